@@ -20,3 +20,33 @@
 {{- define "scaling.chart" -}}
 {{- printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" | trunc 63 | trimSuffix "-" }}
 {{- end }}
+
+{{/*
+Tracing config, shared by the webserver and loadgen
+*/}}
+{{- define "scaling.tracingConfig" -}}
+{
+        "Exporter": {{ .Values.tracing.exporter | quote }},
+        "Endpoint": {{ .Values.tracing.endpoint | quote }},
+        "Insecure": {{ .Values.tracing.insecure }},
+        "Headers": {{ .Values.tracing.headers | toJson }},
+        "Sampler": {{ .Values.tracing.sampler | quote }},
+        "SampleRatio": {{ .Values.tracing.sampleRatio }},
+        "SamplesPerSecond": {{ .Values.tracing.samplesPerSecond }},
+        "ResourceAttributes": {{ .Values.tracing.resourceAttributes | toJson }}
+      }
+{{- end }}
+
+{{/*
+Identifies the pod in trace resource attributes
+*/}}
+{{- define "scaling.podEnvironment" }}
+- name: POD_NAME
+  valueFrom:
+    fieldRef:
+      fieldPath: metadata.name
+- name: POD_NAMESPACE
+  valueFrom:
+    fieldRef:
+      fieldPath: metadata.namespace
+{{- end }}
@@ -32,3 +32,8 @@ app.kubernetes.io/instance: {{ .Release.Name }}
 app.kubernetes.io/component: loadgen-job
 app.kubernetes.io/part-of: loadgen
 {{- end }}
+
+
+{{- define "loadgen.profileClaim" -}}
+{{- default (printf "%s-loadgen-profiles" (include "scaling.fullname" .)) .Values.loadgen.profile.existingClaim }}
+{{- end }}
@@ -9,11 +9,15 @@ import (
 	"github.com/mattfenwick/collections/pkg/json"
 	"github.com/mattfenwick/scaling/pkg/cli"
 	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
 	"github.com/mattfenwick/scaling/pkg/utils"
 	"github.com/mattfenwick/scaling/pkg/webserver"
 	"github.com/sirupsen/logrus"
 )
 
+// metrics are unregistered, since this tool doesn't serve them
+var metrics, _ = telemetry.NewMetrics("client", nil)
+
 func main() {
 	logrus.SetLevel(logrus.InfoLevel)
 
@@ -28,11 +32,11 @@ func main() {
 		utils.Die(err)
 		logrus.Infof("get response: %+v", getResp)
 
-		db, err := database.Connect("postgres", "postgres", "localhost", "scaling")
+		db, err := database.Connect(&database.ConnectionConfig{User: "postgres", Password: "postgres", Host: "localhost", Database: "scaling"})
 		utils.Die(err)
 
 		name, email := "roc", "XAN"
-		dbUsers, err := database.SearchUsers(context.TODO(), db, name, email)
+		dbUsers, err := database.SearchUsers(context.TODO(), db, metrics, name, email)
 		utils.Die(err)
 		fmt.Printf("db users: %+v\n", json.MustMarshalToString(dbUsers))
 
@@ -41,11 +45,11 @@ func main() {
 		fmt.Printf("api users: %s\n", json.MustMarshalToString(apiUsers))
 
 		for _, user := range dbUsers {
-			timelineMessages, err := database.GetUserTimeline(context.TODO(), db, user.UserId)
+			timelineMessages, err := database.GetUserTimeline(context.TODO(), db, metrics, user.UserId)
 			utils.Die(err)
 			fmt.Printf("timeline for user %s (%s, %s):\n%s\n\n", user.UserId.String(), user.Name, user.Email, json.MustMarshalToString(timelineMessages))
 
-			userMessages, err := database.GetUserMessages(context.TODO(), db, user.UserId)
+			userMessages, err := database.GetUserMessages(context.TODO(), db, metrics, user.UserId)
 			utils.Die(err)
 			fmt.Printf("messages sent by user %s (%s, %s):\n%s\n\n", user.UserId.String(), user.Name, user.Email, json.MustMarshalToString(userMessages))
 		}
@@ -69,29 +73,29 @@ func userTimelineAndMessageTest(db *sql.DB, client *webserver.Client) {
 		user1 := database.NewUser("utamt1", "utamt1@scaling.local")
 		user2 := database.NewUser("utamt-two", "utamt-two@scaling.local")
 		// insert users
-		utils.Die(database.InsertUser(context.TODO(), db, user1))
-		utils.Die(database.InsertUser(context.TODO(), db, user2))
+		utils.Die(database.InsertUser(context.TODO(), db, metrics, user1))
+		utils.Die(database.InsertUser(context.TODO(), db, metrics, user2))
 		// have user2 follow user1
-		utils.Die(database.InsertFollower(context.TODO(), db, database.NewFollower(user1.UserId, user2.UserId)))
+		utils.Die(database.InsertFollower(context.TODO(), db, metrics, database.NewFollower(user1.UserId, user2.UserId)))
 		// create message objects
 		message1user1 := database.NewMessage(user1.UserId, "this is message 1, from user 1")
 		message2user1 := database.NewMessage(user1.UserId, "this is message 2, from user 1")
 		message1user2 := database.NewMessage(user2.UserId, "this is message 1, from user 2")
 		// insert messages
-		utils.Die(database.InsertMessage(context.TODO(), db, message1user1))
-		utils.Die(database.InsertMessage(context.TODO(), db, message2user1))
-		utils.Die(database.InsertMessage(context.TODO(), db, message1user2))
+		utils.Die(database.InsertMessage(context.TODO(), db, metrics, message1user1))
+		utils.Die(database.InsertMessage(context.TODO(), db, metrics, message2user1))
+		utils.Die(database.InsertMessage(context.TODO(), db, metrics, message1user2))
 
 		// look at timelines, messages
-		timeline1, err := database.GetUserTimeline(context.TODO(), db, user1.UserId)
+		timeline1, err := database.GetUserTimeline(context.TODO(), db, metrics, user1.UserId)
 		utils.Die(err)
-		messages1, err := database.GetUserMessages(context.TODO(), db, user1.UserId)
+		messages1, err := database.GetUserMessages(context.TODO(), db, metrics, user1.UserId)
 		utils.Die(err)
 		fmt.Printf("user1 (%s) timeline and messages:\n%s\n\n", user1.UserId.String(), json.MustMarshalToString(map[string]any{"timeline": timeline1, "messages": messages1}))
 
-		timeline2, err := database.GetUserTimeline(context.TODO(), db, user2.UserId)
+		timeline2, err := database.GetUserTimeline(context.TODO(), db, metrics, user2.UserId)
 		utils.Die(err)
-		messages2, err := database.GetUserMessages(context.TODO(), db, user2.UserId)
+		messages2, err := database.GetUserMessages(context.TODO(), db, metrics, user2.UserId)
 		utils.Die(err)
 		fmt.Printf("user2 (%s) timeline and messages:\n%s\n\n", user2.UserId.String(), json.MustMarshalToString(map[string]any{"timeline": timeline2, "messages": messages2}))
 	}
@@ -104,7 +108,7 @@ func userTimelineAndMessageTest(db *sql.DB, client *webserver.Client) {
 		utils.Die(err)
 
 		// have user2 follow user1
-		_, err = client.FollowUser(context.TODO(), &webserver.FollowRequest{FolloweeUserId: user1.UserId, FollowerUserId: user2.UserId})
+		_, err = client.Follow(context.TODO(), &webserver.FollowRequest{FolloweeUserId: user1.UserId, FollowerUserId: user2.UserId})
 		utils.Die(err)
 
 		// create message objects
@@ -143,13 +147,13 @@ func messagesTest(client *webserver.Client) {
 }
 
 func tableSizes(db *sql.DB) {
-	rowCounts, err := database.GetTableSizes(context.TODO(), db)
+	rowCounts, err := database.GetTableSizes(context.TODO(), db, metrics)
 	utils.Die(err)
 	fmt.Printf("row counts: %+v\n", rowCounts)
 }
 
 func searchMessages(db *sql.DB) {
-	messages, err := database.SearchMessages(context.TODO(), db, "banan")
+	messages, err := database.SearchMessages(context.TODO(), db, metrics, "banan")
 	utils.Die(err)
 	fmt.Printf("searched messages, found %d:\n%s\n", len(messages), json.MustMarshalToString(messages))
 }
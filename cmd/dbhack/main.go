@@ -8,15 +8,19 @@ import (
 
 	"github.com/mattfenwick/collections/pkg/json"
 	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
 	"github.com/mattfenwick/scaling/pkg/utils"
 )
 
+// metrics are unregistered, since this tool doesn't serve them
+var metrics, _ = telemetry.NewMetrics("dbhack", nil)
+
 func main() {
 	user := "postgres"
 	pw := "postgres"
 	host := "localhost"
 	initDbName := "hack"
-	db, err := database.Connect(user, pw, host, initDbName)
+	db, err := database.Connect(&database.ConnectionConfig{User: user, Password: pw, Host: host, Database: initDbName})
 	utils.Die(err)
 
 	ctx := context.Background()
@@ -25,21 +29,21 @@ func main() {
 	user1 := database.NewUser("abc def", "abcdef@whatever.com")
 	user2 := database.NewUser("qrs xyz", "qrsxyz@whatever.com")
 
-	err = database.InsertUser(ctx, db, user1)
+	err = database.InsertUser(ctx, db, metrics, user1)
 	utils.Die(err)
-	err = database.InsertUser(ctx, db, user2)
+	err = database.InsertUser(ctx, db, metrics, user2)
 	utils.Die(err)
 
-	users, err := database.GetUsers(ctx, db)
+	users, err := database.GetUsers(ctx, db, metrics)
 	utils.Die(err)
 	fmt.Printf("users: %s\n", json.MustMarshalToString(users))
 
 	// followers
 	follower1 := database.NewFollower(user1.UserId, user2.UserId)
-	err = database.InsertFollower(ctx, db, follower1)
+	err = database.InsertFollower(ctx, db, metrics, follower1)
 	utils.Die(err)
 
-	followers, err := database.GetFollowers(ctx, db)
+	followers, err := database.GetFollowers(ctx, db, metrics)
 	utils.Die(err)
 	fmt.Printf("followers: %s\n", json.MustMarshalToString(followers))
 
@@ -47,12 +51,12 @@ func main() {
 	message1 := database.NewMessage(user1.UserId, "hi, i'm user 1")
 	message2 := database.NewMessage(user2.UserId, "whereas I'm user 2")
 
-	err = database.InsertMessage(ctx, db, message1)
+	err = database.InsertMessage(ctx, db, metrics, message1)
 	utils.Die(err)
-	err = database.InsertMessage(ctx, db, message2)
+	err = database.InsertMessage(ctx, db, metrics, message2)
 	utils.Die(err)
 
-	messages, err := database.GetMessages(ctx, db)
+	messages, err := database.GetMessages(ctx, db, metrics)
 	utils.Die(err)
 	fmt.Printf("messages: %s\n", json.MustMarshalToString(messages))
 
@@ -60,26 +64,26 @@ func main() {
 	upvote1 := database.NewUpvote(user1.UserId, message1.MessageId)
 	upvote2 := database.NewUpvote(user1.UserId, message2.MessageId)
 
-	err = database.InsertUpvote(ctx, db, upvote1)
+	err = database.InsertUpvote(ctx, db, metrics, upvote1)
 	utils.Die(err)
-	err = database.InsertUpvote(ctx, db, upvote2)
+	err = database.InsertUpvote(ctx, db, metrics, upvote2)
 	utils.Die(err)
 
-	upvotes, err := database.ReadAllUpvotes(ctx, db)
+	upvotes, err := database.ReadAllUpvotes(ctx, db, metrics)
 	utils.Die(err)
 	fmt.Printf("upvotes: %s\n", json.MustMarshalToString(upvotes))
 
 	// find followers by user
-	allUsers, err := database.GetUsers(ctx, db)
+	allUsers, err := database.GetUsers(ctx, db, metrics)
 	utils.Die(err)
 	for _, user := range allUsers {
-		userFollowers, err := database.GetFollowersOfUser(ctx, db, user.UserId)
+		userFollowers, err := database.GetFollowersOfUser(ctx, db, metrics, user.UserId)
 		utils.Die(err)
 		for _, follower := range userFollowers {
 			fmt.Printf("follower of %s (%s): %s (%s)\n", user.Name, user.UserId, follower.Name, follower.UserId)
 		}
 
-		timelineMessages, err := database.GetUserTimeline(ctx, db, user.UserId)
+		timelineMessages, err := database.GetUserTimeline(ctx, db, metrics, user.UserId)
 		utils.Die(err)
 		for _, message := range timelineMessages {
 			fmt.Printf("timeline message for %s (%s): %d upvotes, %s (%s)\n", user.Name, user.UserId, message.UpvoteCount, message.Content, message.MessageId)
@@ -11,27 +11,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-/*
-/users
- - POST => fancy search
- - GET => naive list of users
-
-/message
- - POST => create
- - GET => by message's uuid
-/messages
- - POST => fancy search
- - GET => naive list of messages
-
-/follow
- - POST
-/followers
- - GET => by user's uuid
-
-/upvote
- - POST
-
-*/
+// see docs/openapi.json for the routes exercised here
 
 func main() {
 	logrus.SetLevel(logrus.InfoLevel)
@@ -59,12 +39,12 @@ func main() {
 	fmt.Printf("get message 2-1 (%s): %s\n", mess21.MessageId.String(), json.MustMarshalToString(utils.DoOrDie(client.GetMessage(context.TODO(), &webserver.GetMessageRequest{MessageId: mess21.MessageId}))))
 
 	// user2 follows user1
-	utils.DoOrDie(client.FollowUser(context.TODO(), &webserver.FollowRequest{FolloweeUserId: createUser1.UserId, FollowerUserId: createUser2.UserId}))
+	utils.DoOrDie(client.Follow(context.TODO(), &webserver.FollowRequest{FolloweeUserId: createUser1.UserId, FollowerUserId: createUser2.UserId}))
 
 	// upvotes
-	utils.DoOrDie(client.UpvoteMessage(context.TODO(), &webserver.CreateUpvoteRequest{UserId: createUser1.UserId, MessageId: mess21.MessageId}))
-	utils.DoOrDie(client.UpvoteMessage(context.TODO(), &webserver.CreateUpvoteRequest{UserId: createUser2.UserId, MessageId: mess11.MessageId}))
-	utils.DoOrDie(client.UpvoteMessage(context.TODO(), &webserver.CreateUpvoteRequest{UserId: createUser2.UserId, MessageId: mess21.MessageId}))
+	utils.DoOrDie(client.CreateUpvote(context.TODO(), &webserver.CreateUpvoteRequest{UserId: createUser1.UserId, MessageId: mess21.MessageId}))
+	utils.DoOrDie(client.CreateUpvote(context.TODO(), &webserver.CreateUpvoteRequest{UserId: createUser2.UserId, MessageId: mess11.MessageId}))
+	utils.DoOrDie(client.CreateUpvote(context.TODO(), &webserver.CreateUpvoteRequest{UserId: createUser2.UserId, MessageId: mess21.MessageId}))
 
 	// get messages
 	fmt.Printf("get messages: %s\n", json.MustMarshalToString(utils.DoOrDie(client.GetMessages(context.TODO(), &webserver.GetMessagesRequest{}))))
@@ -1,19 +1,71 @@
 package main
 
 import (
+	"bytes"
 	"debug/buildinfo"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
 	"os"
+	"strings"
+	"unicode"
 
 	"github.com/mattfenwick/collections/pkg/file"
 	"github.com/mattfenwick/collections/pkg/json"
 	"github.com/mattfenwick/scaling/pkg/utils"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+// hack reads the `route:`, `legacy:` and `stream:` annotations on the Responder interface,
+// and writes out the route tables and the http client methods.  It's run by `go generate` from
+// pkg/webserver, so paths are relative to that directory.
+const (
+	interfaceFile = "responder.go"
+	interfaceName = "Responder"
+	routesFile    = "routes_generated.go"
+	clientFile    = "client_generated.go"
+
+	routePrefix  = "route:"
+	legacyPrefix = "legacy:"
+	streamPrefix = "stream:"
+	header       = "// Code generated by cmd/hack from responder.go; DO NOT EDIT.\n\n"
+)
+
+// Binding is an annotation's http method, path constant and maximum request body size
+type Binding struct {
+	Verb         string
+	PathConstant string
+	MaxSize      string
+}
+
+type Endpoint struct {
+	Method string
+	Binding
+	// Legacy is the endpoint's unversioned route, if it has one
+	Legacy *Binding
+	// Stream is the method which streams the endpoint's list, if it has one
+	Stream       string
+	RequestType  string
+	ResponseType string
+}
+
+// Name turns a method name such as "GetUserTimeline" into "get user timeline"
+func (e *Endpoint) Name() string {
+	var words []string
+	start := 0
+	for i, r := range e.Method {
+		if i > 0 && unicode.IsUpper(r) {
+			words = append(words, strings.ToLower(e.Method[start:i]))
+			start = i
+		}
+	}
+	words = append(words, strings.ToLower(e.Method[start:]))
+	return strings.Join(words, " ")
+}
+
 func PrintBuildInfo() {
 	name := os.Args[1]
 	info, err := buildinfo.ReadFile(name)
@@ -22,32 +74,181 @@ func PrintBuildInfo() {
 }
 
 func main() {
-	filename := "cmd/hack/hack.go"
-	src, err := file.ReadString(filename)
+	endpoints, err := ParseEndpoints(interfaceFile, interfaceName)
 	utils.Die(err)
 
-	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, filename, src, 0)
-	utils.Die(errors.Wrapf(err, "unable to ParseFile %s", filename))
+	utils.Die(writeGoFile(routesFile, GenerateRoutes(endpoints)))
+	utils.Die(writeGoFile(clientFile, GenerateClient(endpoints)))
+	logrus.Infof("generated %d endpoints into %s and %s", len(endpoints), routesFile, clientFile)
+}
+
+func ParseEndpoints(filename string, name string) ([]*Endpoint, error) {
+	src, err := file.ReadString(filename)
+	if err != nil {
+		return nil, err
+	}
 
-	//fmt.Printf("%s\n\n", json.MustMarshalToString(f)) // hits cycle
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to ParseFile %s", filename)
+	}
 
-	// Inspect the AST and print all identifiers and literals.
+	var iface *ast.InterfaceType
 	ast.Inspect(f, func(n ast.Node) bool {
-		//fmt.Printf("node: %T; %s\n\n", n, json.MustMarshalToString(n))
-		fmt.Printf("node: %T\n", n)
-		var s string
-		switch x := n.(type) {
-		case *ast.BasicLit:
-			s = x.Value
-		case *ast.Ident:
-			s = x.Name
-		}
-		if s != "" {
-			fmt.Printf("%s:\t%s\n", fset.Position(n.Pos()), s)
+		if spec, ok := n.(*ast.TypeSpec); ok && spec.Name.Name == name {
+			iface, _ = spec.Type.(*ast.InterfaceType)
+			return false
 		}
 		return true
 	})
+	if iface == nil {
+		return nil, errors.Errorf("unable to find interface %s in %s", name, filename)
+	}
+
+	var endpoints []*Endpoint
+	for _, method := range iface.Methods.List {
+		annotation, ok := findAnnotation(method.Doc, routePrefix)
+		if !ok {
+			continue
+		}
+		position := fset.Position(method.Pos())
+		endpoint, err := parseMethod(method, annotation)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid endpoint at %s", position)
+		}
+		if legacy, ok := findAnnotation(method.Doc, legacyPrefix); ok {
+			endpoint.Legacy, err = parseBinding(legacyPrefix, legacy)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid legacy route at %s", position)
+			}
+		}
+		if stream, ok := findAnnotation(method.Doc, streamPrefix); ok {
+			if len(strings.Fields(stream)) != 1 {
+				return nil, errors.Errorf("expected `%s StreamMethod` at %s, found '%s'", streamPrefix, position, stream)
+			}
+			endpoint.Stream = stream
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+func findAnnotation(doc *ast.CommentGroup, prefix string) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	for _, comment := range doc.List {
+		text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "//"))
+		if strings.HasPrefix(text, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(text, prefix)), true
+		}
+	}
+	return "", false
+}
+
+// parseBinding expects an annotation of the form `VERB PathConstant [maxSize]`
+func parseBinding(prefix string, annotation string) (*Binding, error) {
+	fields := strings.Fields(annotation)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, errors.Errorf("expected `%s VERB PathConstant [maxSize]`, found '%s'", prefix, annotation)
+	}
+	binding := &Binding{Verb: fields[0], PathConstant: fields[1], MaxSize: "0"}
+	if len(fields) == 3 {
+		binding.MaxSize = fields[2]
+	}
+	return binding, nil
+}
+
+// parseMethod expects a method of the form `Name(context.Context, *Request) (*Response, error)`,
+// annotated with `route: VERB PathConstant [maxSize]`
+func parseMethod(method *ast.Field, annotation string) (*Endpoint, error) {
+	binding, err := parseBinding(routePrefix, annotation)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := &Endpoint{Method: method.Names[0].Name, Binding: *binding}
+
+	funcType, ok := method.Type.(*ast.FuncType)
+	if !ok {
+		return nil, errors.Errorf("%s is not a method", endpoint.Method)
+	}
+	if len(funcType.Params.List) != 2 || funcType.Results == nil || len(funcType.Results.List) != 2 {
+		return nil, errors.Errorf("%s: expected 2 params and 2 results", endpoint.Method)
+	}
+	endpoint.RequestType, err = pointerTypeName(funcType.Params.List[1].Type)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s request", endpoint.Method)
+	}
+	endpoint.ResponseType, err = pointerTypeName(funcType.Results.List[0].Type)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s response", endpoint.Method)
+	}
+	return endpoint, nil
+}
+
+func pointerTypeName(expr ast.Expr) (string, error) {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return "", errors.Errorf("expected a pointer type, found %T", expr)
+	}
+	ident, ok := star.X.(*ast.Ident)
+	if !ok {
+		return "", errors.Errorf("expected a pointer to a named type, found %T", star.X)
+	}
+	return ident.Name, nil
+}
+
+func GenerateRoutes(endpoints []*Endpoint) string {
+	b := &bytes.Buffer{}
+	b.WriteString(header)
+	b.WriteString("package webserver\n\n")
+	b.WriteString("func V1Routes(responder Responder) []*Route {\n\treturn []*Route{\n")
+	for _, e := range endpoints {
+		writeRoute(b, e, &e.Binding)
+	}
+	b.WriteString("\t}\n}\n\n")
+	b.WriteString("// LegacyRoutes are the unversioned routes kept for existing clients, which send path\n")
+	b.WriteString("// parameters in the query string or the body\n")
+	b.WriteString("func LegacyRoutes(responder Responder) []*Route {\n\treturn []*Route{\n")
+	for _, e := range endpoints {
+		if e.Legacy != nil {
+			writeRoute(b, e, e.Legacy)
+		}
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+func writeRoute(b *bytes.Buffer, e *Endpoint, binding *Binding) {
+	if e.Stream != "" {
+		fmt.Fprintf(b, "\t\tNewListRoute(%q, %q, %s, %s, responder.%s, responder.%s),\n", e.Name(), binding.Verb, binding.PathConstant, binding.MaxSize, e.Method, e.Stream)
+	} else {
+		fmt.Fprintf(b, "\t\tNewRoute(%q, %q, %s, %s, responder.%s),\n", e.Name(), binding.Verb, binding.PathConstant, binding.MaxSize, e.Method)
+	}
+}
+
+func GenerateClient(endpoints []*Endpoint) string {
+	b := &bytes.Buffer{}
+	b.WriteString(header)
+	b.WriteString("package webserver\n\nimport \"context\"\n\n")
+	b.WriteString("// API is the part of Responder which is exposed to clients\n")
+	b.WriteString("type API interface {\n")
+	for _, e := range endpoints {
+		fmt.Fprintf(b, "\t%s(context.Context, *%s) (*%s, error)\n", e.Method, e.RequestType, e.ResponseType)
+	}
+	b.WriteString("}\n\nvar _ API = &Client{}\n")
+	for _, e := range endpoints {
+		fmt.Fprintf(b, "\nfunc (c *Client) %s(ctx context.Context, request *%s) (*%s, error) {\n", e.Method, e.RequestType, e.ResponseType)
+		fmt.Fprintf(b, "\treturn issueRequest[%s](ctx, c, %q, %s, request)\n}\n", e.ResponseType, e.Verb, e.PathConstant)
+	}
+	return b.String()
+}
 
-	utils.Die(ast.Print(fset, f))
+func writeGoFile(path string, src string) error {
+	formatted, err := format.Source([]byte(src))
+	if err != nil {
+		return errors.Wrapf(err, "unable to format generated source for %s", path)
+	}
+	return errors.Wrapf(os.WriteFile(path, formatted, 0644), "unable to write %s", path)
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+
+	"github.com/mattfenwick/collections/pkg/file"
+	"github.com/mattfenwick/collections/pkg/json"
+	"github.com/mattfenwick/scaling/pkg/utils"
+	"github.com/mattfenwick/scaling/pkg/webserver"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const specPath = "docs/openapi.json"
+
+// usage:
+//
+//	go run ./cmd/openapi write   # regenerate docs/openapi.json
+//	go run ./cmd/openapi check   # fail if docs/openapi.json is out of date
+func main() {
+	mode := "check"
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
+
+	utils.Die(webserver.ValidateRoutes(webserver.V1Routes((*webserver.Model)(nil))))
+	generated := json.MustMarshalToString(webserver.V1OpenAPI())
+
+	switch mode {
+	case "write":
+		utils.Die(file.WriteString(specPath, generated, 0644))
+		logrus.Infof("wrote %s", specPath)
+	case "check":
+		existing, err := file.ReadString(specPath)
+		utils.Die(err)
+		if existing != generated {
+			utils.Die(errors.Errorf("%s is out of date with the route table: run `make openapi`", specPath))
+		}
+		logrus.Infof("%s is up to date", specPath)
+	default:
+		utils.Die(errors.Errorf("invalid mode: %s", mode))
+	}
+}
@@ -7,3 +7,5 @@ make fmt
 make vet
 
 make test
+
+make openapi-check
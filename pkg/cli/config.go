@@ -1,27 +1,67 @@
 package cli
 
-import "github.com/mattfenwick/scaling/pkg/loadgen"
+import (
+	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/mattfenwick/scaling/pkg/loadgen"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/mattfenwick/scaling/pkg/webserver"
+)
 
 type Config struct {
-	LogLevel       string
+	LogLevel string
+	// LogFormat is text or json; the default is text
+	LogFormat string
+	// JaegerURL is shorthand for a jaeger Tracing exporter, used if Tracing.Exporter isn't set
 	JaegerURL      string
 	PrometheusPort int
 
-	Webserver struct {
-		Host          string
-		ContainerPort int
-		ServicePort   int
-	}
+	Tracing telemetry.TracingConfig
+
+	Webserver webserver.Config
 
 	Postgres *PostgresConfig
 
 	LoadGen loadgen.Config
 }
 
+// PostgresConfig is the settings for connecting to Database; AdminDatabase is used, with
+// the same settings, to create Database if it doesn't exist yet
 type PostgresConfig struct {
-	Host          string
-	User          string
-	Password      string
+	database.ConnectionConfig
 	AdminDatabase string
-	Database      string
+}
+
+// Connection returns the settings for connecting to databaseName
+func (c *PostgresConfig) Connection(databaseName string) *database.ConnectionConfig {
+	out := c.ConnectionConfig
+	out.Database = databaseName
+	return &out
+}
+
+func (c *Config) TracingOrDefault() *telemetry.TracingConfig {
+	out := c.Tracing
+	if out.Exporter == "" && c.JaegerURL != "" {
+		out.Exporter = telemetry.TraceExporterJaeger
+		out.Endpoint = c.JaegerURL
+	}
+	return &out
+}
+
+// Redacted returns a copy of the config which is safe to log or expose
+func (c *Config) Redacted() *Config {
+	out := *c
+	if c.Postgres != nil {
+		pg := *c.Postgres
+		pg.Password = "REDACTED"
+		out.Postgres = &pg
+	}
+	out.Webserver.Outbox = c.Webserver.Outbox.Redacted()
+	if len(c.Tracing.Headers) > 0 {
+		// these often carry api keys
+		out.Tracing.Headers = map[string]string{}
+		for key := range c.Tracing.Headers {
+			out.Tracing.Headers[key] = "REDACTED"
+		}
+	}
+	return &out
 }
@@ -3,6 +3,7 @@ package cli
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 
 	"github.com/mattfenwick/collections/pkg/json"
@@ -29,7 +30,8 @@ func Run() {
 func RunWithConfig(mode string, config *Config) {
 	rootContext := context.Background()
 
-	tp, err, cleanup := telemetry.Setup(rootContext, config.LogLevel, mode, config.PrometheusPort, config.JaegerURL)
+	admin := http.NewServeMux()
+	metrics, tp, err, cleanup := telemetry.Setup(rootContext, config.LogLevel, config.LogFormat, mode, config.PrometheusPort, admin, config.TracingOrDefault())
 	defer cleanup()
 	utils.Die(err)
 
@@ -37,44 +39,65 @@ func RunWithConfig(mode string, config *Config) {
 	case "schema":
 		pg := config.Postgres
 
-		adminDb, err := database.Connect(pg.User, pg.Password, pg.Host, pg.AdminDatabase)
+		adminDb, err := database.Connect(pg.Connection(pg.AdminDatabase))
 		utils.Die(err)
-		utils.Die(database.CreateDatabaseIfNotExists(rootContext, adminDb, pg.Database))
+		utils.Die(database.CreateDatabaseIfNotExists(rootContext, adminDb, metrics, pg.Database))
 
-		db, err := database.Connect(pg.User, pg.Password, pg.Host, pg.Database)
+		db, err := database.Connect(&pg.ConnectionConfig)
 		utils.Die(err)
-		utils.Die(database.InitializeSchema(rootContext, db))
+		utils.Die(database.InitializeSchema(rootContext, db, metrics))
 	case "webserver":
 		pg := config.Postgres
 
-		adminDb, err := database.Connect(pg.User, pg.Password, pg.Host, pg.AdminDatabase)
+		adminDb, err := database.Connect(pg.Connection(pg.AdminDatabase))
 		utils.Die(err)
-		utils.Die(database.CreateDatabaseIfNotExists(rootContext, adminDb, pg.Database))
+		utils.Die(database.CreateDatabaseIfNotExists(rootContext, adminDb, metrics, pg.Database))
 
-		db, err := database.Connect(pg.User, pg.Password, pg.Host, pg.Database)
+		db, err := database.Connect(&pg.ConnectionConfig)
 		utils.Die(err)
-		webserver.Run(config.Webserver.ContainerPort, tp, db)
+		utils.Die(metrics.RegisterDBStats(db, pg.Database))
+		listener, err := database.NewListener(pg.URL(), db, config.Webserver.EventRetention(), metrics)
+		utils.Die(err)
+		if err := webserver.Run(&config.Webserver, config.Redacted(), tp, metrics, admin, db, listener); err != nil {
+			// utils.Die would exit without flushing telemetry, which is when it matters most
+			logrus.Errorf("webserver failed: %+v", err)
+			cleanup()
+			os.Exit(1)
+		}
 	case "loadgen":
-		url := fmt.Sprintf("http://%s:%d", config.Webserver.Host, config.Webserver.ServicePort)
-		client := webserver.NewClient(url)
-		loadgen.Cli(client, &config.LoadGen)
+		var client webserver.API
+		switch config.LoadGen.Transport {
+		case "", "http":
+			client = webserver.NewClient(fmt.Sprintf("http://%s:%d", config.Webserver.Host, config.Webserver.ServicePort))
+		case "grpc":
+			grpcClient, err := webserver.NewGRPCClient(fmt.Sprintf("%s:%d", config.Webserver.Host, config.Webserver.GRPCServicePort))
+			utils.Die(err)
+			defer grpcClient.Close()
+			client = grpcClient
+		default:
+			utils.Die(errors.Errorf("invalid loadgen transport: %s", config.LoadGen.Transport))
+		}
+		loadgen.Cli(client, &config.LoadGen, metrics)
+	case "benchmark":
+		pg := config.Postgres
+
+		adminDb, err := database.Connect(pg.Connection(pg.AdminDatabase))
+		utils.Die(err)
+		utils.Die(database.CreateDatabaseIfNotExists(rootContext, adminDb, metrics, pg.Database))
+
+		db, err := database.Connect(&pg.ConnectionConfig)
+		utils.Die(err)
+		defer db.Close()
+		result, err := loadgen.Benchmark(rootContext, &config.LoadGen, &config.Webserver, tp, db)
+		utils.Die(err)
+		fmt.Println(json.MustMarshalToString(result))
 	default:
 		panic(errors.Errorf("invalid mode: %s", mode))
 	}
 }
 
-var (
-	version   = "development"
-	gitSHA    = "development"
-	buildTime = "development"
-)
-
 func RunVersionCommand() {
-	jsonString, err := json.MarshalToString(map[string]string{
-		"Version":   version,
-		"GitSHA":    gitSHA,
-		"BuildTime": buildTime,
-	})
+	jsonString, err := json.MarshalToString(utils.VersionInfo())
 	utils.Die(err)
 	logrus.Infof("scaling version: \n%s\n", jsonString)
 }
@@ -4,24 +4,123 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strconv"
+	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+)
 
-	"net/url"
+type ConnectionConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
 
-	"github.com/pkg/errors"
-)
+	// SSLMode is one of lib/pq's sslmodes: disable, require, verify-ca or verify-full
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	// ApplicationName shows up in pg_stat_activity, which helps to tell clients apart
+	ApplicationName string
+	// StatementTimeoutMilliseconds makes postgres cancel slow statements; zero means no limit
+	StatementTimeoutMilliseconds int
+
+	MaxOpenConns           int
+	MaxIdleConns           int
+	ConnMaxLifetimeSeconds int
+	ConnMaxIdleTimeSeconds int
+}
+
+func (c *ConnectionConfig) PortOrDefault() int {
+	if c.Port <= 0 {
+		return 5432
+	}
+	return c.Port
+}
+
+func (c *ConnectionConfig) SSLModeOrDefault() string {
+	if c.SSLMode == "" {
+		return "disable"
+	}
+	return c.SSLMode
+}
+
+func (c *ConnectionConfig) ApplicationNameOrDefault() string {
+	if c.ApplicationName == "" {
+		return "scaling"
+	}
+	return c.ApplicationName
+}
+
+func (c *ConnectionConfig) MaxOpenConnsOrDefault() int {
+	if c.MaxOpenConns <= 0 {
+		return 5
+	}
+	return c.MaxOpenConns
+}
+
+// MaxIdleConnsOrDefault defaults to, and is capped at, the max open connections
+func (c *ConnectionConfig) MaxIdleConnsOrDefault() int {
+	if c.MaxIdleConns <= 0 || c.MaxIdleConns > c.MaxOpenConnsOrDefault() {
+		return c.MaxOpenConnsOrDefault()
+	}
+	return c.MaxIdleConns
+}
+
+// ConnMaxLifetime is zero, meaning connections are reused forever, unless configured
+func (c *ConnectionConfig) ConnMaxLifetime() time.Duration {
+	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
+}
+
+// ConnMaxIdleTime is zero, meaning idle connections are kept forever, unless configured
+func (c *ConnectionConfig) ConnMaxIdleTime() time.Duration {
+	return time.Duration(c.ConnMaxIdleTimeSeconds) * time.Second
+}
+
+func (c *ConnectionConfig) url() *url.URL {
+	query := url.Values{}
+	query.Set("sslmode", c.SSLModeOrDefault())
+	if c.SSLRootCert != "" {
+		query.Set("sslrootcert", c.SSLRootCert)
+	}
+	if c.SSLCert != "" {
+		query.Set("sslcert", c.SSLCert)
+	}
+	if c.SSLKey != "" {
+		query.Set("sslkey", c.SSLKey)
+	}
+	query.Set("application_name", c.ApplicationNameOrDefault())
+	if c.StatementTimeoutMilliseconds > 0 {
+		// lib/pq passes unrecognized parameters on to the server as settings
+		query.Set("statement_timeout", strconv.Itoa(c.StatementTimeoutMilliseconds))
+	}
+	return &url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     fmt.Sprintf("%s:%d", c.Host, c.PortOrDefault()),
+		Path:     "/" + c.Database,
+		RawQuery: query.Encode(),
+	}
+}
+
+func (c *ConnectionConfig) URL() string {
+	return c.url().String()
+}
+
+// RedactedURL is the connection URL with the password hidden, for logging
+func (c *ConnectionConfig) RedactedURL() string {
+	return c.url().Redacted()
+}
 
-func Connect(user string, password string, host string, database string) (*sql.DB, error) {
-	dbConnectionURL := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable",
-		user,
-		url.QueryEscape(password),
-		host,
-		5432,
-		database)
-	logrus.Infof("attempting to connect to postgres at '%s'", dbConnectionURL)
-	db, err := sql.Open("postgres", dbConnectionURL)
+func Connect(config *ConnectionConfig) (*sql.DB, error) {
+	logrus.Infof("attempting to connect to postgres at '%s'", config.RedactedURL())
+	db, err := sql.Open("postgres", config.URL())
 	if err != nil {
 		return db, errors.Wrap(err, "unable to open postgres connection")
 	}
@@ -29,9 +128,12 @@ func Connect(user string, password string, host string, database string) (*sql.D
 		return db, errors.Wrap(err, "unable to ping postgres")
 	}
 
-	db.SetMaxIdleConns(5)
-	db.SetMaxOpenConns(5)
-	db.SetConnMaxLifetime(0)
+	db.SetMaxOpenConns(config.MaxOpenConnsOrDefault())
+	db.SetMaxIdleConns(config.MaxIdleConnsOrDefault())
+	db.SetConnMaxLifetime(config.ConnMaxLifetime())
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime())
+	logrus.Infof("postgres pool: %d open, %d idle, lifetime %s, idle time %s",
+		config.MaxOpenConnsOrDefault(), config.MaxIdleConnsOrDefault(), config.ConnMaxLifetime(), config.ConnMaxIdleTime())
 
 	return db, nil
 }
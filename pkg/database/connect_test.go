@@ -0,0 +1,45 @@
+package database
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactedURLHidesThePassword(t *testing.T) {
+	config := &ConnectionConfig{Host: "db", User: "scaling", Password: "s3cret/p@ss", Database: "scaling", StatementTimeoutMilliseconds: 500}
+	redacted := config.RedactedURL()
+	if strings.Contains(redacted, "s3cret") || strings.Contains(redacted, url.QueryEscape("s3cret/p@ss")) {
+		t.Errorf("expected the password to be hidden, got %s", redacted)
+	}
+	if !strings.Contains(redacted, "scaling:xxxxx@db:5432/scaling") {
+		t.Errorf("expected everything but the password to be kept, got %s", redacted)
+	}
+
+	parsed, err := url.Parse(config.URL())
+	if err != nil {
+		t.Fatalf("unable to parse url: %+v", err)
+	}
+	if password, _ := parsed.User.Password(); password != config.Password {
+		t.Errorf("expected the real url to have the password, got %q", password)
+	}
+	query := parsed.Query()
+	if query.Get("sslmode") != "disable" || query.Get("application_name") != "scaling" || query.Get("statement_timeout") != "500" {
+		t.Errorf("expected defaults and the statement timeout in the query, got %s", parsed.RawQuery)
+	}
+}
+
+func TestPoolSettings(t *testing.T) {
+	defaults := &ConnectionConfig{}
+	if defaults.MaxOpenConnsOrDefault() != 5 || defaults.MaxIdleConnsOrDefault() != 5 || defaults.ConnMaxLifetime() != 0 {
+		t.Errorf("unexpected defaults: %d open, %d idle, lifetime %s", defaults.MaxOpenConnsOrDefault(), defaults.MaxIdleConnsOrDefault(), defaults.ConnMaxLifetime())
+	}
+	config := &ConnectionConfig{MaxOpenConns: 10, MaxIdleConns: 20, ConnMaxLifetimeSeconds: 60}
+	if config.MaxIdleConnsOrDefault() != 10 {
+		t.Errorf("expected idle connections to be capped at the open connections, got %d", config.MaxIdleConnsOrDefault())
+	}
+	if config.ConnMaxLifetime() != time.Minute {
+		t.Errorf("expected a lifetime of a minute, got %s", config.ConnMaxLifetime())
+	}
+}
@@ -0,0 +1,302 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	EventsChannel = "scaling_events"
+
+	// an event's kind is the name of the table which was written to
+	EventKindUser     = "users"
+	EventKindFollower = "followers"
+	EventKindMessage  = "messages"
+	EventKindUpvote   = "upvotes"
+)
+
+// Event is a row of the events table, which is written by the notify_event trigger
+type Event struct {
+	EventId   int64
+	Kind      string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+}
+
+var loadEvent = func(rows *sql.Rows, record *Event) error {
+	return rows.Scan(&record.EventId, &record.Kind, &record.Payload, &record.CreatedAt)
+}
+
+// GetEventsSince returns events created after since, oldest first
+func GetEventsSince(ctx context.Context, db Querier, metrics *telemetry.Metrics, since time.Time) ([]*Event, error) {
+	return ReadMany(ctx, db, metrics, "get_events_since", loadEvent,
+		"select event_id, kind, payload, created_at from events where created_at > $1 order by event_id",
+		since)
+}
+
+func PruneEvents(ctx context.Context, db Querier, metrics *telemetry.Metrics, before time.Time) (int64, error) {
+	result, err := RunStatement(ctx, db, metrics, "prune_events", "delete from events where created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// payloads are the rows as converted by postgres' to_jsonb, so the keys are column names,
+// and timestamps have no zone
+
+const payloadTimeLayout = "2006-01-02T15:04:05.999999"
+
+type payloadTime time.Time
+
+func (t *payloadTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.Parse(payloadTimeLayout, s)
+	*t = payloadTime(parsed)
+	return errors.Wrapf(err, "unable to parse time from '%s'", s)
+}
+
+func (e *Event) User() (*User, error) {
+	var row struct {
+		UserId    uuid.UUID   `json:"user_id"`
+		Name      string      `json:"name"`
+		Email     string      `json:"email"`
+		CreatedAt payloadTime `json:"created_at"`
+	}
+	if err := e.decode(EventKindUser, &row); err != nil {
+		return nil, err
+	}
+	return &User{UserId: row.UserId, Name: row.Name, Email: row.Email, CreatedAt: time.Time(row.CreatedAt)}, nil
+}
+
+func (e *Event) Follower() (*Follower, error) {
+	var row struct {
+		FolloweeUserId uuid.UUID   `json:"followee_user_id"`
+		FollowerUserId uuid.UUID   `json:"follower_user_id"`
+		CreatedAt      payloadTime `json:"created_at"`
+	}
+	if err := e.decode(EventKindFollower, &row); err != nil {
+		return nil, err
+	}
+	return &Follower{FolloweeUserId: row.FolloweeUserId, FollowerUserId: row.FollowerUserId, CreatedAt: time.Time(row.CreatedAt)}, nil
+}
+
+func (e *Event) Message() (*Message, error) {
+	var row struct {
+		MessageId    uuid.UUID   `json:"message_id"`
+		SenderUserId uuid.UUID   `json:"sender_user_id"`
+		Content      string      `json:"content"`
+		CreatedAt    payloadTime `json:"created_at"`
+	}
+	if err := e.decode(EventKindMessage, &row); err != nil {
+		return nil, err
+	}
+	return &Message{MessageId: row.MessageId, SenderUserId: row.SenderUserId, Content: row.Content, CreatedAt: time.Time(row.CreatedAt)}, nil
+}
+
+func (e *Event) Upvote() (*Upvote, error) {
+	var row struct {
+		UpvoteId  uuid.UUID   `json:"upvote_id"`
+		UserId    uuid.UUID   `json:"user_id"`
+		MessageId uuid.UUID   `json:"message_id"`
+		CreatedAt payloadTime `json:"created_at"`
+	}
+	if err := e.decode(EventKindUpvote, &row); err != nil {
+		return nil, err
+	}
+	return &Upvote{UpvoteId: row.UpvoteId, UserId: row.UserId, MessageId: row.MessageId, CreatedAt: time.Time(row.CreatedAt)}, nil
+}
+
+func (e *Event) decode(kind string, out any) error {
+	if e.Kind != kind {
+		return errors.Errorf("expected event of kind %s, found %s", kind, e.Kind)
+	}
+	return errors.Wrapf(json.Unmarshal(e.Payload, out), "unable to decode payload of event %d", e.EventId)
+}
+
+// Listener fans events out to subscribers within this process.
+//
+// Notifications sent while the listener is disconnected are lost, so after reconnecting it
+// replays events from the table, starting a little before the last one it saw: event ids
+// are assigned at insert but become visible at commit, so they can arrive out of order.
+// Recently seen ids are remembered so that replayed events aren't delivered twice.
+type Listener struct {
+	db       *sql.DB
+	listener *pq.Listener
+	metrics  *telemetry.Metrics
+
+	// ReplayMargin is how far before the last seen event to start replaying from
+	ReplayMargin time.Duration
+	// Retention is how long events are kept; zero keeps them forever
+	Retention time.Duration
+
+	mu          sync.Mutex
+	subscribers []func(*Event)
+	seen        *seenEvents
+	lastEventAt time.Time
+}
+
+func NewListener(connectionURL string, db *sql.DB, retention time.Duration, metrics *telemetry.Metrics) (*Listener, error) {
+	l := &Listener{
+		db:           db,
+		metrics:      metrics,
+		ReplayMargin: 5 * time.Second,
+		Retention:    retention,
+		seen:         newSeenEvents(10_000),
+		lastEventAt:  time.Now(),
+	}
+	l.listener = pq.NewListener(connectionURL, time.Second, time.Minute, l.onConnectionEvent)
+	if err := l.listener.Listen(EventsChannel); err != nil {
+		return nil, errors.Wrapf(err, "unable to listen on %s", EventsChannel)
+	}
+	return l, nil
+}
+
+// Subscribe registers f to be called for every event.  Events are delivered one at a time,
+// from the listener's goroutine, so f mustn't block.
+func (l *Listener) Subscribe(f func(*Event)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers = append(l.subscribers, f)
+}
+
+func (l *Listener) onConnectionEvent(event pq.ListenerEventType, err error) {
+	name := map[pq.ListenerEventType]string{
+		pq.ListenerEventConnected:               "connected",
+		pq.ListenerEventDisconnected:            "disconnected",
+		pq.ListenerEventReconnected:             "reconnected",
+		pq.ListenerEventConnectionAttemptFailed: "connection attempt failed",
+	}[event]
+	l.metrics.RecordDBListenerConnectionEvent(name)
+	if err != nil {
+		logrus.Errorf("event listener %s: %+v", name, err)
+	} else {
+		logrus.Infof("event listener %s", name)
+	}
+}
+
+// Run delivers events until ctx is done, or the listener is closed
+func (l *Listener) Run(ctx context.Context) {
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification, ok := <-l.listener.Notify:
+			if !ok {
+				// the listener was closed
+				return
+			}
+			if notification == nil {
+				// nil means the connection was re-established
+				l.replay(ctx)
+				continue
+			}
+			event := &Event{}
+			if err := json.Unmarshal([]byte(notification.Extra), event); err != nil {
+				logrus.Errorf("unable to parse notification '%s': %+v", notification.Extra, err)
+				continue
+			}
+			l.deliver(event, "notify")
+		case <-ping.C:
+			// detects dead connections which would otherwise go unnoticed while idle
+			if err := l.listener.Ping(); err != nil {
+				logrus.Errorf("event listener ping failed: %+v", err)
+			}
+		case <-prune.C:
+			l.prune(ctx)
+		}
+	}
+}
+
+func (l *Listener) replay(ctx context.Context) {
+	l.mu.Lock()
+	since := l.lastEventAt.Add(-l.ReplayMargin)
+	l.mu.Unlock()
+
+	events, err := GetEventsSince(ctx, l.db, l.metrics, since)
+	if err != nil {
+		// there's no later chance to recover these, so they're dropped
+		logrus.Errorf("unable to replay events since %s: %+v", since, err)
+		return
+	}
+	logrus.Infof("replaying %d events since %s", len(events), since)
+	for _, event := range events {
+		l.deliver(event, "replay")
+	}
+}
+
+func (l *Listener) deliver(event *Event, source string) {
+	l.mu.Lock()
+	if !l.seen.Add(event.EventId) {
+		l.mu.Unlock()
+		return
+	}
+	if event.CreatedAt.After(l.lastEventAt) {
+		l.lastEventAt = event.CreatedAt
+	}
+	subscribers := l.subscribers
+	l.mu.Unlock()
+
+	l.metrics.RecordDBEvent(event.Kind, source)
+	for _, f := range subscribers {
+		f(event)
+	}
+}
+
+func (l *Listener) prune(ctx context.Context) {
+	if l.Retention <= 0 {
+		return
+	}
+	count, err := PruneEvents(ctx, l.db, l.metrics, time.Now().Add(-l.Retention))
+	if err != nil {
+		logrus.Errorf("unable to prune events: %+v", err)
+		return
+	}
+	logrus.Debugf("pruned %d events", count)
+}
+
+func (l *Listener) Close() error {
+	return errors.Wrapf(l.listener.Close(), "unable to close event listener")
+}
+
+// seenEvents remembers the most recent ids, up to a limit
+type seenEvents struct {
+	limit int
+	ids   map[int64]bool
+	order []int64
+}
+
+func newSeenEvents(limit int) *seenEvents {
+	return &seenEvents{limit: limit, ids: map[int64]bool{}}
+}
+
+// Add returns false if id has already been seen
+func (s *seenEvents) Add(id int64) bool {
+	if s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	s.order = append(s.order, id)
+	if len(s.order) > s.limit {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
@@ -3,53 +3,218 @@ package database
 import (
 	"context"
 	"database/sql"
+	"time"
 
+	"github.com/mattfenwick/scaling/pkg/telemetry"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-func ReadMany[A any](ctx context.Context, db *sql.DB, process func(*sql.Rows, *A) error, query string, args ...any) ([]*A, error) {
-	rows, err := db.QueryContext(ctx, query, args...)
+// Querier is satisfied by both *sql.DB and *sql.Tx, so that the helpers, and everything
+// built on them, can run either on their own or as part of a transaction
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+var (
+	_ Querier = &sql.DB{}
+	_ Querier = &sql.Tx{}
+)
+
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxAttempts bounds how many times a transaction is run when it hits a transient
+	// error; the default is RetryAttempts
+	MaxAttempts int
+}
+
+func (o *TxOptions) maxAttempts() int {
+	if o == nil || o.MaxAttempts <= 0 {
+		return RetryAttempts
+	}
+	return o.MaxAttempts
+}
+
+func (o *TxOptions) sqlOptions() *sql.TxOptions {
+	if o == nil {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: o.Isolation, ReadOnly: o.ReadOnly}
+}
+
+// WithTx runs f in a transaction, which is committed if f succeeds and rolled back otherwise.
+// Serialization failures, deadlocks and lost connections are retried, so f may run more than
+// once: it mustn't have side effects outside of tx.  nil options mean the database's default
+// isolation.
+func WithTx(ctx context.Context, db *sql.DB, metrics *telemetry.Metrics, options *TxOptions, f func(tx *sql.Tx) error) error {
+	ctx, span := metrics.Tracer(tracerName).Start(ctx, "transaction")
+	err := retry(ctx, metrics, options.maxAttempts(), isTxRetryable, func() error {
+		return runTx(ctx, db, options, f)
+	})
+	endQuerySpan(span, 0, err)
+	return err
+}
+
+// commitError marks failed commits: a connection lost during commit leaves it unknown
+// whether the transaction was applied, so it can't safely be run again
+type commitError struct {
+	error
+}
+
+func (e *commitError) Unwrap() error {
+	return e.error
+}
+
+func isTxRetryable(err error) bool {
+	if IsSerializationFailure(err) {
+		return true
+	}
+	var commitErr *commitError
+	return !errors.As(err, &commitErr) && IsTransient(err)
+}
+
+func runTx(ctx context.Context, db *sql.DB, options *TxOptions, f func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, options.sqlOptions())
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to issue query")
+		return errors.Wrapf(err, "unable to begin transaction")
+	}
+	if err := f(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			telemetry.Logger(ctx).Errorf("unable to roll back transaction: %+v", rollbackErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(&commitError{err}, "unable to commit transaction")
 	}
+	return nil
+}
+
+// readerRetry retries reads run directly on a *sql.DB.  Within a transaction, an error aborts
+// the whole transaction, so retrying is left to WithTx.
+func readerRetry(ctx context.Context, db Querier, metrics *telemetry.Metrics, f func() error) error {
+	if _, ok := db.(*sql.DB); !ok {
+		return f()
+	}
+	return Retry(ctx, metrics, f)
+}
+
+// ReadMany, ReadEach, ReadSingle and RunStatement take a name, which should be stable and low
+// cardinality: it identifies the query in metrics, which are recorded in the Metrics of the
+// service running it.
+
+func ReadMany[A any](ctx context.Context, db Querier, metrics *telemetry.Metrics, name string, process func(*sql.Rows, *A) error, query string, args ...any) ([]*A, error) {
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, metrics, name, query)
+	var records []*A
+	err := readerRetry(ctx, db, metrics, func() error {
+		var err error
+		records, err = readMany(ctx, db, process, query, args...)
+		return err
+	})
+	metrics.RecordDBQueryDuration(name, err, start)
+	endQuerySpan(span, int64(len(records)), err)
+	return records, err
+}
 
+func readMany[A any](ctx context.Context, db Querier, process func(*sql.Rows, *A) error, query string, args ...any) ([]*A, error) {
 	var records []*A
+	_, err := readEach(ctx, db, process, func(record *A) error {
+		records = append(records, record)
+		return nil
+	}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
 
+// ReadEach is ReadMany for results too big to hold at once: onRecord is called with each
+// record as it's read, and the first error it returns stops the query.  Records can't be
+// taken back once they've been handed over, so unlike ReadMany, failures aren't retried.
+func ReadEach[A any](ctx context.Context, db Querier, metrics *telemetry.Metrics, name string, process func(*sql.Rows, *A) error, onRecord func(*A) error, query string, args ...any) error {
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, metrics, name, query)
+	count, err := readEach(ctx, db, process, onRecord, query, args...)
+	metrics.RecordDBQueryDuration(name, err, start)
+	endQuerySpan(span, count, err)
+	return err
+}
+
+func readEach[A any](ctx context.Context, db Querier, process func(*sql.Rows, *A) error, onRecord func(*A) error, query string, args ...any) (int64, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to issue query")
+	}
+	defer rows.Close()
+
+	var count int64
 	for rows.Next() {
 		var record A
 		err = process(rows, &record)
 		if err != nil {
-			return nil, errors.Wrapf(err, "unable to load row")
+			return count, errors.Wrapf(err, "unable to load row")
+		}
+		count++
+		if err = onRecord(&record); err != nil {
+			return count, err
 		}
-		records = append(records, &record)
 	}
 
 	if closeErr := rows.Close(); closeErr != nil {
-		return nil, errors.Wrapf(err, "unable to close")
+		return count, errors.Wrapf(closeErr, "unable to close")
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, errors.Wrapf(err, "row iteration problem")
+		return count, errors.Wrapf(err, "row iteration problem")
 	}
 
-	return records, nil
+	return count, nil
 }
 
-func ReadSingle[A any](ctx context.Context, db *sql.DB, process func(*sql.Row, *A) error, query string, args ...any) (*A, error) {
+func ReadSingle[A any](ctx context.Context, db Querier, metrics *telemetry.Metrics, name string, process func(*sql.Row, *A) error, query string, args ...any) (*A, error) {
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, metrics, name, query)
 	var record A
-	if err := process(db.QueryRowContext(ctx, query, args...), &record); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+	found := true
+	err := readerRetry(ctx, db, metrics, func() error {
+		err := process(db.QueryRowContext(ctx, query, args...), &record)
+		if errors.Is(err, sql.ErrNoRows) {
+			found = false
+			return nil
 		}
+		return err
+	})
+	metrics.RecordDBQueryDuration(name, err, start)
+	if found {
+		endQuerySpan(span, 1, err)
+	} else {
+		endQuerySpan(span, 0, err)
+	}
+	if err != nil {
 		return nil, errors.Wrapf(err, "unable to run query '%s' with args '%+v'", query, args)
 	}
+	if !found {
+		return nil, nil
+	}
 	logrus.Tracef("ReadSingle result: %+v", record)
 	return &record, nil
 }
 
-func RunStatement(ctx context.Context, db *sql.DB, query string, args ...any) (sql.Result, error) {
+func RunStatement(ctx context.Context, db Querier, metrics *telemetry.Metrics, name string, query string, args ...any) (sql.Result, error) {
 	logrus.Tracef("running SQL query: '%s' with args '%+v'", query, args)
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, metrics, name, query)
 	result, err := db.ExecContext(ctx, query, args...)
+	metrics.RecordDBQueryDuration(name, err, start)
+	var rows int64
+	if err == nil {
+		// not every driver or statement supports this, in which case 0 is recorded
+		rows, _ = result.RowsAffected()
+	}
+	endQuerySpan(span, rows, err)
 	return result, errors.Wrapf(err, "unable to run query '%s' with args '%+v'", query, args)
 }
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// execQuerier only supports statements, which all succeed
+type execQuerier struct {
+	Querier
+}
+
+func (e execQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func newRegisteredMetrics(t *testing.T, namespace string) (*telemetry.Metrics, *prometheus.Registry) {
+	registry := prometheus.NewRegistry()
+	metrics, err := telemetry.NewMetrics(namespace, registry)
+	if err != nil {
+		t.Fatalf("unable to create metrics: %+v", err)
+	}
+	return metrics, registry
+}
+
+// sampleCount sums the observations, or counts, of the series of the metric named name
+func sampleCount(t *testing.T, registry *prometheus.Registry, name string) uint64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather: %+v", err)
+	}
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			count += metric.GetHistogram().GetSampleCount() + uint64(metric.GetCounter().GetValue())
+		}
+	}
+	return count
+}
+
+func TestQueriesRecordToTheirServicesMetrics(t *testing.T) {
+	server, serverRegistry := newRegisteredMetrics(t, "webserver")
+	loadgen, loadgenRegistry := newRegisteredMetrics(t, "loadgen")
+
+	if _, err := RunStatement(context.Background(), execQuerier{}, server, "test", "select 1"); err != nil {
+		t.Fatalf("unable to run statement: %+v", err)
+	}
+	attempts := 0
+	_ = Retry(context.Background(), loadgen, func() error {
+		attempts++
+		return driver.ErrBadConn
+	})
+
+	if count := sampleCount(t, serverRegistry, "webserver_db_query_duration_histogram_milliseconds"); count != 1 {
+		t.Errorf("expected the server's query to be recorded by the server, got %d", count)
+	}
+	if count := sampleCount(t, loadgenRegistry, "loadgen_db_query_duration_histogram_milliseconds"); count != 0 {
+		t.Errorf("expected the server's query not to be recorded by the loadgen, got %d", count)
+	}
+	if count := sampleCount(t, loadgenRegistry, "loadgen_db_error_counter"); count != uint64(attempts) || attempts != RetryAttempts {
+		t.Errorf("expected %d errors recorded by the loadgen, got %d of %d", RetryAttempts, count, attempts)
+	}
+	if count := sampleCount(t, serverRegistry, "webserver_db_error_counter"); count != 0 {
+		t.Errorf("expected the loadgen's errors not to be recorded by the server, got %d", count)
+	}
+}
+
+func TestQuerySpansGoToTheirServicesTracerProvider(t *testing.T) {
+	metrics, _ := newRegisteredMetrics(t, "webserver")
+	recorder := tracetest.NewSpanRecorder()
+	metrics.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	if _, err := RunStatement(context.Background(), execQuerier{}, metrics, "test", "select 1"); err != nil {
+		t.Fatalf("unable to run statement: %+v", err)
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "test" || spans[0].InstrumentationScope().Name != tracerName {
+		t.Fatalf("expected one %s span named after the query, got %+v", tracerName, spans)
+	}
+}
+
+func TestPoolAndQueryMetrics(t *testing.T) {
+	metrics, registry := newRegisteredMetrics(t, "test")
+	db, err := sql.Open("upvote-index", "")
+	if err != nil {
+		t.Fatalf("unable to open db: %+v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(7)
+	if err := metrics.RegisterDBStats(db, "scaling"); err != nil {
+		t.Fatalf("unable to register db stats: %+v", err)
+	}
+
+	process := func(row *sql.Row, out *int) error {
+		return row.Scan(out)
+	}
+	if _, err := ReadSingle(context.Background(), db, metrics, "count_things", process, "select count(*) from things"); err != nil {
+		t.Fatalf("unable to query: %+v", err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather: %+v", err)
+	}
+	found := map[string]bool{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if family.GetName() == "go_sql_max_open_connections" && label.GetName() == "db_name" && label.GetValue() == "scaling" && metric.GetGauge().GetValue() == 7 {
+					found["pool"] = true
+				}
+				if family.GetName() == "test_db_query_duration_histogram_milliseconds" && label.GetName() == "query" && label.GetValue() == "count_things" && metric.GetHistogram().GetSampleCount() == 1 {
+					found["query"] = true
+				}
+			}
+		}
+	}
+	if !found["pool"] || !found["query"] {
+		t.Errorf("expected the pool's max open connections and the query's duration to be exported, found %+v", found)
+	}
+}
@@ -7,10 +7,17 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mattfenwick/collections/pkg/slice"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
 	"github.com/pkg/errors"
 )
 
 const (
+	getUsersQuery       = "select * from users"
+	searchUsersQuery    = "select * from users where name ilike $1 and email ilike $2"
+	getMessagesQuery    = "select * from messages"
+	searchMessagesQuery = "select * from messages where position($1 in content) > 0"
+
 	getFollowersOfQueryTemplate = `
 	select 
 		users.*
@@ -42,6 +49,16 @@ const (
 	where
 		messages.sender_user_id = $1`
 
+	// getTimelineSendersTemplate must select the same user ids as getUserTimelineTemplate
+	getTimelineSendersTemplate = `
+	select 
+		$1::uuid as user_id
+	union
+	select 
+		follower_user_id
+	from followers
+	where followee_user_id = $1`
+
 	getUserTimelineTemplate = `
 	with userids as (
 		select 
@@ -107,8 +124,8 @@ func NewUser(name string, email string) *User {
 	return &User{UserId: uuid.New(), Name: name, Email: email, CreatedAt: time.Now()}
 }
 
-func InsertUser(ctx context.Context, db *sql.DB, user *User) error {
-	_, err := db.ExecContext(ctx,
+func InsertUser(ctx context.Context, db Querier, metrics *telemetry.Metrics, user *User) error {
+	_, err := RunStatement(ctx, db, metrics, "insert_user",
 		"INSERT INTO users (user_id, name, email, created_at) VALUES ($1, $2, $3, $4)",
 		user.UserId,
 		user.Name,
@@ -118,23 +135,34 @@ func InsertUser(ctx context.Context, db *sql.DB, user *User) error {
 	return errors.Wrapf(err, "unable to insert user")
 }
 
-func GetUser(ctx context.Context, db *sql.DB, userId uuid.UUID) (*User, error) {
+func GetUser(ctx context.Context, db Querier, metrics *telemetry.Metrics, userId uuid.UUID) (*User, error) {
 	// TODO consider using a prepared statement
 	//   https://go.dev/doc/database/prepared-statements
-	return ReadSingle(ctx, db, loadSingleUser, `SELECT * FROM users WHERE user_id = $1`, userId.String())
+	return ReadSingle(ctx, db, metrics, "get_user", loadSingleUser, `SELECT * FROM users WHERE user_id = $1`, userId.String())
 }
 
-func GetUsers(ctx context.Context, db *sql.DB) ([]*User, error) {
-	return ReadMany(ctx, db, loadUser, "select * from users")
+func GetUsers(ctx context.Context, db Querier, metrics *telemetry.Metrics) ([]*User, error) {
+	return ReadMany(ctx, db, metrics, "get_users", loadUser, getUsersQuery)
+}
+
+// StreamUsers is GetUsers, handing each user to onUser as it's read
+func StreamUsers(ctx context.Context, db Querier, metrics *telemetry.Metrics, onUser func(*User) error) error {
+	return ReadEach(ctx, db, metrics, "get_users", loadUser, onUser, getUsersQuery)
 }
 
 func regexWrap(s string) string {
 	return "%" + s + "%"
 }
 
-func SearchUsers(ctx context.Context, db *sql.DB, namePattern string, emailPattern string) ([]*User, error) {
-	return ReadMany(ctx, db, loadUser,
-		"select * from users where name ilike $1 and email ilike $2",
+func SearchUsers(ctx context.Context, db Querier, metrics *telemetry.Metrics, namePattern string, emailPattern string) ([]*User, error) {
+	return ReadMany(ctx, db, metrics, "search_users", loadUser, searchUsersQuery,
+		regexWrap(namePattern),
+		regexWrap(emailPattern))
+}
+
+// StreamSearchUsers is SearchUsers, handing each user to onUser as it's read
+func StreamSearchUsers(ctx context.Context, db Querier, metrics *telemetry.Metrics, namePattern string, emailPattern string, onUser func(*User) error) error {
+	return ReadEach(ctx, db, metrics, "search_users", loadUser, onUser, searchUsersQuery,
 		regexWrap(namePattern),
 		regexWrap(emailPattern))
 }
@@ -147,12 +175,29 @@ type TimelineMessage struct {
 	CreatedAt    time.Time
 }
 
-func GetUserTimeline(ctx context.Context, db *sql.DB, userId uuid.UUID) ([]*TimelineMessage, error) {
-	return ReadMany(ctx, db, loadTimelineMessage, getUserTimelineTemplate, userId)
+func GetUserTimeline(ctx context.Context, db Querier, metrics *telemetry.Metrics, userId uuid.UUID) ([]*TimelineMessage, error) {
+	return ReadMany(ctx, db, metrics, "get_user_timeline", loadTimelineMessage, getUserTimelineTemplate, userId)
 }
 
-func GetUserMessages(ctx context.Context, db *sql.DB, userId uuid.UUID) ([]*TimelineMessage, error) {
-	return ReadMany(ctx, db, loadTimelineMessage, getUserMessagesTemplate, userId)
+// GetTimelineSenders returns the ids of the users whose messages appear in userId's timeline
+func GetTimelineSenders(ctx context.Context, db Querier, metrics *telemetry.Metrics, userId uuid.UUID) ([]uuid.UUID, error) {
+	process := func(rows *sql.Rows, record *uuid.UUID) error {
+		return rows.Scan(record)
+	}
+	ids, err := ReadMany(ctx, db, metrics, "get_timeline_senders", process, getTimelineSendersTemplate, userId)
+	if err != nil {
+		return nil, err
+	}
+	return slice.Map(func(id *uuid.UUID) uuid.UUID { return *id }, ids), nil
+}
+
+func GetUserMessages(ctx context.Context, db Querier, metrics *telemetry.Metrics, userId uuid.UUID) ([]*TimelineMessage, error) {
+	return ReadMany(ctx, db, metrics, "get_user_messages", loadTimelineMessage, getUserMessagesTemplate, userId)
+}
+
+// StreamUserMessages is GetUserMessages, handing each message to onMessage as it's read
+func StreamUserMessages(ctx context.Context, db Querier, metrics *telemetry.Metrics, userId uuid.UUID, onMessage func(*TimelineMessage) error) error {
+	return ReadEach(ctx, db, metrics, "get_user_messages", loadTimelineMessage, onMessage, getUserMessagesTemplate, userId)
 }
 
 // Messages
@@ -168,29 +213,37 @@ func NewMessage(senderUserId uuid.UUID, content string) *Message {
 	return &Message{MessageId: uuid.New(), SenderUserId: senderUserId, Content: content, CreatedAt: time.Now()}
 }
 
-func InsertMessage(ctx context.Context, db *sql.DB, message *Message) error {
-	_, err := db.ExecContext(ctx,
+func InsertMessage(ctx context.Context, db Querier, metrics *telemetry.Metrics, message *Message) error {
+	_, err := RunStatement(ctx, db, metrics, "insert_message",
 		"INSERT INTO messages (message_id, sender_user_id, content, created_at) VALUES ($1, $2, $3, $4)",
 		message.MessageId,
 		message.SenderUserId,
 		message.Content,
 		message.CreatedAt,
 	)
-	return errors.Wrapf(err, "unable to insert follower")
+	return errors.Wrapf(err, "unable to insert message")
 }
 
-func GetMessage(ctx context.Context, db *sql.DB, messageId uuid.UUID) (*Message, error) {
-	return ReadSingle(ctx, db, loadSingleMessage, `SELECT * FROM messages WHERE message_id = $1`, messageId.String())
+func GetMessage(ctx context.Context, db Querier, metrics *telemetry.Metrics, messageId uuid.UUID) (*Message, error) {
+	return ReadSingle(ctx, db, metrics, "get_message", loadSingleMessage, `SELECT * FROM messages WHERE message_id = $1`, messageId.String())
 }
 
-func GetMessages(ctx context.Context, db *sql.DB) ([]*Message, error) {
-	return ReadMany(ctx, db, loadMessage, "select * from messages")
+func GetMessages(ctx context.Context, db Querier, metrics *telemetry.Metrics) ([]*Message, error) {
+	return ReadMany(ctx, db, metrics, "get_messages", loadMessage, getMessagesQuery)
 }
 
-func SearchMessages(ctx context.Context, db *sql.DB, literalString string) ([]*Message, error) {
-	return ReadMany(ctx, db, loadMessage,
-		"select * from messages where position($1 in content) > 0",
-		literalString)
+// StreamMessages is GetMessages, handing each message to onMessage as it's read
+func StreamMessages(ctx context.Context, db Querier, metrics *telemetry.Metrics, onMessage func(*Message) error) error {
+	return ReadEach(ctx, db, metrics, "get_messages", loadMessage, onMessage, getMessagesQuery)
+}
+
+func SearchMessages(ctx context.Context, db Querier, metrics *telemetry.Metrics, literalString string) ([]*Message, error) {
+	return ReadMany(ctx, db, metrics, "search_messages", loadMessage, searchMessagesQuery, literalString)
+}
+
+// StreamSearchMessages is SearchMessages, handing each message to onMessage as it's read
+func StreamSearchMessages(ctx context.Context, db Querier, metrics *telemetry.Metrics, literalString string, onMessage func(*Message) error) error {
+	return ReadEach(ctx, db, metrics, "search_messages", loadMessage, onMessage, searchMessagesQuery, literalString)
 }
 
 // Followers
@@ -205,8 +258,8 @@ func NewFollower(followeeId uuid.UUID, followerId uuid.UUID) *Follower {
 	return &Follower{FolloweeUserId: followeeId, FollowerUserId: followerId, CreatedAt: time.Now()}
 }
 
-func InsertFollower(ctx context.Context, db *sql.DB, follower *Follower) error {
-	_, err := db.ExecContext(ctx,
+func InsertFollower(ctx context.Context, db Querier, metrics *telemetry.Metrics, follower *Follower) error {
+	_, err := RunStatement(ctx, db, metrics, "insert_follower",
 		"INSERT INTO followers (followee_user_id, follower_user_id, created_at) VALUES ($1, $2, $3)",
 		follower.FolloweeUserId,
 		follower.FollowerUserId,
@@ -215,15 +268,15 @@ func InsertFollower(ctx context.Context, db *sql.DB, follower *Follower) error {
 	return errors.Wrapf(err, "unable to insert follower")
 }
 
-func GetFollowers(ctx context.Context, db *sql.DB) ([]*Follower, error) {
+func GetFollowers(ctx context.Context, db Querier, metrics *telemetry.Metrics) ([]*Follower, error) {
 	process := func(rows *sql.Rows, record *Follower) error {
 		return rows.Scan(&record.FolloweeUserId, &record.FollowerUserId, &record.CreatedAt)
 	}
-	return ReadMany(ctx, db, process, "select * from followers")
+	return ReadMany(ctx, db, metrics, "get_followers", process, "select * from followers")
 }
 
-func GetFollowersOfUser(ctx context.Context, db *sql.DB, userId uuid.UUID) ([]*User, error) {
-	return ReadMany(ctx, db, loadUser, getFollowersOfQueryTemplate, userId)
+func GetFollowersOfUser(ctx context.Context, db Querier, metrics *telemetry.Metrics, userId uuid.UUID) ([]*User, error) {
+	return ReadMany(ctx, db, metrics, "get_followers_of_user", loadUser, getFollowersOfQueryTemplate, userId)
 }
 
 // Upvotes
@@ -239,27 +292,58 @@ func NewUpvote(userId uuid.UUID, messageId uuid.UUID) *Upvote {
 	return &Upvote{UpvoteId: uuid.New(), UserId: userId, MessageId: messageId, CreatedAt: time.Now()}
 }
 
-func InsertUpvote(ctx context.Context, db *sql.DB, upvote *Upvote) error {
-	_, err := db.ExecContext(ctx,
+func InsertUpvote(ctx context.Context, db Querier, metrics *telemetry.Metrics, upvote *Upvote) error {
+	_, err := RunStatement(ctx, db, metrics, "insert_upvote",
 		"INSERT INTO upvotes (upvote_id, user_id, message_id, created_at) VALUES ($1, $2, $3, $4)",
 		upvote.UpvoteId,
 		upvote.UserId,
 		upvote.MessageId,
 		upvote.CreatedAt,
 	)
-	return errors.Wrapf(err, "unable to insert follower")
+	return errors.Wrapf(err, "unable to insert upvote")
+}
+
+// InsertUpvoteIfAbsent inserts upvote unless its user has already upvoted its message, and
+// reports whether it did
+func InsertUpvoteIfAbsent(ctx context.Context, db Querier, metrics *telemetry.Metrics, upvote *Upvote) (bool, error) {
+	process := func(row *sql.Row, record *uuid.UUID) error {
+		return row.Scan(record)
+	}
+	upvoteId, err := ReadSingle(ctx, db, metrics, "insert_upvote_if_absent", process,
+		`INSERT INTO upvotes (upvote_id, user_id, message_id, created_at) VALUES ($1, $2, $3, $4)
+		  ON CONFLICT (user_id, message_id) DO NOTHING
+		  RETURNING upvote_id`,
+		upvote.UpvoteId,
+		upvote.UserId,
+		upvote.MessageId,
+		upvote.CreatedAt,
+	)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to insert upvote")
+	}
+	return upvoteId != nil, nil
+}
+
+// GetUpvote returns userId's upvote of messageId, or nil if there isn't one
+func GetUpvote(ctx context.Context, db Querier, metrics *telemetry.Metrics, userId uuid.UUID, messageId uuid.UUID) (*Upvote, error) {
+	process := func(row *sql.Row, record *Upvote) error {
+		return row.Scan(&record.UpvoteId, &record.UserId, &record.MessageId, &record.CreatedAt)
+	}
+	return ReadSingle(ctx, db, metrics, "get_upvote", process,
+		"select upvote_id, user_id, message_id, created_at from upvotes where user_id = $1 and message_id = $2",
+		userId, messageId)
 }
 
-func ReadAllUpvotes(ctx context.Context, db *sql.DB) ([]*Upvote, error) {
+func ReadAllUpvotes(ctx context.Context, db Querier, metrics *telemetry.Metrics) ([]*Upvote, error) {
 	process := func(rows *sql.Rows, record *Upvote) error {
 		return rows.Scan(&record.UpvoteId, &record.UserId, &record.MessageId, &record.CreatedAt)
 	}
-	return ReadMany(ctx, db, process, "select * from upvotes")
+	return ReadMany(ctx, db, metrics, "read_all_upvotes", process, "select * from upvotes")
 }
 
 // debug
 
-func GetTableSizes(ctx context.Context, db *sql.DB) (map[string]int, error) {
+func GetTableSizes(ctx context.Context, db Querier, metrics *telemetry.Metrics) (map[string]int, error) {
 	tableNames := []string{
 		"users",
 		"messages",
@@ -273,7 +357,7 @@ func GetTableSizes(ctx context.Context, db *sql.DB) (map[string]int, error) {
 	}
 	rowCounts := map[string]int{}
 	for _, table := range tableNames {
-		count, err := ReadSingle(ctx, db, process, fmt.Sprintf(`SELECT count(*) FROM %s`, table))
+		count, err := ReadSingle(ctx, db, metrics, "get_table_sizes", process, fmt.Sprintf(`SELECT count(*) FROM %s`, table))
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+)
+
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	// DeliveryStatusDead marks deliveries which ran out of attempts; they're kept, with
+	// their last error, until pruned
+	DeliveryStatusDead = "dead"
+)
+
+// InsertOutboxEvent records a write for webhook delivery.  It should be run in the same
+// transaction as the write, so that either both or neither happen.
+func InsertOutboxEvent(ctx context.Context, db Querier, metrics *telemetry.Metrics, kind string, payload any) error {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrapf(err, "unable to marshal outbox payload")
+	}
+	_, err = RunStatement(ctx, db, metrics, "insert_outbox_event", "INSERT INTO outbox (kind, payload) VALUES ($1, $2)", kind, bytes)
+	return errors.Wrapf(err, "unable to insert outbox event")
+}
+
+const (
+	// skip locked lets several replicas dispatch concurrently without handling a row twice
+	dispatchOutboxTemplate = `
+	with claimed as (
+		update outbox set dispatched = true
+		where outbox_id in (
+			select outbox_id from outbox
+			where not dispatched
+			order by outbox_id
+			limit $2
+			for update skip locked)
+		returning outbox_id
+	)
+	insert into webhook_deliveries (outbox_id, webhook, status)
+	select claimed.outbox_id, webhooks.name, 'pending'
+	from claimed cross join unnest($1::text[]) as webhooks(name)`
+
+	// claiming pushes next_attempt_at out by the lease, so that a replica which dies
+	// mid-delivery doesn't strand the delivery
+	claimDeliveriesTemplate = `
+	with due as (
+		select outbox_id, webhook from webhook_deliveries
+		where status = 'pending' and next_attempt_at <= now()
+		order by next_attempt_at
+		limit $1
+		for update skip locked
+	)
+	update webhook_deliveries d
+	set next_attempt_at = now() + make_interval(secs => $2), attempts = d.attempts + 1, updated_at = now()
+	from due, outbox o
+	where d.outbox_id = due.outbox_id and d.webhook = due.webhook and o.outbox_id = d.outbox_id
+	returning d.outbox_id, d.webhook, d.attempts, o.kind, o.payload, o.created_at`
+)
+
+// DispatchOutbox creates a pending delivery per webhook for up to limit undispatched
+// outbox rows, returning how many deliveries were created
+func DispatchOutbox(ctx context.Context, db Querier, metrics *telemetry.Metrics, webhooks []string, limit int) (int64, error) {
+	result, err := RunStatement(ctx, db, metrics, "dispatch_outbox", dispatchOutboxTemplate, pq.Array(webhooks), limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+type Delivery struct {
+	OutboxId  int64
+	Webhook   string
+	Attempts  int
+	Kind      string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+}
+
+// ClaimDeliveries returns up to limit deliveries which are due, leasing them for lease
+func ClaimDeliveries(ctx context.Context, db Querier, metrics *telemetry.Metrics, limit int, lease time.Duration) ([]*Delivery, error) {
+	process := func(rows *sql.Rows, record *Delivery) error {
+		return rows.Scan(&record.OutboxId, &record.Webhook, &record.Attempts, &record.Kind, &record.Payload, &record.CreatedAt)
+	}
+	return ReadMany(ctx, db, metrics, "claim_deliveries", process, claimDeliveriesTemplate, limit, lease.Seconds())
+}
+
+func MarkDeliveryDelivered(ctx context.Context, db Querier, metrics *telemetry.Metrics, outboxId int64, webhook string) error {
+	_, err := RunStatement(ctx, db, metrics, "mark_delivery_delivered",
+		"update webhook_deliveries set status = $3, last_error = null, updated_at = now() where outbox_id = $1 and webhook = $2",
+		outboxId, webhook, DeliveryStatusDelivered)
+	return err
+}
+
+// MarkDeliveryFailed schedules a retry after retryAfter, or dead-letters the delivery if dead
+func MarkDeliveryFailed(ctx context.Context, db Querier, metrics *telemetry.Metrics, outboxId int64, webhook string, deliveryErr error, retryAfter time.Duration, dead bool) error {
+	status := DeliveryStatusPending
+	if dead {
+		status = DeliveryStatusDead
+	}
+	_, err := RunStatement(ctx, db, metrics, "mark_delivery_failed", `
+	update webhook_deliveries
+	set status = $3, last_error = $4, next_attempt_at = now() + make_interval(secs => $5), updated_at = now()
+	where outbox_id = $1 and webhook = $2`,
+		outboxId, webhook, status, deliveryErr.Error(), retryAfter.Seconds())
+	return err
+}
+
+// PruneOutbox deletes delivered deliveries, and fully delivered outbox rows, older than before.
+// Dead deliveries, and the rows they belong to, are kept for inspection.
+func PruneOutbox(ctx context.Context, db Querier, metrics *telemetry.Metrics, before time.Time) error {
+	_, err := RunStatement(ctx, db, metrics, "prune_webhook_deliveries",
+		"delete from webhook_deliveries where status = $1 and updated_at < $2",
+		DeliveryStatusDelivered, before)
+	if err != nil {
+		return err
+	}
+	_, err = RunStatement(ctx, db, metrics, "prune_outbox", `
+	delete from outbox
+	where dispatched and created_at < $1
+	and not exists (select 1 from webhook_deliveries d where d.outbox_id = outbox.outbox_id)`,
+		before)
+	return err
+}
+
+// GetDeliveryCounts returns the number of deliveries by webhook, then by status
+func GetDeliveryCounts(ctx context.Context, db Querier, metrics *telemetry.Metrics) (map[string]map[string]int, error) {
+	type count struct {
+		Webhook string
+		Status  string
+		Count   int
+	}
+	process := func(rows *sql.Rows, record *count) error {
+		return rows.Scan(&record.Webhook, &record.Status, &record.Count)
+	}
+	counts, err := ReadMany(ctx, db, metrics, "get_delivery_counts", process, "select webhook, status, count(*) from webhook_deliveries group by webhook, status")
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]map[string]int{}
+	for _, c := range counts {
+		if _, ok := out[c.Webhook]; !ok {
+			out[c.Webhook] = map[string]int{}
+		}
+		out[c.Webhook][c.Status] = c.Count
+	}
+	return out, nil
+}
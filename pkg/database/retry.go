@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Error classes, used to decide what's worth retrying and to label metrics
+const (
+	ErrorClassConnection    = "connection"
+	ErrorClassSerialization = "serialization"
+	ErrorClassDeadlock      = "deadlock"
+	ErrorClassCanceled      = "canceled"
+	ErrorClassOther         = "other"
+)
+
+// ClassifyError sorts errors by what went wrong, as far as retrying is concerned.  During a
+// failover, clients see broken connections, then admin shutdown, then refused connections
+// while the new primary starts up: these are all connection errors.
+func ClassifyError(err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassCanceled
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "40001":
+			return ErrorClassSerialization
+		case pqErr.Code == "40P01":
+			return ErrorClassDeadlock
+		case pqErr.Code.Class() == "08":
+			// connection_exception and friends
+			return ErrorClassConnection
+		case pqErr.Code == "57P01", pqErr.Code == "57P02", pqErr.Code == "57P03":
+			// admin_shutdown, crash_shutdown, cannot_connect_now
+			return ErrorClassConnection
+		}
+		return ErrorClassOther
+	}
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return ErrorClassConnection
+	}
+	return ErrorClassOther
+}
+
+// IsSerializationFailure is true of errors which mean a transaction lost a race, and
+// should be retried from the beginning
+func IsSerializationFailure(err error) bool {
+	class := ClassifyError(err)
+	return class == ErrorClassSerialization || class == ErrorClassDeadlock
+}
+
+// IsTransient is true of errors which may well go away if the same work is tried again
+func IsTransient(err error) bool {
+	return IsSerializationFailure(err) || ClassifyError(err) == ErrorClassConnection
+}
+
+// RetryAttempts bounds how many times Retry runs a function
+var RetryAttempts = 3
+
+// Retry runs f until it succeeds, fails with an error which isn't transient, or runs out of
+// attempts.  f must be safe to run more than once: reads are, and so are writes which either
+// happen completely or not at all.
+func Retry(ctx context.Context, metrics *telemetry.Metrics, f func() error) error {
+	return retry(ctx, metrics, RetryAttempts, IsTransient, f)
+}
+
+func retry(ctx context.Context, metrics *telemetry.Metrics, maxAttempts int, retryable func(error) bool, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		class := ClassifyError(err)
+		if class == ErrorClassCanceled {
+			return err
+		}
+		if !retryable(err) {
+			metrics.RecordDBError(class, "failed")
+			return err
+		}
+		if attempt >= maxAttempts {
+			metrics.RecordDBError(class, "exhausted")
+			return err
+		}
+		metrics.RecordDBError(class, "retried")
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.String("error.class", class),
+			attribute.Int("attempt", attempt)))
+		telemetry.Logger(ctx).Debugf("retrying after %s error, attempt %d: %s", class, attempt, err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(retryBackoff(attempt)):
+		}
+	}
+}
+
+// retryBackoff doubles from 20ms, up to a second, and is jittered so that the callers which
+// failed together don't all come back at once
+func retryBackoff(attempt int) time.Duration {
+	backoff := time.Second
+	if attempt < 7 {
+		backoff = 20 * time.Millisecond << (attempt - 1)
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, testCase := range []struct {
+		err   error
+		class string
+	}{
+		{err: &pq.Error{Code: "40001"}, class: ErrorClassSerialization},
+		{err: errors.Wrapf(&pq.Error{Code: "40P01"}, "wrapped"), class: ErrorClassDeadlock},
+		{err: &pq.Error{Code: "08006"}, class: ErrorClassConnection},
+		{err: &pq.Error{Code: "57P01"}, class: ErrorClassConnection},
+		{err: &pq.Error{Code: "57P03"}, class: ErrorClassConnection},
+		{err: &pq.Error{Code: "57014"}, class: ErrorClassOther},
+		{err: &pq.Error{Code: "23505"}, class: ErrorClassOther},
+		{err: driver.ErrBadConn, class: ErrorClassConnection},
+		{err: errors.Wrapf(io.ErrUnexpectedEOF, "wrapped"), class: ErrorClassConnection},
+		{err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, class: ErrorClassConnection},
+		{err: context.Canceled, class: ErrorClassCanceled},
+		{err: errors.Wrapf(context.DeadlineExceeded, "wrapped"), class: ErrorClassCanceled},
+		{err: errors.New("something else"), class: ErrorClassOther},
+	} {
+		if class := ClassifyError(testCase.err); class != testCase.class {
+			t.Errorf("%+v: expected class %s, got %s", testCase.err, testCase.class, class)
+		}
+	}
+	if !IsTransient(&pq.Error{Code: "40001"}) || !IsTransient(driver.ErrBadConn) || IsTransient(&pq.Error{Code: "23505"}) {
+		t.Errorf("expected serialization and connection errors, and only those, to be transient")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	metrics, registry := newRegisteredMetrics(t, "test")
+	for _, testCase := range []struct {
+		errs     []error
+		attempts int
+		failed   bool
+	}{
+		{errs: []error{driver.ErrBadConn, nil}, attempts: 2},
+		{errs: []error{&pq.Error{Code: "40001"}, &pq.Error{Code: "40001"}, &pq.Error{Code: "40001"}}, attempts: 3, failed: true},
+		// not worth retrying
+		{errs: []error{&pq.Error{Code: "23505"}}, attempts: 1, failed: true},
+		{errs: []error{context.Canceled}, attempts: 1, failed: true},
+	} {
+		attempts := 0
+		err := retry(context.Background(), metrics, 3, IsTransient, func() error {
+			attempts++
+			return testCase.errs[attempts-1]
+		})
+		if attempts != testCase.attempts || (err != nil) != testCase.failed {
+			t.Errorf("%+v: expected %d attempts, failed %t; got %d attempts and %+v", testCase.errs, testCase.attempts, testCase.failed, attempts, err)
+		}
+	}
+	// one retry each for the first two cases, then exhausted and failed; cancellation isn't an error
+	if count := sampleCount(t, registry, "test_db_error_counter"); count != 5 {
+		t.Errorf("expected 5 recorded errors, got %d", count)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempt, max := range map[int]time.Duration{1: 20 * time.Millisecond, 2: 40 * time.Millisecond, 6: 640 * time.Millisecond, 7: time.Second, 20: time.Second} {
+		for i := 0; i < 10; i++ {
+			if backoff := retryBackoff(attempt); backoff < max/2 || backoff > max {
+				t.Errorf("attempt %d: expected a backoff between %s and %s, got %s", attempt, max/2, max, backoff)
+			}
+		}
+	}
+}
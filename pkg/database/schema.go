@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 
+	"github.com/mattfenwick/scaling/pkg/telemetry"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -51,6 +52,89 @@ CREATE TABLE IF NOT EXISTS upvotes (
 );
 `
 
+	// a user upvotes a message at most once.  This is an index rather than a constraint in
+	// upvotesTable so that it's also added to existing databases, which used to allow duplicate
+	// upvotes: see createUpvotesUserMessageIndex.
+	upvotesUserMessageIndexName = "upvotes_user_message_idx"
+	upvotesUserMessageIndex     = `CREATE UNIQUE INDEX IF NOT EXISTS ` + upvotesUserMessageIndexName + ` ON upvotes (user_id, message_id)`
+
+	// dedupeUpvotes keeps each user's first upvote of a message.  The lock keeps out inserts
+	// until the unique index exists, without blocking reads.
+	lockUpvotes   = `LOCK TABLE upvotes IN SHARE ROW EXCLUSIVE MODE`
+	dedupeUpvotes = `
+DELETE FROM upvotes a USING upvotes b
+    WHERE a.user_id = b.user_id AND a.message_id = b.message_id
+      AND (a.created_at, a.upvote_id) > (b.created_at, b.upvote_id)
+`
+
+	// every write to users, followers, messages and upvotes is recorded in events, and
+	// announced with NOTIFY, so that replicas can learn about each other's writes
+
+	eventsTable = `
+CREATE TABLE IF NOT EXISTS events (
+    event_id bigserial NOT NULL,
+    kind varchar(40) NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamptz DEFAULT clock_timestamp() NOT NULL,
+    CONSTRAINT events_pk PRIMARY KEY (event_id)
+);
+`
+
+	eventsCreatedAtIndex = `CREATE INDEX IF NOT EXISTS events_created_at_idx ON events (created_at)`
+
+	notifyEventFunction = `
+CREATE OR REPLACE FUNCTION notify_event() RETURNS trigger AS $$
+DECLARE
+    event events;
+BEGIN
+    INSERT INTO events (kind, payload) VALUES (TG_TABLE_NAME, to_jsonb(NEW)) RETURNING * INTO event;
+    PERFORM pg_notify('` + EventsChannel + `', json_build_object(
+        'EventId', event.event_id,
+        'Kind', event.kind,
+        'Payload', event.payload,
+        'CreatedAt', event.created_at)::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+`
+
+	// CREATE OR REPLACE TRIGGER needs postgres 14
+	notifyEventTriggerTemplate = `
+CREATE OR REPLACE TRIGGER %[1]s_notify_event AFTER INSERT ON %[1]s
+    FOR EACH ROW EXECUTE FUNCTION notify_event();
+`
+
+	// outbox rows are inserted in the same transaction as the write they describe, and
+	// fanned out into one webhook_deliveries row per webhook
+
+	outboxTable = `
+CREATE TABLE IF NOT EXISTS outbox (
+    outbox_id bigserial NOT NULL,
+    kind varchar(40) NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamptz DEFAULT now() NOT NULL,
+    dispatched boolean DEFAULT false NOT NULL,
+    CONSTRAINT outbox_pk PRIMARY KEY (outbox_id)
+);
+`
+
+	outboxUndispatchedIndex = `CREATE INDEX IF NOT EXISTS outbox_undispatched_idx ON outbox (outbox_id) WHERE NOT dispatched`
+
+	webhookDeliveriesTable = `
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    outbox_id bigint NOT NULL references outbox(outbox_id) ON DELETE CASCADE,
+    webhook varchar(80) NOT NULL,
+    status varchar(20) NOT NULL,
+    attempts int DEFAULT 0 NOT NULL,
+    next_attempt_at timestamptz DEFAULT now() NOT NULL,
+    last_error text,
+    updated_at timestamptz DEFAULT now() NOT NULL,
+    CONSTRAINT webhook_deliveries_pk PRIMARY KEY (outbox_id, webhook)
+);
+`
+
+	webhookDeliveriesDueIndex = `CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`
+
 	// ?? derived tables ??
 
 	topicsTable = `
@@ -74,11 +158,11 @@ CREATE TABLE IF NOT EXISTS pings (
 `
 )
 
-func DoesDatabaseExist(ctx context.Context, db *sql.DB, databaseName string) (bool, error) {
+func DoesDatabaseExist(ctx context.Context, db *sql.DB, metrics *telemetry.Metrics, databaseName string) (bool, error) {
 	process := func(row *sql.Row, out *int) error {
 		return errors.Wrapf(row.Scan(out), "unable to fetch row")
 	}
-	count, err := ReadSingle(ctx, db, process, fmt.Sprintf(`SELECT count(*) FROM pg_database WHERE datname='%s'`, databaseName))
+	count, err := ReadSingle(ctx, db, metrics, "does_database_exist", process, fmt.Sprintf(`SELECT count(*) FROM pg_database WHERE datname='%s'`, databaseName))
 	if err != nil {
 		return false, err
 	}
@@ -88,16 +172,16 @@ func DoesDatabaseExist(ctx context.Context, db *sql.DB, databaseName string) (bo
 	return *count == 1, nil
 }
 
-func CreateDatabase(ctx context.Context, db *sql.DB, databaseName string) error {
+func CreateDatabase(ctx context.Context, db *sql.DB, metrics *telemetry.Metrics, databaseName string) error {
 	// TODO why doesn't this work?
-	// _, err := RunStatement(ctx, db, `create database "$1" encoding UTF8`, databaseName)
-	_, err := RunStatement(ctx, db, fmt.Sprintf(`create database "%s" encoding UTF8`, databaseName))
+	// _, err := RunStatement(ctx, db, metrics, `create database "$1" encoding UTF8`, databaseName)
+	_, err := RunStatement(ctx, db, metrics, "create_database", fmt.Sprintf(`create database "%s" encoding UTF8`, databaseName))
 	return err
 }
 
-func CreateDatabaseIfNotExists(ctx context.Context, db *sql.DB, databaseName string) error {
+func CreateDatabaseIfNotExists(ctx context.Context, db *sql.DB, metrics *telemetry.Metrics, databaseName string) error {
 	logrus.Debugf("creating database '%s' if not exists", databaseName)
-	exists, err := DoesDatabaseExist(ctx, db, databaseName)
+	exists, err := DoesDatabaseExist(ctx, db, metrics, databaseName)
 	if err != nil {
 		return err
 	}
@@ -106,20 +190,87 @@ func CreateDatabaseIfNotExists(ctx context.Context, db *sql.DB, databaseName str
 		return nil
 	}
 	logrus.Debugf("database '%s' does not exist: creating", databaseName)
-	_, err = RunStatement(ctx, db, fmt.Sprintf(`create database "%s" encoding UTF8`, databaseName))
+	_, err = RunStatement(ctx, db, metrics, "create_database", fmt.Sprintf(`create database "%s" encoding UTF8`, databaseName))
 	return err
 }
 
-func InitializeSchema(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, uuidOsspExtention)
+func InitializeSchema(ctx context.Context, db *sql.DB, metrics *telemetry.Metrics) error {
+	_, err := RunStatement(ctx, db, metrics, "initialize_schema", uuidOsspExtention)
 	if err != nil {
 		return errors.Wrapf(err, "unable to create extension")
 	}
-	for _, table := range []string{usersTable, followersTable, messagesTable, upvotesTable, topicsTable, pingsTable} {
-		_, err = RunStatement(ctx, db, table)
+	for _, table := range []string{usersTable, followersTable, messagesTable, upvotesTable, topicsTable, pingsTable, eventsTable, eventsCreatedAtIndex, notifyEventFunction, outboxTable, outboxUndispatchedIndex, webhookDeliveriesTable, webhookDeliveriesDueIndex} {
+		_, err = RunStatement(ctx, db, metrics, "initialize_schema", table)
+		if err != nil {
+			return err
+		}
+	}
+	if err := createUpvotesUserMessageIndex(ctx, db, metrics); err != nil {
+		return err
+	}
+	for _, table := range eventSourceTables {
+		_, err = RunStatement(ctx, db, metrics, "initialize_schema", fmt.Sprintf(notifyEventTriggerTemplate, table))
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// createUpvotesUserMessageIndex removes duplicate upvotes, which databases created before
+// the index may have, then creates the index.  Deduplicating scans the whole table, so it's
+// only done while the index is missing.
+func createUpvotesUserMessageIndex(ctx context.Context, db *sql.DB, metrics *telemetry.Metrics) error {
+	process := func(row *sql.Row, out *int) error {
+		return errors.Wrapf(row.Scan(out), "unable to fetch row")
+	}
+	count, err := ReadSingle(ctx, db, metrics, "initialize_schema", process,
+		`SELECT count(*) FROM pg_indexes WHERE schemaname = current_schema() AND indexname = $1`, upvotesUserMessageIndexName)
+	if err != nil {
+		return err
+	}
+	if count != nil && *count > 0 {
+		return nil
+	}
+	return WithTx(ctx, db, metrics, nil, func(tx *sql.Tx) error {
+		if _, err := RunStatement(ctx, tx, metrics, "initialize_schema", lockUpvotes); err != nil {
+			return err
+		}
+		result, err := RunStatement(ctx, tx, metrics, "initialize_schema", dedupeUpvotes)
+		if err != nil {
+			return errors.Wrapf(err, "unable to remove duplicate upvotes")
+		}
+		if removed, err := result.RowsAffected(); err == nil && removed > 0 {
+			logrus.Warnf("removed %d duplicate upvotes before adding %s", removed, upvotesUserMessageIndexName)
+		}
+		_, err = RunStatement(ctx, tx, metrics, "initialize_schema", upvotesUserMessageIndex)
+		return err
+	})
+}
+
+var schemaTables = []string{"users", "followers", "messages", "upvotes", "topics", "pings", "events", "outbox", "webhook_deliveries"}
+
+var eventSourceTables = []string{EventKindUser, EventKindFollower, EventKindMessage, EventKindUpvote}
+
+// GetMissingTables returns the schema tables which haven't been created yet
+func GetMissingTables(ctx context.Context, db *sql.DB, metrics *telemetry.Metrics) ([]string, error) {
+	process := func(rows *sql.Rows, out *string) error {
+		return errors.Wrapf(rows.Scan(out), "unable to fetch row")
+	}
+	existing, err := ReadMany(ctx, db, metrics, "get_missing_tables", process,
+		`SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()`)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, table := range existing {
+		found[*table] = true
+	}
+	var missing []string
+	for _, table := range schemaTables {
+		if !found[table] {
+			missing = append(missing, table)
+		}
+	}
+	return missing, nil
+}
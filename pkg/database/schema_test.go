@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// indexDriver answers queries for the count of an index with indexCount, and records statements
+type indexDriver struct {
+	mu         sync.Mutex
+	indexCount int64
+	statements []string
+}
+
+type indexConn struct {
+	driver *indexDriver
+}
+
+type countRows struct {
+	count int64
+	done  bool
+}
+
+func (d *indexDriver) Open(name string) (driver.Conn, error) {
+	return &indexConn{driver: d}, nil
+}
+
+func (c *indexConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, driver.ErrSkip
+}
+
+func (c *indexConn) Close() error {
+	return nil
+}
+
+func (c *indexConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *indexConn) Commit() error {
+	return nil
+}
+
+func (c *indexConn) Rollback() error {
+	return nil
+}
+
+func (c *indexConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	c.driver.statements = append(c.driver.statements, query)
+	return driver.RowsAffected(0), nil
+}
+
+func (c *indexConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	return &countRows{count: c.driver.indexCount}, nil
+}
+
+func (r *countRows) Columns() []string {
+	return []string{"count"}
+}
+
+func (r *countRows) Close() error {
+	return nil
+}
+
+func (r *countRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.count
+	return nil
+}
+
+var upvoteIndexDriver = &indexDriver{}
+
+func init() {
+	sql.Register("upvote-index", upvoteIndexDriver)
+}
+
+func TestUpvotesAreDedupedBeforeTheirIndexIsCreated(t *testing.T) {
+	db, err := sql.Open("upvote-index", "")
+	if err != nil {
+		t.Fatalf("unable to open db: %+v", err)
+	}
+	defer db.Close()
+	metrics, _ := newRegisteredMetrics(t, "test")
+
+	for _, existing := range []int64{0, 1} {
+		upvoteIndexDriver.mu.Lock()
+		upvoteIndexDriver.indexCount, upvoteIndexDriver.statements = existing, nil
+		upvoteIndexDriver.mu.Unlock()
+
+		if err := createUpvotesUserMessageIndex(context.Background(), db, metrics); err != nil {
+			t.Fatalf("unable to create index: %+v", err)
+		}
+
+		var expected []string
+		if existing == 0 {
+			expected = []string{lockUpvotes, dedupeUpvotes, upvotesUserMessageIndex}
+		}
+		statements := upvoteIndexDriver.statements
+		if len(statements) != len(expected) {
+			t.Fatalf("with %d indexes: expected %d statements, got %d: %s", existing, len(expected), len(statements), strings.Join(statements, "; "))
+		}
+		for i := range expected {
+			if statements[i] != expected[i] {
+				t.Errorf("with %d indexes: expected statement %d to be %s, got %s", existing, i, expected[i], statements[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of query and transaction spans
+const tracerName = "database"
+
+// startQuerySpan starts a span named after the query, so that the span names in traces
+// match the query labels in metrics.  The span goes to the TracerProvider of metrics.
+func startQuerySpan(ctx context.Context, metrics *telemetry.Metrics, name string, query string) (context.Context, trace.Span) {
+	return metrics.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatementKey.String(NormalizeStatement(query)),
+		))
+}
+
+// endQuerySpan records the number of rows read or affected, and the error if there was one
+func endQuerySpan(span trace.Span, rows int64, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(attribute.Int64("db.rows", rows))
+	}
+	span.End()
+}
+
+// NormalizeStatement collapses the whitespace of a query onto a single line.  Values are
+// passed as parameters, so statements don't carry user data.
+func NormalizeStatement(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
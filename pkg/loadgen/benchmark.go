@@ -0,0 +1,192 @@
+package loadgen
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/mattfenwick/scaling/pkg/webserver"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LatencySummary describes one kind of request.  Percentiles are bucket upper bounds, so
+// they overestimate by up to a bucket's width.
+type LatencySummary struct {
+	Count            uint64
+	Errors           uint64
+	MeanMilliseconds float64
+	P50Milliseconds  float64
+	P99Milliseconds  float64
+}
+
+type BenchmarkResult struct {
+	ElapsedSeconds float64
+	// Client is the loadgen's view of requests, by request name
+	Client map[string]*LatencySummary
+	// Server is the webserver's view of requests, by route template
+	Server map[string]*LatencySummary
+	// SLOs are the webserver's SLOs, as they stood at the end of the run
+	SLOs []*telemetry.SLOStatus
+}
+
+// Benchmark runs a webserver and a loadgen in this process, talking over a loopback port.
+// Each has its own metrics registry, so the two don't collide, and so that their views of
+// the same requests can be compared.  Workers each create BenchmarkUsers users, with their
+// messages.
+func Benchmark(ctx context.Context, config *Config, serverConfig *webserver.Config, tp trace.TracerProvider, db *sql.DB) (*BenchmarkResult, error) {
+	if err := config.Profile.Validate(); err != nil {
+		return nil, err
+	}
+	serverRegistry := prometheus.NewRegistry()
+	serverMetrics, err := telemetry.NewMetrics("webserver", serverRegistry)
+	if err != nil {
+		return nil, err
+	}
+	serverMetrics.SetTracerProvider(tp)
+	if err := database.InitializeSchema(ctx, db, serverMetrics); err != nil {
+		return nil, err
+	}
+	loadgenRegistry := prometheus.NewRegistry()
+	loadgenMetrics, err := telemetry.NewMetrics("loadgen", loadgenRegistry)
+	if err != nil {
+		return nil, err
+	}
+
+	serverContext, stopServer := context.WithCancel(ctx)
+	defer stopServer()
+	model := webserver.NewModel(serverContext, serverConfig, nil, tp, serverMetrics, db, nil)
+	router := webserver.NewV1Router(model, serverConfig.StreamHeartbeat(), &serverConfig.AccessLog, serverMetrics)
+	if err := webserver.ValidateSLORoutes(serverConfig.SLOs, router); err != nil {
+		return nil, err
+	}
+	if err := serverMetrics.TrackSLOs(serverConfig.SLOs); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to listen on loopback")
+	}
+	server := &http.Server{Handler: webserver.SetupHTTPServer(model, router, &serverConfig.AccessLog, tp, serverMetrics)}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			logrus.Errorf("benchmark server failed: %+v", err)
+		}
+	}()
+	defer func() {
+		shutdownContext, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout())
+		defer cancel()
+		model.CloseStreams()
+		_ = server.Shutdown(shutdownContext)
+		_ = model.Stop(shutdownContext)
+	}()
+
+	url := fmt.Sprintf("http://%s", listener.Addr().String())
+	generator := NewGenerator(ctx, webserver.NewClient(url), loadgenMetrics)
+	generator.Profile = &config.Profile
+	logrus.Infof("benchmarking %s with %d workers, %d users each", url, config.WorkersOrDefault(), config.BenchmarkUsersOrDefault())
+
+	generator.captureAtPeak(ctx)
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < config.WorkersOrDefault(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			generator.CreateUsers(ctx, config.BenchmarkUsersOrDefault())
+		}()
+	}
+	wg.Wait()
+	result := &BenchmarkResult{ElapsedSeconds: time.Since(start).Seconds(), SLOs: serverMetrics.SLOStatuses()}
+	generator.StopProfiles()
+
+	result.Client, err = summarizeLatencies(loadgenRegistry, "loadgen_client_request_duration_histogram_milliseconds", "name", 1, func(labels map[string]string) bool {
+		return labels["isError"] == "true"
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Server, err = summarizeLatencies(serverRegistry, "webserver_api_request_duration_seconds", "route", 1000, func(labels map[string]string) bool {
+		return strings.HasPrefix(labels["code"], "5")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// summarizeLatencies merges the series of the histogram named metricName by the label key,
+// scaling observations to milliseconds
+func summarizeLatencies(gatherer prometheus.Gatherer, metricName string, key string, toMilliseconds float64, isError func(labels map[string]string) bool) (map[string]*LatencySummary, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to gather metrics")
+	}
+	sums := map[string]float64{}
+	buckets := map[string]map[float64]uint64{}
+	summaries := map[string]*LatencySummary{}
+	for _, family := range families {
+		if family.GetName() != metricName {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			name := labels[key]
+			if summaries[name] == nil {
+				summaries[name] = &LatencySummary{}
+				buckets[name] = map[float64]uint64{}
+			}
+			histogram := metric.GetHistogram()
+			summaries[name].Count += histogram.GetSampleCount()
+			if isError(labels) {
+				summaries[name].Errors += histogram.GetSampleCount()
+			}
+			sums[name] += histogram.GetSampleSum() * toMilliseconds
+			for _, bucket := range histogram.GetBucket() {
+				buckets[name][bucket.GetUpperBound()*toMilliseconds] += bucket.GetCumulativeCount()
+			}
+		}
+	}
+	for name, summary := range summaries {
+		if summary.Count > 0 {
+			summary.MeanMilliseconds = sums[name] / float64(summary.Count)
+		}
+		summary.P50Milliseconds = bucketQuantile(buckets[name], summary.Count, 0.5)
+		summary.P99Milliseconds = bucketQuantile(buckets[name], summary.Count, 0.99)
+	}
+	return summaries, nil
+}
+
+// bucketQuantile finds the upper bound of the bucket holding quantile q.  Beyond the last
+// bucket, it gives the last bound, which is then an underestimate.
+func bucketQuantile(cumulativeCounts map[float64]uint64, count uint64, q float64) float64 {
+	var bounds []float64
+	for bound := range cumulativeCounts {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	rank := uint64(math.Ceil(q * float64(count)))
+	for _, bound := range bounds {
+		if cumulativeCounts[bound] >= rank {
+			return bound
+		}
+	}
+	if len(bounds) == 0 {
+		return 0
+	}
+	return bounds[len(bounds)-1]
+}
@@ -0,0 +1,115 @@
+package loadgen
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mattfenwick/scaling/pkg/webserver"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// acceptingDriver stands in for postgres: every statement succeeds, and every query finds
+// nothing, which is enough for the benchmark, which only writes
+type acceptingDriver struct {
+	statements int64
+}
+
+type acceptingConn struct {
+	driver *acceptingDriver
+}
+
+type noRows struct{}
+
+func (d *acceptingDriver) Open(name string) (driver.Conn, error) {
+	return &acceptingConn{driver: d}, nil
+}
+
+func (c *acceptingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, driver.ErrSkip
+}
+
+func (c *acceptingConn) Close() error {
+	return nil
+}
+
+func (c *acceptingConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *acceptingConn) Commit() error {
+	return nil
+}
+
+func (c *acceptingConn) Rollback() error {
+	return nil
+}
+
+func (c *acceptingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	atomic.AddInt64(&c.driver.statements, 1)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *acceptingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return noRows{}, nil
+}
+
+func (noRows) Columns() []string {
+	return nil
+}
+
+func (noRows) Close() error {
+	return nil
+}
+
+func (noRows) Next(dest []driver.Value) error {
+	return io.EOF
+}
+
+var benchmarkDriver = &acceptingDriver{}
+
+func init() {
+	sql.Register("accepting", benchmarkDriver)
+}
+
+// TestBenchmarkInOneProcess runs a webserver and a loadgen side by side, twice, which
+// panicked with duplicate registrations while metrics were global
+func TestBenchmarkInOneProcess(t *testing.T) {
+	db, err := sql.Open("accepting", "")
+	if err != nil {
+		t.Fatalf("unable to open db: %+v", err)
+	}
+	defer db.Close()
+
+	config := &Config{Workers: 2, BenchmarkUsers: 3}
+	for run := 0; run < 2; run++ {
+		before := atomic.LoadInt64(&benchmarkDriver.statements)
+		result, err := Benchmark(context.Background(), config, &webserver.Config{}, trace.NewNoopTracerProvider(), db)
+		if err != nil {
+			t.Fatalf("run %d: unable to benchmark: %+v", run, err)
+		}
+
+		// each registry only holds its own run's requests
+		users := result.Client["create user"]
+		if users == nil || users.Count != 6 || users.Errors != 0 {
+			t.Errorf("run %d: expected 6 users to be created, got %+v", run, users)
+		}
+		var messages uint64
+		if summary := result.Client["create message"]; summary != nil {
+			messages = summary.Count
+		}
+		var served uint64
+		for _, summary := range result.Server {
+			served += summary.Count
+		}
+		if served != users.Count+messages {
+			t.Errorf("run %d: expected the server to have handled the loadgen's %d requests, got %d", run, users.Count+messages, served)
+		}
+		if atomic.LoadInt64(&benchmarkDriver.statements) == before {
+			t.Errorf("run %d: expected the server to write to the database", run)
+		}
+	}
+}
@@ -2,26 +2,76 @@ package loadgen
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/mattfenwick/scaling/pkg/telemetry"
 	"github.com/mattfenwick/scaling/pkg/utils"
 	"github.com/mattfenwick/scaling/pkg/webserver"
 	"github.com/pkg/errors"
 )
 
 type Config struct {
-	Mode              string
+	Mode string
+	// Transport is "http" (the default) or "grpc"
+	Transport         string
 	Workers           int
 	PauseMilliseconds int
+	// Streams is how many timeline streams the stream-timelines mode holds open
+	Streams int
+	// BenchmarkUsers is how many users each of the benchmark's Workers creates
+	BenchmarkUsers int
+
+	Profile ProfileConfig
+}
+
+func (c *Config) WorkersOrDefault() int {
+	if c.Workers <= 0 {
+		return 1
+	}
+	return c.Workers
+}
+
+func (c *Config) BenchmarkUsersOrDefault() int {
+	if c.BenchmarkUsers <= 0 {
+		return 10
+	}
+	return c.BenchmarkUsers
+}
+
+func (c *Config) StreamsOrDefault() int {
+	if c.Streams <= 0 {
+		return 1000
+	}
+	return c.Streams
+}
+
+func (c *Config) Pause() time.Duration {
+	return time.Duration(c.PauseMilliseconds) * time.Millisecond
 }
 
-func Cli(client *webserver.Client, config *Config) {
+func Cli(client webserver.API, config *Config, metrics *telemetry.Metrics) {
 	ctx := context.TODO()
 
-	uploader := NewGenerator(ctx, client)
+	uploader := NewGenerator(ctx, client, metrics)
+	uploader.Profile = &config.Profile
+	utils.Die(config.Profile.Validate())
 
 	switch config.Mode {
 	case "create-users":
+		uploader.captureAtPeak(ctx)
 		uploader.CreateUsers(ctx, 10)
+		uploader.StopProfiles()
+	case "stream-timelines":
+		streamer, ok := client.(webserver.TimelineStreamer)
+		if !ok {
+			utils.Die(errors.Errorf("mode %s requires the http transport", config.Mode))
+		}
+		signalContext, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		utils.Die(uploader.StreamTimelines(signalContext, streamer, config.StreamsOrDefault(), config.Workers, config.Pause()))
 	default:
 		utils.Die(errors.Errorf("invalid mode: %s", config.Mode))
 	}
@@ -3,6 +3,7 @@ package loadgen
 import (
 	"context"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,15 +13,26 @@ import (
 )
 
 type Generator struct {
-	Client  *webserver.Client
+	Client  webserver.API
+	Metrics *telemetry.Metrics
+	// Profile, if set, captures profiles from the target at the peak of a run
+	Profile *ProfileConfig
 	Actions chan func()
 	UserIds []uuid.UUID
+
+	// completed counts requests, so that profiles can be captured once the run is at its peak
+	completed    int64
+	peak         chan struct{}
+	profiles     sync.WaitGroup
+	stopProfiles context.CancelFunc
 }
 
-func NewGenerator(ctx context.Context, client *webserver.Client) *Generator {
+func NewGenerator(ctx context.Context, client webserver.API, metrics *telemetry.Metrics) *Generator {
 	g := &Generator{
 		Client:  client,
+		Metrics: metrics,
 		Actions: make(chan func()),
+		peak:    make(chan struct{}),
 	}
 	go func() {
 		for {
@@ -47,7 +59,7 @@ func (g *Generator) CreateUsers(ctx context.Context, limit int) {
 		nextUser := <-users
 		start := time.Now()
 		resp, err := g.Client.CreateUser(childCtx, &webserver.CreateUserRequest{Name: nextUser[0], Email: nextUser[1]})
-		telemetry.RecordClientApiRequestDuration("create user", err, start)
+		g.recordRequest("create user", err, start)
 		if err != nil {
 			logrus.Errorf("unable to create user: %+v", err)
 		} else {
@@ -63,7 +75,10 @@ func (g *Generator) CreateUsers(ctx context.Context, limit int) {
 func (g *Generator) CreateMessages(ctx context.Context, userId uuid.UUID, messages <-chan string, count int) {
 	for i := 0; i < count; i++ {
 		logrus.Infof("creating message %d of %d for user %s", i+1, count, userId.String())
-		resp, err := g.Client.CreateMessage(ctx, &webserver.CreateMessageRequest{SenderUserId: userId, Content: <-messages})
+		content := <-messages
+		start := time.Now()
+		resp, err := g.Client.CreateMessage(ctx, &webserver.CreateMessageRequest{SenderUserId: userId, Content: content})
+		g.recordRequest("create message", err, start)
 		if err != nil {
 			logrus.Errorf("unable to create message: %+v", err)
 		} else {
@@ -0,0 +1,155 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ProfileConfig captures profiles from the target at the peak of a run: once AfterRequests
+// requests have completed, and then after a delay, to let the target settle.  A capture which
+// hasn't finished when the run ends is abandoned, so Seconds should fit within the run.
+type ProfileConfig struct {
+	// URL is the target's prometheus port, such as http://webserver:9090; capturing is off
+	// unless it's set
+	URL          string
+	Seconds      int
+	DelaySeconds int
+	// AfterRequests is how many requests must complete before the run counts as being at
+	// full load; the default is 100
+	AfterRequests int
+	// Directory is where captures are written, and is required when capturing.  In a pod, it
+	// should be a mounted volume, or the captures go with the pod.
+	Directory string
+}
+
+func (c *ProfileConfig) SecondsOrDefault() int {
+	if c.Seconds <= 0 {
+		return 30
+	}
+	return c.Seconds
+}
+
+func (c *ProfileConfig) Delay() time.Duration {
+	return time.Duration(c.DelaySeconds) * time.Second
+}
+
+func (c *ProfileConfig) AfterRequestsOrDefault() int64 {
+	if c.AfterRequests <= 0 {
+		return 100
+	}
+	return int64(c.AfterRequests)
+}
+
+// Validate checks, before a run starts, that captures will have somewhere to go
+func (c *ProfileConfig) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	if c.Directory == "" {
+		return errors.Errorf("Profile.Directory is required to capture profiles")
+	}
+	info, err := os.Stat(c.Directory)
+	if err != nil {
+		return errors.Wrapf(err, "unable to use profile directory %s", c.Directory)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("profile directory %s isn't a directory", c.Directory)
+	}
+	return nil
+}
+
+// CaptureProfiles downloads a zip of cpu, heap and goroutine profiles from the target, and
+// returns the path it was saved to
+func CaptureProfiles(ctx context.Context, config *ProfileConfig) (string, error) {
+	seconds := config.SecondsOrDefault()
+	url := fmt.Sprintf("%s%s?seconds=%d", config.URL, telemetry.ProfileCapturePath, seconds)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to build request to %s", url)
+	}
+	client := &http.Client{Timeout: time.Duration(seconds)*time.Second + 30*time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to capture profiles from %s", url)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return "", errors.Errorf("unable to capture profiles from %s: status %d, %s", url, response.StatusCode, body)
+	}
+
+	path := filepath.Join(config.Directory, fmt.Sprintf("profiles-%s.zip", time.Now().UTC().Format("20060102T150405Z")))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to create %s", path)
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, response.Body); err != nil {
+		return "", errors.Wrapf(err, "unable to write %s", path)
+	}
+	return path, nil
+}
+
+// captureAtPeak captures profiles in the background, if configured to, once the run reaches
+// full load; call it before the run starts.  StopProfiles ends it with the run.
+func (g *Generator) captureAtPeak(ctx context.Context) {
+	if g.Profile == nil || g.Profile.URL == "" {
+		return
+	}
+	ctx, g.stopProfiles = context.WithCancel(ctx)
+	g.profiles.Add(1)
+	go func() {
+		defer g.profiles.Done()
+		select {
+		case <-ctx.Done():
+			logrus.Warnf("run ended after %d requests, before reaching the %d needed to capture profiles", atomic.LoadInt64(&g.completed), g.Profile.AfterRequestsOrDefault())
+			return
+		case <-g.peak:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(g.Profile.Delay()):
+		}
+		logrus.Infof("capturing %d seconds of profiles from %s", g.Profile.SecondsOrDefault(), g.Profile.URL)
+		path, err := CaptureProfiles(ctx, g.Profile)
+		if err != nil {
+			if ctx.Err() != nil {
+				logrus.Warnf("run ended during the %d second profile capture, which was abandoned; lower Profile.Seconds to fit the run", g.Profile.SecondsOrDefault())
+				return
+			}
+			logrus.Errorf("%+v", err)
+			return
+		}
+		logrus.Infof("saved profiles to %s", path)
+	}()
+}
+
+// recordRequest records a completed request, and marks the run as at its peak once enough
+// have completed
+func (g *Generator) recordRequest(name string, err error, start time.Time) {
+	g.Metrics.RecordClientApiRequestDuration(name, err, start)
+	completed := atomic.AddInt64(&g.completed, 1)
+	if g.Profile != nil && completed == g.Profile.AfterRequestsOrDefault() {
+		close(g.peak)
+	}
+}
+
+// StopProfiles abandons a capture which hasn't finished by the end of the run, since once the
+// load is gone it would no longer describe the target under load, and waits for it to stop
+func (g *Generator) StopProfiles() {
+	if g.stopProfiles != nil {
+		g.stopProfiles()
+	}
+	g.profiles.Wait()
+}
@@ -0,0 +1,137 @@
+package loadgen
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+)
+
+// newTestMetrics creates metrics which aren't registered, so that tests can make as many as
+// they like
+func newTestMetrics(t *testing.T) *telemetry.Metrics {
+	metrics, err := telemetry.NewMetrics("test", nil)
+	if err != nil {
+		t.Fatalf("unable to create metrics: %+v", err)
+	}
+	return metrics
+}
+
+func newTestGenerator(t *testing.T, profile *ProfileConfig) *Generator {
+	metrics := newTestMetrics(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	g := NewGenerator(ctx, nil, metrics)
+	g.Profile = profile
+	return g
+}
+
+func TestCaptureWaitsForPeak(t *testing.T) {
+	captures := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captures <- struct{}{}
+		_, _ = w.Write([]byte("profiles"))
+	}))
+	defer server.Close()
+	directory := t.TempDir()
+	g := newTestGenerator(t, &ProfileConfig{URL: server.URL, Seconds: 1, AfterRequests: 3, Directory: directory})
+
+	g.captureAtPeak(context.Background())
+	g.recordRequest("test", nil, time.Now())
+	g.recordRequest("test", nil, time.Now())
+	select {
+	case <-captures:
+		t.Fatalf("expected no capture before the run's peak")
+	case <-time.After(50 * time.Millisecond):
+	}
+	g.recordRequest("test", nil, time.Now())
+	select {
+	case <-captures:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a capture once the run peaked")
+	}
+	// the run ends once the capture is saved
+	for deadline := time.Now().Add(5 * time.Second); !saved(t, directory, "profiles"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the capture to be saved")
+		}
+	}
+	g.StopProfiles()
+}
+
+func saved(t *testing.T, directory string, contents string) bool {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("unable to read %s: %+v", directory, err)
+	}
+	for _, entry := range entries {
+		if out, _ := os.ReadFile(filepath.Join(directory, entry.Name())); string(out) == contents {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCaptureEndsWithRun(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	directory := t.TempDir()
+	g := newTestGenerator(t, &ProfileConfig{URL: server.URL, Seconds: 60, AfterRequests: 1, Directory: directory})
+
+	g.captureAtPeak(context.Background())
+	g.recordRequest("test", nil, time.Now())
+	<-started
+	stopped := make(chan struct{})
+	go func() {
+		g.StopProfiles()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the capture to be abandoned when the run ended")
+	}
+	if entries, _ := os.ReadDir(directory); len(entries) != 0 {
+		t.Errorf("expected nothing to be saved, got %+v", entries)
+	}
+
+	// a run which never peaks doesn't capture at all
+	g = newTestGenerator(t, &ProfileConfig{URL: server.URL, AfterRequests: 10, Directory: directory})
+	g.captureAtPeak(context.Background())
+	g.recordRequest("test", nil, time.Now())
+	g.StopProfiles()
+}
+
+func TestProfileConfigValidate(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "file")
+	if err != nil {
+		t.Fatalf("unable to create file: %+v", err)
+	}
+	file.Close()
+	for _, config := range []*ProfileConfig{
+		{URL: "http://webserver:9090"},
+		{URL: "http://webserver:9090", Directory: "/does/not/exist"},
+		{URL: "http://webserver:9090", Directory: file.Name()},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", config)
+		}
+	}
+	for _, config := range []*ProfileConfig{
+		{},
+		{URL: "http://webserver:9090", Directory: t.TempDir()},
+	} {
+		if err := config.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got %+v", config, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package loadgen
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattfenwick/scaling/pkg/webserver"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// StreamTimelines holds open streamCount timeline streams, spread over the existing users,
+// while workers create messages.  Fan-out latency is measured from each message's
+// server-side creation time, so assumes the clocks of loadgen and webserver roughly agree.
+// It runs until ctx is done.
+func (g *Generator) StreamTimelines(ctx context.Context, streamer webserver.TimelineStreamer, streamCount int, workers int, pause time.Duration) error {
+	resp, err := g.Client.GetUsers(ctx, &webserver.GetUsersRequest{})
+	if err != nil {
+		return err
+	}
+	if len(resp.Users) == 0 {
+		return errors.Errorf("no users to stream timelines for; try the create-users mode first")
+	}
+	userIds := make([]uuid.UUID, len(resp.Users))
+	for i, user := range resp.Users {
+		userIds[i] = user.UserId
+	}
+
+	g.captureAtPeak(ctx)
+	defer g.StopProfiles()
+
+	wg := &sync.WaitGroup{}
+	logrus.Infof("opening %d streams over %d users", streamCount, len(userIds))
+	for i := 0; i < streamCount; i++ {
+		wg.Add(1)
+		go func(userId uuid.UUID) {
+			defer wg.Done()
+			g.holdStream(ctx, streamer, userId)
+		}(userIds[i%len(userIds)])
+		// ramp up, rather than opening every connection at once
+		if i%100 == 99 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+
+	messages := GenerateMessages(ctx, int(time.Now().Unix()))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(pause):
+				}
+				start := time.Now()
+				_, err := g.Client.CreateMessage(ctx, &webserver.CreateMessageRequest{
+					SenderUserId: userIds[rand.Intn(len(userIds))],
+					Content:      <-messages,
+				})
+				g.recordRequest("create message", err, start)
+				if err != nil && ctx.Err() == nil {
+					logrus.Errorf("unable to create message: %+v", err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// holdStream reconnects, with a little jitter, whenever the stream ends
+func (g *Generator) holdStream(ctx context.Context, streamer webserver.TimelineStreamer, userId uuid.UUID) {
+	for {
+		g.Metrics.AddClientStreamConnections(1)
+		err := streamer.StreamTimeline(ctx, userId, func(event *webserver.TimelineEvent) {
+			g.Metrics.RecordClientStreamLatency(event.CreatedAt)
+		})
+		g.Metrics.AddClientStreamConnections(-1)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logrus.Errorf("timeline stream of %s failed: %s", userId, err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second + time.Duration(rand.Intn(1000))*time.Millisecond):
+		}
+	}
+}
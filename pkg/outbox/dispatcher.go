@@ -0,0 +1,260 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/mattfenwick/scaling/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type Webhook struct {
+	Name   string
+	URL    string
+	Secret string
+}
+
+type Config struct {
+	Webhooks []Webhook
+
+	// PollMilliseconds is how often to look for new outbox rows and due deliveries
+	PollMilliseconds int
+	// BatchSize caps how many deliveries are attempted concurrently
+	BatchSize int
+	// MaxAttempts is how many times a delivery is tried before it's dead-lettered
+	MaxAttempts int
+	// TimeoutSeconds bounds each webhook request
+	TimeoutSeconds int
+	// RetentionMinutes is how long delivered events are kept
+	RetentionMinutes int
+}
+
+func (c *Config) PollInterval() time.Duration {
+	if c.PollMilliseconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(c.PollMilliseconds) * time.Millisecond
+}
+
+func (c *Config) BatchSizeOrDefault() int {
+	if c.BatchSize <= 0 {
+		return 50
+	}
+	return c.BatchSize
+}
+
+func (c *Config) MaxAttemptsOrDefault() int {
+	if c.MaxAttempts <= 0 {
+		return 8
+	}
+	return c.MaxAttempts
+}
+
+func (c *Config) Timeout() time.Duration {
+	if c.TimeoutSeconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+func (c *Config) Retention() time.Duration {
+	if c.RetentionMinutes <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.RetentionMinutes) * time.Minute
+}
+
+// Redacted returns a copy of the config with webhook secrets hidden
+func (c *Config) Redacted() Config {
+	out := *c
+	out.Webhooks = make([]Webhook, len(c.Webhooks))
+	for i, webhook := range c.Webhooks {
+		webhook.Secret = "REDACTED"
+		out.Webhooks[i] = webhook
+	}
+	return out
+}
+
+// Event is the json body of a webhook request
+type Event struct {
+	Id        int64
+	Kind      string
+	CreatedAt time.Time
+	Payload   json.RawMessage
+}
+
+// Dispatcher delivers outbox events to every webhook, at least once.  Receivers should use
+// the delivery header to spot duplicates.
+type Dispatcher struct {
+	Config *Config
+	Client *http.Client
+	Store  Store
+
+	metrics  *telemetry.Metrics
+	webhooks map[string]*Webhook
+}
+
+func NewDispatcher(config *Config, db *sql.DB, metrics *telemetry.Metrics) *Dispatcher {
+	webhooks := map[string]*Webhook{}
+	for i := range config.Webhooks {
+		webhooks[config.Webhooks[i].Name] = &config.Webhooks[i]
+	}
+	return &Dispatcher{
+		Config:   config,
+		Client:   &http.Client{Transport: utils.OtelTransport(), Timeout: config.Timeout()},
+		Store:    &postgresStore{db: db, metrics: metrics},
+		metrics:  metrics,
+		webhooks: webhooks,
+	}
+}
+
+// Run dispatches until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	poll := time.NewTicker(d.Config.PollInterval())
+	defer poll.Stop()
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+			// keep going while there's a backlog
+			for {
+				count, err := d.DispatchOnce(ctx)
+				if err != nil {
+					logrus.Errorf("unable to dispatch webhooks: %+v", err)
+				}
+				if err != nil || count < d.Config.BatchSizeOrDefault() || ctx.Err() != nil {
+					break
+				}
+			}
+		case <-prune.C:
+			if err := d.Store.Prune(ctx, time.Now().Add(-d.Config.Retention())); err != nil {
+				logrus.Errorf("unable to prune outbox: %+v", err)
+			}
+		}
+	}
+}
+
+// DispatchOnce fans new outbox rows out to the webhooks, then attempts one batch of due
+// deliveries, returning the size of the batch
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	names := make([]string, 0, len(d.Config.Webhooks))
+	for _, webhook := range d.Config.Webhooks {
+		names = append(names, webhook.Name)
+	}
+	if _, err := d.Store.DispatchOutbox(ctx, names, d.Config.BatchSizeOrDefault()); err != nil {
+		return 0, err
+	}
+
+	// the lease outlasts the request timeout, so a delivery isn't claimed twice at once
+	deliveries, err := d.Store.ClaimDeliveries(ctx, d.Config.BatchSizeOrDefault(), 2*d.Config.Timeout())
+	if err != nil {
+		return 0, err
+	}
+	wg := &sync.WaitGroup{}
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *database.Delivery) {
+			defer wg.Done()
+			d.attempt(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, delivery *database.Delivery) {
+	start := time.Now()
+	webhook, ok := d.webhooks[delivery.Webhook]
+	var err error
+	if !ok {
+		err = errors.Errorf("webhook %s is no longer configured", delivery.Webhook)
+	} else {
+		err = d.Send(ctx, webhook, &Event{
+			Id:        delivery.OutboxId,
+			Kind:      delivery.Kind,
+			CreatedAt: delivery.CreatedAt,
+			Payload:   delivery.Payload,
+		})
+	}
+
+	if err == nil {
+		d.metrics.RecordWebhookDelivery(delivery.Webhook, "delivered", start)
+		d.metrics.RecordWebhookLag(delivery.Webhook, delivery.CreatedAt)
+		err = d.Store.MarkDelivered(ctx, delivery.OutboxId, delivery.Webhook)
+	} else {
+		dead := !ok || delivery.Attempts >= d.Config.MaxAttemptsOrDefault()
+		result := "failed"
+		if dead {
+			result = "dead"
+			logrus.Errorf("dead-lettering delivery of %d to %s after %d attempts: %s", delivery.OutboxId, delivery.Webhook, delivery.Attempts, err.Error())
+		} else {
+			logrus.Debugf("delivery of %d to %s failed, attempt %d: %s", delivery.OutboxId, delivery.Webhook, delivery.Attempts, err.Error())
+		}
+		d.metrics.RecordWebhookDelivery(delivery.Webhook, result, start)
+		err = d.Store.MarkFailed(ctx, delivery.OutboxId, delivery.Webhook, err, Backoff(delivery.Attempts), dead)
+	}
+	if err != nil {
+		// the lease will expire, and the delivery will be retried
+		logrus.Errorf("unable to record delivery of %d to %s: %+v", delivery.OutboxId, delivery.Webhook, err)
+	}
+}
+
+// Send posts a signed event to webhook; any non-2xx response is an error
+func (d *Dispatcher) Send(ctx context.Context, webhook *Webhook, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrapf(err, "unable to marshal event")
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "unable to create request")
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("content-type", "application/json")
+	request.Header.Set(EventHeader, event.Kind)
+	request.Header.Set(DeliveryHeader, strconv.FormatInt(event.Id, 10))
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, body))
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return errors.Wrapf(err, "unable to post to %s", webhook.Name)
+	}
+	defer response.Body.Close()
+	// drain, so that the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.Errorf("webhook %s responded with status code %d", webhook.Name, response.StatusCode)
+	}
+	return nil
+}
+
+// Backoff doubles from a second after the first attempt, up to ten minutes, with up to
+// 10% jitter so that failed deliveries don't retry in lockstep
+func Backoff(attempts int) time.Duration {
+	backoff := 10 * time.Minute
+	if attempts < 1 {
+		backoff = time.Second
+	} else if attempts <= 10 {
+		backoff = time.Second << (attempts - 1)
+		if backoff > 10*time.Minute {
+			backoff = 10 * time.Minute
+		}
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff/10)+1))
+}
@@ -0,0 +1,231 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+)
+
+// memoryStore hands out its pending deliveries once each, and records what happened to them
+type memoryStore struct {
+	mu        sync.Mutex
+	pending   []*database.Delivery
+	delivered []int64
+	failed    map[int64]failure
+}
+
+type failure struct {
+	retryAfter time.Duration
+	dead       bool
+}
+
+// newTestMetrics creates metrics which aren't registered, so that tests can make as many as
+// they like
+func newTestMetrics(t *testing.T) *telemetry.Metrics {
+	metrics, err := telemetry.NewMetrics("test", nil)
+	if err != nil {
+		t.Fatalf("unable to create metrics: %+v", err)
+	}
+	return metrics
+}
+
+func newMemoryStore(deliveries ...*database.Delivery) *memoryStore {
+	return &memoryStore{pending: deliveries, failed: map[int64]failure{}}
+}
+
+func (m *memoryStore) DispatchOutbox(ctx context.Context, webhooks []string, limit int) (int64, error) {
+	return 0, nil
+}
+
+func (m *memoryStore) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*database.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	claimed := m.pending
+	m.pending = nil
+	return claimed, nil
+}
+
+func (m *memoryStore) MarkDelivered(ctx context.Context, outboxId int64, webhook string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delivered = append(m.delivered, outboxId)
+	return nil
+}
+
+func (m *memoryStore) MarkFailed(ctx context.Context, outboxId int64, webhook string, deliveryErr error, retryAfter time.Duration, dead bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failed[outboxId] = failure{retryAfter: retryAfter, dead: dead}
+	return nil
+}
+
+func (m *memoryStore) Prune(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+// receiver accepts deliveries which are correctly signed, and rejects the rest, and any
+// whose id is in reject
+type receiver struct {
+	t      *testing.T
+	secret string
+	reject map[int64]bool
+
+	mu         sync.Mutex
+	received   map[int64]*Event
+	unverified int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		r.t.Errorf("unable to read body: %+v", err)
+		return
+	}
+	if err := Verify(r.secret, request.Header, body, time.Minute); err != nil {
+		r.mu.Lock()
+		r.unverified++
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	event := &Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		r.t.Errorf("unable to parse delivery: %+v", err)
+		return
+	}
+	if request.Header.Get(DeliveryHeader) != strconv.FormatInt(event.Id, 10) || request.Header.Get(EventHeader) != event.Kind {
+		r.t.Errorf("headers don't match event %+v: %+v", event, request.Header)
+	}
+	if r.reject[event.Id] {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.mu.Lock()
+	r.received[event.Id] = event
+	r.mu.Unlock()
+}
+
+func newTestDispatcher(t *testing.T, url string, secret string, store Store) *Dispatcher {
+	metrics := newTestMetrics(t)
+	config := &Config{
+		Webhooks:    []Webhook{{Name: "receiver", URL: url, Secret: secret}},
+		MaxAttempts: 3,
+	}
+	dispatcher := NewDispatcher(config, nil, metrics)
+	dispatcher.Store = store
+	return dispatcher
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	r := &receiver{t: t, secret: "secret", reject: map[int64]bool{2: true, 3: true}, received: map[int64]*Event{}}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	store := newMemoryStore(
+		&database.Delivery{OutboxId: 1, Webhook: "receiver", Attempts: 1, Kind: "messages", Payload: json.RawMessage(`{"content":"hi"}`), CreatedAt: time.Now()},
+		// rejected, with attempts to spare
+		&database.Delivery{OutboxId: 2, Webhook: "receiver", Attempts: 2, Kind: "messages", Payload: json.RawMessage(`{}`), CreatedAt: time.Now()},
+		// rejected on its last attempt
+		&database.Delivery{OutboxId: 3, Webhook: "receiver", Attempts: 3, Kind: "messages", Payload: json.RawMessage(`{}`), CreatedAt: time.Now()},
+		// for a webhook which has been removed from the config
+		&database.Delivery{OutboxId: 4, Webhook: "removed", Attempts: 1, Kind: "messages", Payload: json.RawMessage(`{}`), CreatedAt: time.Now()},
+	)
+	dispatcher := newTestDispatcher(t, server.URL, "secret", store)
+
+	count, err := dispatcher.DispatchOnce(context.Background())
+	if err != nil {
+		t.Fatalf("unable to dispatch: %+v", err)
+	}
+	if count != 4 {
+		t.Errorf("expected 4 deliveries to be attempted, got %d", count)
+	}
+
+	if len(store.delivered) != 1 || store.delivered[0] != 1 {
+		t.Errorf("expected 1 to be delivered, got %+v", store.delivered)
+	}
+	if event := r.received[1]; event == nil || event.Kind != "messages" || string(event.Payload) != `{"content":"hi"}` {
+		t.Errorf("expected 1 to be received intact, got %+v", event)
+	}
+	if r.unverified != 0 {
+		t.Errorf("expected every delivery to be verified, %d weren't", r.unverified)
+	}
+	if f, ok := store.failed[2]; !ok || f.dead || f.retryAfter < 2*time.Second || f.retryAfter > 2200*time.Millisecond {
+		t.Errorf("expected 2 to be retried after backoff, got %+v", f)
+	}
+	if f, ok := store.failed[3]; !ok || !f.dead {
+		t.Errorf("expected 3 to be dead-lettered after max attempts, got %+v", f)
+	}
+	if f, ok := store.failed[4]; !ok || !f.dead {
+		t.Errorf("expected 4, for an unknown webhook, to be dead-lettered, got %+v", f)
+	}
+}
+
+func TestDispatcherSignatureMismatch(t *testing.T) {
+	r := &receiver{t: t, secret: "secret", received: map[int64]*Event{}}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	store := newMemoryStore(&database.Delivery{OutboxId: 1, Webhook: "receiver", Attempts: 1, Kind: "users", Payload: json.RawMessage(`{}`), CreatedAt: time.Now()})
+	dispatcher := newTestDispatcher(t, server.URL, "wrong secret", store)
+	if _, err := dispatcher.DispatchOnce(context.Background()); err != nil {
+		t.Fatalf("unable to dispatch: %+v", err)
+	}
+	if r.unverified != 1 || len(r.received) != 0 || len(store.delivered) != 0 {
+		t.Errorf("expected a badly signed delivery to be rejected")
+	}
+	if f, ok := store.failed[1]; !ok || f.dead {
+		t.Errorf("expected the rejected delivery to be retried, got %+v", f)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"Id":1}`)
+	header := http.Header{}
+	now := time.Now().Unix()
+	header.Set(TimestampHeader, strconv.FormatInt(now, 10))
+	header.Set(SignatureHeader, Sign("secret", now, body))
+	if err := Verify("secret", header, body, time.Minute); err != nil {
+		t.Errorf("expected a valid signature, got %+v", err)
+	}
+	if err := Verify("secret", header, []byte(`{"Id":2}`), time.Minute); err == nil {
+		t.Errorf("expected a changed body to fail")
+	}
+	if err := Verify("other", header, body, time.Minute); err == nil {
+		t.Errorf("expected a different secret to fail")
+	}
+
+	old := now - 600
+	header.Set(TimestampHeader, strconv.FormatInt(old, 10))
+	header.Set(SignatureHeader, Sign("secret", old, body))
+	if err := Verify("secret", header, body, time.Minute); err == nil {
+		t.Errorf("expected a stale timestamp to fail")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, base := range map[int]time.Duration{
+		0:  time.Second,
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		10: 512 * time.Second,
+		11: 10 * time.Minute,
+		50: 10 * time.Minute,
+	} {
+		for i := 0; i < 100; i++ {
+			backoff := Backoff(attempts)
+			if backoff < base || backoff > base+base/10 {
+				t.Fatalf("attempt %d: expected backoff from %s to %s, got %s", attempts, base, base+base/10, backoff)
+			}
+		}
+	}
+}
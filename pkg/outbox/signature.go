@@ -0,0 +1,54 @@
+package outbox
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Webhook requests carry these headers.  The signature covers the timestamp as well as
+// the body, so that a captured request can't be replayed later.
+const (
+	EventHeader     = "X-Scaling-Event"
+	DeliveryHeader  = "X-Scaling-Delivery"
+	TimestampHeader = "X-Scaling-Timestamp"
+	SignatureHeader = "X-Scaling-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+// Sign computes the signature header value: `sha256=` and the hex HMAC-SHA256 of
+// `<timestamp>.<body>`
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify is for receivers: it checks the signature, and that the timestamp is within
+// tolerance of now
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "unable to parse %s", TimestampHeader)
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return errors.Errorf("timestamp %d outside of tolerance %s", timestamp, tolerance)
+	}
+	signature := header.Get(SignatureHeader)
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return errors.Errorf("missing or malformed %s", SignatureHeader)
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return errors.Errorf("signature mismatch")
+	}
+	return nil
+}
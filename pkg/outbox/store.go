@@ -0,0 +1,49 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+)
+
+// Store is where the dispatcher finds deliveries and records how they went
+type Store interface {
+	// DispatchOutbox fans up to limit new outbox rows out into one delivery per webhook
+	DispatchOutbox(ctx context.Context, webhooks []string, limit int) (int64, error)
+	// ClaimDeliveries returns up to limit deliveries which are due, leasing them for lease
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*database.Delivery, error)
+	MarkDelivered(ctx context.Context, outboxId int64, webhook string) error
+	// MarkFailed schedules a retry after retryAfter, or dead-letters the delivery if dead
+	MarkFailed(ctx context.Context, outboxId int64, webhook string, deliveryErr error, retryAfter time.Duration, dead bool) error
+	// Prune drops delivered events last updated before `before`
+	Prune(ctx context.Context, before time.Time) error
+}
+
+// postgresStore keeps deliveries in the outbox and webhook_deliveries tables
+type postgresStore struct {
+	db      *sql.DB
+	metrics *telemetry.Metrics
+}
+
+func (p *postgresStore) DispatchOutbox(ctx context.Context, webhooks []string, limit int) (int64, error) {
+	return database.DispatchOutbox(ctx, p.db, p.metrics, webhooks, limit)
+}
+
+func (p *postgresStore) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*database.Delivery, error) {
+	return database.ClaimDeliveries(ctx, p.db, p.metrics, limit, lease)
+}
+
+func (p *postgresStore) MarkDelivered(ctx context.Context, outboxId int64, webhook string) error {
+	return database.MarkDeliveryDelivered(ctx, p.db, p.metrics, outboxId, webhook)
+}
+
+func (p *postgresStore) MarkFailed(ctx context.Context, outboxId int64, webhook string, deliveryErr error, retryAfter time.Duration, dead bool) error {
+	return database.MarkDeliveryFailed(ctx, p.db, p.metrics, outboxId, webhook, deliveryErr, retryAfter, dead)
+}
+
+func (p *postgresStore) Prune(ctx context.Context, before time.Time) error {
+	return database.PruneOutbox(ctx, p.db, p.metrics, before)
+}
@@ -0,0 +1,126 @@
+package telemetry
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PprofPath = "/debug/pprof/"
+	// ProfileCapturePath serves a zip of cpu, heap and goroutine profiles, taken together
+	ProfileCapturePath = "/debug/profiles"
+
+	defaultCaptureSeconds = 30
+	maxCaptureSeconds     = 300
+)
+
+// RegisterRuntimeMetrics replaces the global registry's go collector with one which also
+// exports the runtime's own metrics: gc pause and scheduler latency histograms, and a finer
+// breakdown of the heap
+func RegisterRuntimeMetrics() error {
+	prometheus.Unregister(collectors.NewGoCollector())
+	err := prometheus.Register(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsMemory, collectors.MetricsScheduler)))
+	return errors.Wrapf(err, "unable to register go runtime metrics")
+}
+
+// registerDiagnostics serves net/http/pprof, and on-demand profile captures, from serveMux
+func registerDiagnostics(serveMux *http.ServeMux) {
+	serveMux.HandleFunc(PprofPath, pprof.Index)
+	serveMux.HandleFunc(PprofPath+"cmdline", pprof.Cmdline)
+	serveMux.HandleFunc(PprofPath+"profile", pprof.Profile)
+	serveMux.HandleFunc(PprofPath+"symbol", pprof.Symbol)
+	serveMux.HandleFunc(PprofPath+"trace", pprof.Trace)
+	serveMux.HandleFunc(ProfileCapturePath, captureProfiles)
+}
+
+// captureLock makes captures take turns, since only one cpu profile can run at a time
+var captureLock sync.Mutex
+
+// captureProfiles profiles the cpu for `seconds` (30 by default), then snapshots the heap and
+// goroutines, so that all three describe the same stretch of time
+func captureProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	seconds := defaultCaptureSeconds
+	if value := r.URL.Query().Get("seconds"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxCaptureSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be from 1 to %d", maxCaptureSeconds), http.StatusBadRequest)
+			return
+		}
+		seconds = parsed
+	}
+	if !captureLock.TryLock() {
+		http.Error(w, "a capture is already running", http.StatusConflict)
+		return
+	}
+	defer captureLock.Unlock()
+
+	logrus.Infof("capturing profiles for %d seconds", seconds)
+	archive, err := profileArchive(r, time.Duration(seconds)*time.Second)
+	if err != nil {
+		logrus.Errorf("unable to capture profiles: %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"profiles-%s.zip\"", time.Now().UTC().Format("20060102T150405Z")))
+	_, _ = w.Write(archive)
+}
+
+func profileArchive(r *http.Request, duration time.Duration) ([]byte, error) {
+	cpu := &bytes.Buffer{}
+	// fails if someone's using pprof's own cpu endpoint
+	if err := runtimepprof.StartCPUProfile(cpu); err != nil {
+		return nil, errors.Wrapf(err, "unable to start cpu profile")
+	}
+	select {
+	case <-time.After(duration):
+	case <-r.Context().Done():
+	}
+	runtimepprof.StopCPUProfile()
+	if err := r.Context().Err(); err != nil {
+		return nil, errors.Wrapf(err, "capture abandoned")
+	}
+
+	out := &bytes.Buffer{}
+	archive := zip.NewWriter(out)
+	file, err := archive.Create("cpu.pprof")
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to add cpu profile")
+	}
+	if _, err := file.Write(cpu.Bytes()); err != nil {
+		return nil, errors.Wrapf(err, "unable to add cpu profile")
+	}
+	// collect garbage first, so that the heap profile is up to date
+	runtime.GC()
+	for _, name := range []string{"heap", "goroutine"} {
+		file, err := archive.Create(name + ".pprof")
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to add %s profile", name)
+		}
+		if err := runtimepprof.Lookup(name).WriteTo(file, 0); err != nil {
+			return nil, errors.Wrapf(err, "unable to write %s profile", name)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, errors.Wrapf(err, "unable to finish profile archive")
+	}
+	return out.Bytes(), nil
+}
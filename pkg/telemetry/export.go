@@ -0,0 +1,215 @@
+package telemetry
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const metricsScope = "github.com/mattfenwick/scaling/pkg/telemetry"
+
+func (c *TracingConfig) MetricsInterval() time.Duration {
+	if c.MetricsIntervalSeconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.MetricsIntervalSeconds) * time.Second
+}
+
+func (c *TracingConfig) metricsExporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	switch c.ExporterOrDefault() {
+	case TraceExporterOTLPGRPC:
+		var options []otlpmetricgrpc.Option
+		if c.Endpoint != "" {
+			options = append(options, otlpmetricgrpc.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlpmetricgrpc.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			options = append(options, otlpmetricgrpc.WithHeaders(c.Headers))
+		}
+		exporter, err := otlpmetricgrpc.New(ctx, options...)
+		return exporter, errors.Wrapf(err, "unable to instantiate otlp grpc metric exporter")
+	case TraceExporterOTLPHTTP:
+		var options []otlpmetrichttp.Option
+		if c.Endpoint != "" {
+			options = append(options, otlpmetrichttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlpmetrichttp.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			options = append(options, otlpmetrichttp.WithHeaders(c.Headers))
+		}
+		exporter, err := otlpmetrichttp.New(ctx, options...)
+		return exporter, errors.Wrapf(err, "unable to instantiate otlp http metric exporter")
+	default:
+		return nil, errors.Errorf("metrics can only be exported over otlp, not %s", c.ExporterOrDefault())
+	}
+}
+
+// MetricsExporter pushes everything gathered from a prometheus registry to an otlp collector
+// periodically, so that collectors which don't scrape still get the metrics served on
+// /metrics.  Summaries have no otlp equivalent, so they're only served on /metrics.
+type MetricsExporter struct {
+	gatherer prometheus.Gatherer
+	exporter sdkmetric.Exporter
+	resource *resource.Resource
+	start    time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartMetricsExporter exports what gatherer gathers every config.MetricsInterval(), until
+// it's shut down
+func StartMetricsExporter(ctx context.Context, config *TracingConfig, service string, gatherer prometheus.Gatherer) (*MetricsExporter, error) {
+	logrus.Infof("setting up %s metrics exporter at '%s' for service %s, every %s", config.ExporterOrDefault(), config.Endpoint, service, config.MetricsInterval())
+
+	exporter, err := config.metricsExporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e := &MetricsExporter{
+		gatherer: gatherer,
+		exporter: exporter,
+		resource: config.resource(service),
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run(config.MetricsInterval())
+	return e, nil
+}
+
+func (e *MetricsExporter) run(interval time.Duration) {
+	defer close(e.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := e.Export(ctx); err != nil {
+				logrus.Errorf("%+v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Export gathers and exports the current values once
+func (e *MetricsExporter) Export(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return errors.Wrapf(err, "unable to gather metrics")
+	}
+	metrics := metricdata.ResourceMetrics{
+		Resource: e.resource,
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: metricsScope},
+			Metrics: convertMetricFamilies(families, e.start, time.Now()),
+		}},
+	}
+	return errors.Wrapf(e.exporter.Export(ctx, metrics), "unable to export metrics")
+}
+
+// Shutdown stops the periodic export, exports the final values, and closes the connection
+// to the collector
+func (e *MetricsExporter) Shutdown(ctx context.Context) error {
+	close(e.stop)
+	<-e.done
+	err := e.Export(ctx)
+	if shutdownErr := e.exporter.Shutdown(ctx); err == nil {
+		err = errors.Wrapf(shutdownErr, "unable to shut down metrics exporter")
+	}
+	return err
+}
+
+// convertMetricFamilies translates prometheus' cumulative counters, gauges and histograms into
+// their otlp equivalents.  Prometheus doesn't record when series start, so start, when
+// exporting started, stands in for it.
+func convertMetricFamilies(families []*dto.MetricFamily, start time.Time, now time.Time) []metricdata.Metrics {
+	var out []metricdata.Metrics
+	for _, family := range families {
+		var data metricdata.Aggregation
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+			for _, metric := range family.Metric {
+				sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: labelSet(metric), StartTime: start, Time: now, Value: metric.GetCounter().GetValue(),
+				})
+			}
+			data = sum
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := metricdata.Gauge[float64]{}
+			for _, metric := range family.Metric {
+				value := metric.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = metric.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: labelSet(metric), StartTime: start, Time: now, Value: value,
+				})
+			}
+			data = gauge
+		case dto.MetricType_HISTOGRAM:
+			histogram := metricdata.Histogram{Temporality: metricdata.CumulativeTemporality}
+			for _, metric := range family.Metric {
+				histogram.DataPoints = append(histogram.DataPoints, histogramDataPoint(metric, start, now))
+			}
+			data = histogram
+		default:
+			continue
+		}
+		out = append(out, metricdata.Metrics{Name: family.GetName(), Description: family.GetHelp(), Data: data})
+	}
+	return out
+}
+
+// histogramDataPoint turns prometheus' cumulative bucket counts into otlp's per-bucket counts,
+// which end with a bucket for everything above the last bound
+func histogramDataPoint(metric *dto.Metric, start time.Time, now time.Time) metricdata.HistogramDataPoint {
+	histogram := metric.GetHistogram()
+	point := metricdata.HistogramDataPoint{
+		Attributes: labelSet(metric),
+		StartTime:  start,
+		Time:       now,
+		Count:      histogram.GetSampleCount(),
+		Sum:        histogram.GetSampleSum(),
+	}
+	var previous uint64
+	for _, bucket := range histogram.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		point.Bounds = append(point.Bounds, bucket.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, bucket.GetCumulativeCount()-previous)
+		previous = bucket.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, point.Count-previous)
+	return point
+}
+
+func labelSet(metric *dto.Metric) attribute.Set {
+	attributes := make([]attribute.KeyValue, 0, len(metric.Label))
+	for _, label := range metric.Label {
+		attributes = append(attributes, attribute.String(label.GetName(), label.GetValue()))
+	}
+	return attribute.NewSet(attributes...)
+}
@@ -1,19 +1,66 @@
 package telemetry
 
 import (
+	"context"
+	"time"
+
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
 )
 
-func SetUpLogger(level string) error {
+func SetUpLogger(level string, format string) error {
 	logLevel, err := logrus.ParseLevel(level)
 	if err != nil {
 		return errors.Wrapf(err, "unable to parse the specified log level: '%s'", level)
 	}
 	logrus.SetLevel(logLevel)
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-	})
+	switch format {
+	case "", LogFormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+		})
+	case LogFormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+	default:
+		return errors.Errorf("invalid log format: '%s'", format)
+	}
 	logrus.Infof("log level set to '%s'", logrus.GetLevel())
 	return nil
 }
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying logger, so that everything handling a request logs
+// with the same fields
+func WithLogger(ctx context.Context, logger *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger carried by ctx.  Failing that, it returns the standard logger,
+// with the ids of ctx's span if there is one.
+func Logger(ctx context.Context) *logrus.Entry {
+	if logger, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return logger
+	}
+	return logrus.WithFields(TraceFields(ctx))
+}
+
+// TraceFields are the trace and span ids of ctx's span, which tie log lines to traces
+func TraceFields(ctx context.Context) logrus.Fields {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return logrus.Fields{}
+	}
+	return logrus.Fields{
+		"trace_id": spanContext.TraceID().String(),
+		"span_id":  spanContext.SpanID().String(),
+	}
+}
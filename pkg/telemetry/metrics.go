@@ -1,72 +1,456 @@
 package telemetry
 
 import (
+	"database/sql"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var keyValCounter *prometheus.CounterVec
-var apiDurationHistogram *prometheus.HistogramVec
-var eventLoopDurationHistogram *prometheus.HistogramVec
-var clientApiRequestDurationHistogram *prometheus.HistogramVec
+// Metrics are registered with the Registerer they're created with, rather than always the
+// global one, so that several services can run in one process -- such as a webserver and a
+// loadgen in a benchmark -- without their metrics colliding.  Likewise, the spans of the
+// queries they time go to the service's TracerProvider, rather than the global one.
+type Metrics struct {
+	namespace      string
+	registerer     prometheus.Registerer
+	slos           *SLOTracker
+	tracerProvider trace.TracerProvider
+
+	keyValCounter                     *prometheus.CounterVec
+	apiDurationHistogram              *prometheus.HistogramVec
+	apiInFlightGauge                  *prometheus.GaugeVec
+	apiRequestSizeHistogram           *prometheus.HistogramVec
+	apiResponseSizeHistogram          *prometheus.HistogramVec
+	grpcDurationHistogram             *prometheus.HistogramVec
+	eventLoopDurationHistogram        *prometheus.HistogramVec
+	clientApiRequestDurationHistogram *prometheus.HistogramVec
+	eventLoopWaitHistogram            *prometheus.HistogramVec
+	eventLoopQueueDepthGauge          prometheus.Gauge
+	eventLoopShedCounter              *prometheus.CounterVec
+	eventLoopExpiredCounter           *prometheus.CounterVec
+	streamConnectionsGauge            prometheus.Gauge
+	streamEventCounter                *prometheus.CounterVec
+	dbEventCounter                    *prometheus.CounterVec
+	dbListenerConnectionEventCounter  *prometheus.CounterVec
+	dbErrorCounter                    *prometheus.CounterVec
+	dbQueryDurationHistogram          *prometheus.HistogramVec
+	webhookDeliveryDurationHistogram  *prometheus.HistogramVec
+	webhookLagHistogram               *prometheus.HistogramVec
+	clientStreamConnectionsGauge      prometheus.Gauge
+	clientStreamLatencyHistogram      prometheus.Histogram
+	cacheRequestCounter               *prometheus.CounterVec
+	cacheRemovalCounter               *prometheus.CounterVec
+	cacheEntriesGauge                 *prometheus.GaugeVec
+}
 
-func RecordKeyValEvent(name string, value string) {
+func (m *Metrics) RecordKeyValEvent(name string, value string) {
 	labels := prometheus.Labels{"name": name, "value": value}
-	keyValCounter.With(labels).Inc()
+	m.keyValCounter.With(labels).Inc()
+}
+
+// API metrics are labelled by route template, such as `/v1/users/{userid}`, and never by the
+// raw path, so that scans and typos can't create unbounded numbers of series
+func (m *Metrics) RecordAPIRequest(route string, method string, code int, duration time.Duration, requestBytes int64, responseBytes int64) {
+	method = normalizeMethod(method)
+	labels := prometheus.Labels{"route": route, "method": method, "code": fmt.Sprintf("%d", code)}
+	m.apiDurationHistogram.With(labels).Observe(duration.Seconds())
+	sizeLabels := prometheus.Labels{"route": route, "method": method}
+	m.apiRequestSizeHistogram.With(sizeLabels).Observe(float64(requestBytes))
+	m.apiResponseSizeHistogram.With(sizeLabels).Observe(float64(responseBytes))
+	if m.slos != nil {
+		m.slos.Observe(route, code, duration)
+	}
+}
+
+// TrackSLOs starts computing error budgets and burn rates, for SLOs on the routes of the API
+// requests recorded from now on.  It must be called before any requests are recorded.
+func (m *Metrics) TrackSLOs(configs []SLOConfig) error {
+	tracker, err := NewSLOTracker(m.namespace, configs)
+	if err != nil {
+		return err
+	}
+	if err := m.register(tracker); err != nil {
+		return err
+	}
+	m.slos = tracker
+	return nil
+}
+
+// SLOStatuses reports the tracked SLOs, if there are any
+func (m *Metrics) SLOStatuses() []*SLOStatus {
+	if m.slos == nil {
+		return nil
+	}
+	return m.slos.Statuses()
+}
+
+func (m *Metrics) AddAPIInFlight(route string, delta int) {
+	m.apiInFlightGauge.With(prometheus.Labels{"route": route}).Add(float64(delta))
+}
+
+func normalizeMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
 }
 
-func RecordAPIDuration(path string, method string, code int, start time.Time) {
+func (m *Metrics) RecordGRPCDuration(method string, code string, start time.Time) {
 	duration := time.Since(start)
-	labels := prometheus.Labels{"path": path, "method": method, "code": fmt.Sprintf("%d", code)}
-	apiDurationHistogram.With(labels).Observe(float64(duration / time.Millisecond))
+	labels := prometheus.Labels{"method": method, "code": code}
+	m.grpcDurationHistogram.With(labels).Observe(duration.Seconds())
 }
 
-func RecordEventLoopDuration(name string, err error, start time.Time) {
+func (m *Metrics) RecordEventLoopDuration(name string, err error, start time.Time) {
 	duration := time.Since(start)
 	labels := prometheus.Labels{"name": name, "isError": fmt.Sprintf("%t", err != nil)}
-	eventLoopDurationHistogram.With(labels).Observe(float64(duration / time.Millisecond))
+	m.eventLoopDurationHistogram.With(labels).Observe(duration.Seconds())
 }
 
-func RecordClientApiRequestDuration(name string, err error, start time.Time) {
+func (m *Metrics) RecordEventLoopWait(name string, enqueuedAt time.Time) {
+	duration := time.Since(enqueuedAt)
+	m.eventLoopWaitHistogram.With(prometheus.Labels{"name": name}).Observe(duration.Seconds())
+}
+
+func (m *Metrics) SetEventLoopQueueDepth(depth int) {
+	m.eventLoopQueueDepthGauge.Set(float64(depth))
+}
+
+func (m *Metrics) RecordEventLoopShed(name string) {
+	m.eventLoopShedCounter.With(prometheus.Labels{"name": name}).Inc()
+}
+
+func (m *Metrics) RecordEventLoopExpired(name string) {
+	m.eventLoopExpiredCounter.With(prometheus.Labels{"name": name}).Inc()
+}
+
+func (m *Metrics) SetStreamConnections(count int) {
+	m.streamConnectionsGauge.Set(float64(count))
+}
+
+// RecordStreamEvent counts events handed to timeline streams, by result: delivered or dropped
+func (m *Metrics) RecordStreamEvent(result string) {
+	m.streamEventCounter.With(prometheus.Labels{"result": result}).Inc()
+}
+
+// RecordDBEvent counts events received from postgres, by kind and by source: notify or replay
+func (m *Metrics) RecordDBEvent(kind string, source string) {
+	m.dbEventCounter.With(prometheus.Labels{"kind": kind, "source": source}).Inc()
+}
+
+func (m *Metrics) RecordDBListenerConnectionEvent(event string) {
+	m.dbListenerConnectionEventCounter.With(prometheus.Labels{"event": event}).Inc()
+}
+
+// RecordDBError counts database errors by class, and by what was done about them: retried,
+// exhausted when out of attempts, or failed when the error isn't retryable
+func (m *Metrics) RecordDBError(class string, outcome string) {
+	m.dbErrorCounter.With(prometheus.Labels{"class": class, "outcome": outcome}).Inc()
+}
+
+// RecordDBQueryDuration records fractional milliseconds, since many queries take less than one
+func (m *Metrics) RecordDBQueryDuration(query string, err error, start time.Time) {
+	duration := time.Since(start)
+	labels := prometheus.Labels{"query": query, "isError": fmt.Sprintf("%t", err != nil)}
+	m.dbQueryDurationHistogram.With(labels).Observe(float64(duration) / float64(time.Millisecond))
+}
+
+// RegisterDBStats exports a connection pool's stats: open, in-use and idle connections, and how
+// often and for how long queries waited for one
+func (m *Metrics) RegisterDBStats(db *sql.DB, name string) error {
+	return m.register(collectors.NewDBStatsCollector(db, name))
+}
+
+// RecordWebhookDelivery records a delivery attempt, by result: delivered, failed or dead
+func (m *Metrics) RecordWebhookDelivery(webhook string, result string, start time.Time) {
+	duration := time.Since(start)
+	labels := prometheus.Labels{"webhook": webhook, "result": result}
+	m.webhookDeliveryDurationHistogram.With(labels).Observe(duration.Seconds())
+}
+
+// RecordWebhookLag records the time from a write until its successful delivery
+func (m *Metrics) RecordWebhookLag(webhook string, createdAt time.Time) {
+	m.webhookLagHistogram.With(prometheus.Labels{"webhook": webhook}).Observe(time.Since(createdAt).Seconds())
+}
+
+// RecordCacheRequest counts cache lookups, by result: hit, miss, or shared when a miss
+// waits for a load which is already in progress
+func (m *Metrics) RecordCacheRequest(cache string, result string) {
+	m.cacheRequestCounter.With(prometheus.Labels{"cache": cache, "result": result}).Inc()
+}
+
+// RecordCacheRemoval counts entries leaving a cache, by reason: expired, evicted,
+// invalidated or replaced
+func (m *Metrics) RecordCacheRemoval(cache string, reason string) {
+	m.cacheRemovalCounter.With(prometheus.Labels{"cache": cache, "reason": reason}).Inc()
+}
+
+func (m *Metrics) SetCacheEntries(cache string, count int) {
+	m.cacheEntriesGauge.With(prometheus.Labels{"cache": cache}).Set(float64(count))
+}
+
+func (m *Metrics) AddClientStreamConnections(delta int) {
+	m.clientStreamConnectionsGauge.Add(float64(delta))
+}
+
+// RecordClientStreamLatency records the time from a message's creation until a stream receives it
+func (m *Metrics) RecordClientStreamLatency(createdAt time.Time) {
+	m.clientStreamLatencyHistogram.Observe(time.Since(createdAt).Seconds())
+}
+
+func (m *Metrics) RecordClientApiRequestDuration(name string, err error, start time.Time) {
 	duration := time.Since(start)
 	labels := prometheus.Labels{"name": name, "isError": fmt.Sprintf("%t", err != nil)}
-	clientApiRequestDurationHistogram.With(labels).Observe(float64(duration / time.Millisecond))
+	m.clientApiRequestDurationHistogram.With(labels).Observe(float64(duration / time.Millisecond))
+}
+
+// SetTracerProvider sends the spans of work timed by these metrics, such as database
+// queries, to tp.  Until it's called, those spans are dropped.
+func (m *Metrics) SetTracerProvider(tp trace.TracerProvider) {
+	m.tracerProvider = tp
 }
 
-func CreateMetrics(namespace string) {
-	apiDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+// Tracer returns the named tracer of the provider given to SetTracerProvider
+func (m *Metrics) Tracer(name string) trace.Tracer {
+	return m.tracerProvider.Tracer(name)
+}
+
+// NewMetrics creates every metric under namespace, and registers them with registerer.  If
+// registerer is nil, the metrics work but aren't exported.
+func NewMetrics(namespace string, registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{namespace: namespace, registerer: registerer, tracerProvider: trace.NewNoopTracerProvider()}
+
+	m.apiDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: namespace,
 		Subsystem: "api",
-		Name:      "duration_histogram_milliseconds",
-		Help:      "record duration of API endpoints in milliseconds",
-		Buckets:   prometheus.ExponentialBuckets(1, 2, 20),
-	}, []string{"path", "method", "code"})
-	prometheus.MustRegister(apiDurationHistogram)
+		Name:      "request_duration_seconds",
+		Help:      "record duration of API requests in seconds, by route template",
+		// 100us to 30s; scrapers which support native histograms get finer resolution still
+		Buckets:                     prometheus.ExponentialBucketsRange(0.0001, 30, 24),
+		NativeHistogramBucketFactor: 1.1,
+	}, []string{"route", "method", "code"})
 
-	eventLoopDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	m.apiInFlightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: "api",
-		Name:      "event_loop_duration_histogram_milliseconds",
-		Help:      "record duration of event loop handler",
-		Buckets:   prometheus.ExponentialBuckets(1, 2, 20),
+		Name:      "in_flight_requests",
+		Help:      "number of API requests being handled, by route template",
+	}, []string{"route"})
+
+	m.apiRequestSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "request_size_bytes",
+		Help:      "record size of API request bodies, by route template",
+		Buckets:   prometheus.ExponentialBuckets(16, 4, 10),
+	}, []string{"route", "method"})
+
+	m.apiResponseSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "response_size_bytes",
+		Help:      "record size of API response bodies, by route template",
+		Buckets:   prometheus.ExponentialBuckets(16, 4, 10),
+	}, []string{"route", "method"})
+
+	m.grpcDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "grpc_duration_seconds",
+		Help:      "record duration of gRPC methods in seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20),
+	}, []string{"method", "code"})
+
+	m.eventLoopDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "event_loop_duration_seconds",
+		Help:      "record duration of event loop handler in seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20),
 	}, []string{"name", "isError"})
-	prometheus.MustRegister(eventLoopDurationHistogram)
 
-	clientApiRequestDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	m.eventLoopWaitHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "event_loop_wait_seconds",
+		Help:      "record seconds actions spend queued before an event loop worker picks them up",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20),
+	}, []string{"name"})
+
+	m.eventLoopQueueDepthGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "event_loop_queue_depth",
+		Help:      "number of actions waiting in the event loop queue",
+	})
+
+	m.eventLoopShedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "event_loop_shed_counter",
+		Help:      "actions rejected because the event loop queue was full",
+	}, []string{"name"})
+
+	m.eventLoopExpiredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "event_loop_expired_counter",
+		Help:      "actions skipped because their deadline passed while queued",
+	}, []string{"name"})
+
+	m.streamConnectionsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "stream_connections",
+		Help:      "number of open timeline streams",
+	})
+
+	m.streamEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "stream_event_counter",
+		Help:      "events handed to timeline streams, by whether they were delivered or dropped",
+	}, []string{"result"})
+
+	m.dbEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "event_counter",
+		Help:      "events received from postgres, by kind and by whether they were notified or replayed",
+	}, []string{"kind", "source"})
+
+	m.dbListenerConnectionEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "listener_connection_event_counter",
+		Help:      "connection state changes of the postgres event listener",
+	}, []string{"event"})
+
+	m.dbErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "error_counter",
+		Help:      "database errors, by class and outcome",
+	}, []string{"class", "outcome"})
+
+	m.dbQueryDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_duration_histogram_milliseconds",
+		Help:      "record duration of database queries in milliseconds, by query name",
+		Buckets:   prometheus.ExponentialBuckets(0.125, 2, 20),
+	}, []string{"query", "isError"})
+
+	m.webhookDeliveryDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "delivery_duration_seconds",
+		Help:      "record duration of webhook delivery attempts in seconds, by result",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20),
+	}, []string{"webhook", "result"})
+
+	m.webhookLagHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "lag_seconds",
+		Help:      "record seconds from a write until its webhook delivery succeeds",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 24),
+	}, []string{"webhook"})
+
+	m.clientStreamConnectionsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "stream_connections",
+		Help:      "number of timeline streams held open from the client side",
+	})
+
+	m.clientStreamLatencyHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "stream_latency_seconds",
+		Help:      "record seconds from message creation until a timeline stream receives it",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20),
+	})
+
+	m.clientApiRequestDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: namespace,
 		Subsystem: "client",
 		Name:      "request_duration_histogram_milliseconds",
 		Help:      "record duration of requests to APIs from the client side",
 		Buckets:   prometheus.ExponentialBuckets(1, 2, 20),
 	}, []string{"name", "isError"})
-	prometheus.MustRegister(clientApiRequestDurationHistogram)
 
-	keyValCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	m.cacheRequestCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "request_counter",
+		Help:      "cache lookups, by cache and by whether they hit, missed, or shared a load in progress",
+	}, []string{"cache", "result"})
+
+	m.cacheRemovalCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "removal_counter",
+		Help:      "entries removed from caches, by cache and reason",
+	}, []string{"cache", "reason"})
+
+	m.cacheEntriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "entries",
+		Help:      "number of entries in each cache",
+	}, []string{"cache"})
+
+	m.keyValCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: "api",
 		Name:      "keyval_counter",
 		Help:      "event counts by keyval",
 	}, []string{"name", "value"})
-	prometheus.MustRegister(keyValCounter)
+
+	for _, collector := range []prometheus.Collector{
+		m.apiDurationHistogram,
+		m.apiInFlightGauge,
+		m.apiRequestSizeHistogram,
+		m.apiResponseSizeHistogram,
+		m.grpcDurationHistogram,
+		m.eventLoopDurationHistogram,
+		m.eventLoopWaitHistogram,
+		m.eventLoopQueueDepthGauge,
+		m.eventLoopShedCounter,
+		m.eventLoopExpiredCounter,
+		m.streamConnectionsGauge,
+		m.streamEventCounter,
+		m.dbEventCounter,
+		m.dbListenerConnectionEventCounter,
+		m.dbErrorCounter,
+		m.dbQueryDurationHistogram,
+		m.webhookDeliveryDurationHistogram,
+		m.webhookLagHistogram,
+		m.clientStreamConnectionsGauge,
+		m.clientStreamLatencyHistogram,
+		m.clientApiRequestDurationHistogram,
+		m.cacheRequestCounter,
+		m.cacheRemovalCounter,
+		m.cacheEntriesGauge,
+		m.keyValCounter,
+	} {
+		if err := m.register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) register(collector prometheus.Collector) error {
+	if m.registerer == nil {
+		return nil
+	}
+	return errors.Wrapf(m.registerer.Register(collector), "unable to register metric")
 }
@@ -0,0 +1,60 @@
+package telemetry
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// histogramSum finds the sum of the observations of the named histogram, across its labels
+func histogramSum(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %+v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		sum := 0.0
+		for _, metric := range family.GetMetric() {
+			sum += metric.GetHistogram().GetSampleSum()
+		}
+		return sum
+	}
+	t.Fatalf("no histogram named %s", name)
+	return 0
+}
+
+func TestDurationsAreRecordedInSeconds(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics, err := NewMetrics("test", registry)
+	if err != nil {
+		t.Fatalf("unable to create metrics: %+v", err)
+	}
+	start := time.Now().Add(-1500 * time.Millisecond)
+	metrics.RecordGRPCDuration("method", "OK", start)
+	metrics.RecordEventLoopDuration("action", nil, start)
+	metrics.RecordEventLoopWait("action", start)
+	metrics.RecordWebhookDelivery("webhook", "delivered", start)
+	metrics.RecordWebhookLag("webhook", start)
+	metrics.RecordClientStreamLatency(start)
+	metrics.RecordAPIRequest("/test", "GET", 200, 1500*time.Millisecond, 0, 0)
+
+	for _, name := range []string{
+		"test_api_grpc_duration_seconds",
+		"test_api_event_loop_duration_seconds",
+		"test_api_event_loop_wait_seconds",
+		"test_webhook_delivery_duration_seconds",
+		"test_webhook_lag_seconds",
+		"test_client_stream_latency_seconds",
+		"test_api_request_duration_seconds",
+	} {
+		// allow for the time taken to record them
+		if sum := histogramSum(t, registry, name); math.Abs(sum-1.5) > 0.5 {
+			t.Errorf("expected %s to have recorded about 1.5 seconds, got %f", name, sum)
+		}
+	}
+}
@@ -13,50 +13,84 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
-func Setup(ctx context.Context, logLevel string, serviceName string, prometheusPort int, jaegerURL string) (trace.TracerProvider, error, func()) {
+// Setup configures logging, tracing, and metrics registered globally and exported on
+// prometheusPort, from admin
+func Setup(ctx context.Context, logLevel string, logFormat string, serviceName string, prometheusPort int, admin *http.ServeMux, tracing *TracingConfig) (*Metrics, trace.TracerProvider, error, func()) {
 	cleanup := func() {
-		logrus.Infof("noop tracing cleanup")
+		logrus.Infof("noop cleanup")
 	}
 
 	// logs
-	logrus.Infof("setting up logging for level %s", logLevel)
-	err := SetUpLogger(logLevel)
+	logrus.Infof("setting up %s logging for level %s", logFormat, logLevel)
+	err := SetUpLogger(logLevel, logFormat)
 	if err != nil {
-		return nil, err, cleanup
+		return nil, nil, err, cleanup
 	}
 
 	// metrics
 	logrus.Infof("setting up metrics for namespace %s", serviceName)
-	CreateMetrics(serviceName) // TODO is this really what we want/
-	SetupPrometheus(prometheusPort)
+	metrics, err := NewMetrics(serviceName, prometheus.DefaultRegisterer)
+	if err != nil {
+		return nil, nil, err, cleanup
+	}
+	if err := RegisterRuntimeMetrics(); err != nil {
+		return nil, nil, err, cleanup
+	}
+	prometheusServer := SetupPrometheus(prometheusPort, admin)
+	cleanup = func() {
+		shutdownPrometheus(ctx, prometheusServer)
+	}
 
 	// traces
-	logrus.Infof("setting up tracing for jaeger url %s", jaegerURL)
 	var tp trace.TracerProvider
-	if jaegerURL == "" {
+	if tracing.ExporterOrDefault() == TraceExporterNone {
 		tp = SetUpNoopTracerProvider()
 	} else {
-		jtp, err := SetUpJaegerTracerProvider(jaegerURL, serviceName)
+		sdkTP, err := SetUpTracerProvider(ctx, tracing, serviceName)
 		if err != nil {
-			return nil, err, cleanup
+			return nil, nil, err, cleanup
+		}
+		tp = sdkTP
+
+		cleanup = func() {
+			logrus.Infof("tracing cleanup")
+			timedContext, timedCancel := context.WithTimeout(ctx, time.Second*5)
+			defer timedCancel()
+			// flushes spans which haven't been exported yet
+			_ = sdkTP.Shutdown(timedContext)
+			shutdownPrometheus(ctx, prometheusServer)
 		}
-		tp = jtp
+	}
 
+	metrics.SetTracerProvider(tp)
+
+	// metrics, pushed as well as scraped
+	if tracing.ExportMetrics {
+		exporter, err := StartMetricsExporter(ctx, tracing, serviceName, prometheus.DefaultGatherer)
+		if err != nil {
+			return nil, nil, err, cleanup
+		}
+		tracingCleanup := cleanup
 		cleanup = func() {
-			logrus.Infof("jaeger tracing cleanup")
+			logrus.Infof("metrics exporter cleanup")
 			timedContext, timedCancel := context.WithTimeout(ctx, time.Second*5)
 			defer timedCancel()
-			_ = jtp.Shutdown(timedContext)
+			if err := exporter.Shutdown(timedContext); err != nil {
+				logrus.Errorf("%+v", err)
+			}
+			tracingCleanup()
 		}
 	}
 
-	return tp, nil, cleanup
+	return metrics, tp, nil, cleanup
 }
 
-func SetupPrometheus(port int) {
+// SetupPrometheus serves metrics on port, along with pprof and profile captures, from
+// serveMux.  The port is for operators rather than clients, so callers may add their own
+// admin handlers to serveMux, even once it's serving.
+func SetupPrometheus(port int, serveMux *http.ServeMux) *http.Server {
 	addr := fmt.Sprintf(":%d", port)
 
-	serveMux := http.NewServeMux()
 	serveMux.Handle("/metrics", promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
 		promhttp.HandlerOpts{
@@ -65,7 +99,20 @@ func SetupPrometheus(port int) {
 			Timeout: 10 * time.Second,
 		},
 	))
+	registerDiagnostics(serveMux)
+	server := &http.Server{Addr: addr, Handler: serveMux}
 	go func() {
-		utils.Die(http.ListenAndServe(addr, serveMux))
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			utils.Die(err)
+		}
 	}()
+	return server
+}
+
+func shutdownPrometheus(ctx context.Context, server *http.Server) {
+	logrus.Infof("prometheus server cleanup")
+	timedContext, timedCancel := context.WithTimeout(ctx, time.Second*5)
+	defer timedCancel()
+	_ = server.Shutdown(timedContext)
 }
@@ -0,0 +1,280 @@
+package telemetry
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	SLOKindAvailability = "availability"
+	SLOKindLatency      = "latency"
+
+	// sloBucketWidth is the resolution of SLO windows
+	sloBucketWidth = 10 * time.Second
+)
+
+// SLOConfig is an objective for the requests to one route.  An availability SLO counts
+// 5xx responses as bad; a latency SLO counts responses slower than LatencyMilliseconds as bad.
+type SLOConfig struct {
+	// Name defaults to the route and kind, such as `/v1/users/{userid} latency`
+	Name string
+	// Route is a route template, as used to label API metrics
+	Route string
+	// Objective is the fraction of requests which should be good, such as 0.999
+	Objective float64
+	// LatencyMilliseconds makes this a latency SLO; otherwise, it's an availability SLO
+	LatencyMilliseconds int
+	// BudgetWindowMinutes is the rolling window the error budget covers; the default is 60
+	BudgetWindowMinutes int
+	// BurnRateWindowsMinutes are the windows burn rates are computed over; the default is
+	// 5, 30 and 60.  Windows longer than the budget window are dropped.
+	BurnRateWindowsMinutes []int
+}
+
+func (c *SLOConfig) Kind() string {
+	if c.LatencyMilliseconds > 0 {
+		return SLOKindLatency
+	}
+	return SLOKindAvailability
+}
+
+func (c *SLOConfig) NameOrDefault() string {
+	if c.Name == "" {
+		return fmt.Sprintf("%s %s", c.Route, c.Kind())
+	}
+	return c.Name
+}
+
+func (c *SLOConfig) BudgetWindow() time.Duration {
+	if c.BudgetWindowMinutes <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.BudgetWindowMinutes) * time.Minute
+}
+
+func (c *SLOConfig) BurnRateWindows() []time.Duration {
+	minutes := c.BurnRateWindowsMinutes
+	if len(minutes) == 0 {
+		minutes = []int{5, 30, 60}
+	}
+	var windows []time.Duration
+	for _, m := range minutes {
+		if window := time.Duration(m) * time.Minute; m > 0 && window <= c.BudgetWindow() {
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
+
+func (c *SLOConfig) Validate() error {
+	if c.Route == "" {
+		return errors.Errorf("SLO %s has no route", c.NameOrDefault())
+	}
+	if c.Objective <= 0 || c.Objective >= 1 {
+		return errors.Errorf("SLO %s objective %f must be between 0 and 1", c.NameOrDefault(), c.Objective)
+	}
+	return nil
+}
+
+// SLOStatus is an SLO's standing over its budget window.  BudgetConsumed is the fraction
+// of the allowed bad requests which have been used up: over 1 means the SLO is missed.
+// A burn rate of 1 uses up the budget exactly by the end of the window.
+type SLOStatus struct {
+	Name                string
+	Route               string
+	Kind                string
+	Objective           float64
+	LatencyMilliseconds int `json:",omitempty"`
+	BudgetWindowMinutes float64
+	Requests            int64
+	BadRequests         int64
+	BudgetConsumed      float64
+	// BurnRates are by window, such as `5m` or `1h`
+	BurnRates map[string]float64
+}
+
+// SLOTracker computes SLO standings from the API requests recorded by a Metrics
+type SLOTracker struct {
+	slos    []*sloWindow
+	byRoute map[string][]*sloWindow
+
+	objectiveDesc      *prometheus.Desc
+	budgetConsumedDesc *prometheus.Desc
+	burnRateDesc       *prometheus.Desc
+}
+
+func NewSLOTracker(namespace string, configs []SLOConfig) (*SLOTracker, error) {
+	labels := []string{"slo", "route", "kind"}
+	t := &SLOTracker{
+		byRoute: map[string][]*sloWindow{},
+		objectiveDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "slo", "objective_ratio"),
+			"fraction of requests which should be good", labels, nil),
+		budgetConsumedDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "slo", "error_budget_consumed_ratio"),
+			"fraction of the error budget used up over the budget window", labels, nil),
+		burnRateDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "slo", "burn_rate"),
+			"rate the error budget is being used up, relative to using it up exactly over the budget window", append(labels, "window"), nil),
+	}
+	names := map[string]bool{}
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+		if names[config.NameOrDefault()] {
+			return nil, errors.Errorf("duplicate SLO name: %s", config.NameOrDefault())
+		}
+		names[config.NameOrDefault()] = true
+		slo := newSLOWindow(config)
+		t.slos = append(t.slos, slo)
+		t.byRoute[config.Route] = append(t.byRoute[config.Route], slo)
+	}
+	return t, nil
+}
+
+// Observe counts a request against the SLOs of its route
+func (t *SLOTracker) Observe(route string, code int, duration time.Duration) {
+	now := time.Now()
+	for _, slo := range t.byRoute[route] {
+		slo.observe(now, slo.isBad(code, duration))
+	}
+}
+
+// Statuses reports every SLO, in the order they were configured
+func (t *SLOTracker) Statuses() []*SLOStatus {
+	now := time.Now()
+	statuses := make([]*SLOStatus, len(t.slos))
+	for i, slo := range t.slos {
+		statuses[i] = slo.status(now)
+	}
+	return statuses
+}
+
+func (t *SLOTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.objectiveDesc
+	ch <- t.budgetConsumedDesc
+	ch <- t.burnRateDesc
+}
+
+// Collect computes the SLO metrics at scrape time, from the same windows as Statuses
+func (t *SLOTracker) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range t.Statuses() {
+		labels := []string{status.Name, status.Route, status.Kind}
+		ch <- prometheus.MustNewConstMetric(t.objectiveDesc, prometheus.GaugeValue, status.Objective, labels...)
+		ch <- prometheus.MustNewConstMetric(t.budgetConsumedDesc, prometheus.GaugeValue, status.BudgetConsumed, labels...)
+		windows := make([]string, 0, len(status.BurnRates))
+		for window := range status.BurnRates {
+			windows = append(windows, window)
+		}
+		sort.Strings(windows)
+		for _, window := range windows {
+			ch <- prometheus.MustNewConstMetric(t.burnRateDesc, prometheus.GaugeValue, status.BurnRates[window], append(labels, window)...)
+		}
+	}
+}
+
+type sloCounts struct {
+	total int64
+	bad   int64
+}
+
+// sloWindow counts requests in a ring of fixed-width buckets covering the budget window.
+// Each bucket remembers which interval it holds, so that stale buckets are skipped, and
+// reset when they're reused.
+type sloWindow struct {
+	config SLOConfig
+
+	mu        sync.Mutex
+	buckets   []sloCounts
+	intervals []int64
+}
+
+func newSLOWindow(config SLOConfig) *sloWindow {
+	size := int(config.BudgetWindow() / sloBucketWidth)
+	return &sloWindow{
+		config:    config,
+		buckets:   make([]sloCounts, size),
+		intervals: make([]int64, size),
+	}
+}
+
+func (w *sloWindow) isBad(code int, duration time.Duration) bool {
+	if w.config.Kind() == SLOKindLatency {
+		return duration > time.Duration(w.config.LatencyMilliseconds)*time.Millisecond
+	}
+	return code >= 500
+}
+
+func (w *sloWindow) observe(now time.Time, bad bool) {
+	interval := now.UnixNano() / int64(sloBucketWidth)
+	slot := int(interval % int64(len(w.buckets)))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.intervals[slot] != interval {
+		w.intervals[slot] = interval
+		w.buckets[slot] = sloCounts{}
+	}
+	w.buckets[slot].total++
+	if bad {
+		w.buckets[slot].bad++
+	}
+}
+
+// sum totals the buckets covering the last `window`, including the current partial one
+func (w *sloWindow) sum(now time.Time, window time.Duration) sloCounts {
+	current := now.UnixNano() / int64(sloBucketWidth)
+	count := int(window / sloBucketWidth)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := sloCounts{}
+	for i := 0; i < count && i < len(w.buckets); i++ {
+		interval := current - int64(i)
+		slot := int(interval % int64(len(w.buckets)))
+		if w.intervals[slot] == interval {
+			out.total += w.buckets[slot].total
+			out.bad += w.buckets[slot].bad
+		}
+	}
+	return out
+}
+
+// burnRate is the fraction of bad requests, relative to the fraction allowed
+func (w *sloWindow) burnRate(counts sloCounts) float64 {
+	if counts.total == 0 {
+		return 0
+	}
+	return (float64(counts.bad) / float64(counts.total)) / (1 - w.config.Objective)
+}
+
+func (w *sloWindow) status(now time.Time) *SLOStatus {
+	budgetCounts := w.sum(now, w.config.BudgetWindow())
+	status := &SLOStatus{
+		Name:                w.config.NameOrDefault(),
+		Route:               w.config.Route,
+		Kind:                w.config.Kind(),
+		Objective:           w.config.Objective,
+		LatencyMilliseconds: w.config.LatencyMilliseconds,
+		BudgetWindowMinutes: w.config.BudgetWindow().Minutes(),
+		Requests:            budgetCounts.total,
+		BadRequests:         budgetCounts.bad,
+		// over the whole budget window, consumption and burn rate are the same thing
+		BudgetConsumed: w.burnRate(budgetCounts),
+		BurnRates:      map[string]float64{},
+	}
+	for _, window := range w.config.BurnRateWindows() {
+		status.BurnRates[formatWindow(window)] = w.burnRate(w.sum(now, window))
+	}
+	return status
+}
+
+func formatWindow(window time.Duration) string {
+	if window%time.Hour == 0 {
+		return fmt.Sprintf("%dh", window/time.Hour)
+	}
+	return fmt.Sprintf("%dm", window/time.Minute)
+}
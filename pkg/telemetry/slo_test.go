@@ -0,0 +1,84 @@
+package telemetry
+
+import (
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func observeMany(w *sloWindow, at time.Time, total int, bad int) {
+	for i := 0; i < total; i++ {
+		w.observe(at, i < bad)
+	}
+}
+
+func TestSLOBurnRates(t *testing.T) {
+	w := newSLOWindow(SLOConfig{Route: "/test", Objective: 0.99})
+	now := time.Now()
+	// stale: the ring has wrapped around twice since, onto the current bucket's slot
+	observeMany(w, now.Add(-2*time.Hour), 100, 100)
+	observeMany(w, now.Add(-40*time.Minute), 100, 10)
+	observeMany(w, now.Add(-time.Minute), 100, 1)
+
+	status := w.status(now)
+	if status.Requests != 200 || status.BadRequests != 11 {
+		t.Fatalf("expected 11 bad of 200 requests in the budget window, got %d of %d", status.BadRequests, status.Requests)
+	}
+	// 5.5% bad, against 1% allowed
+	expected := map[string]float64{"5m": 1, "30m": 1, "1h": 5.5}
+	for window, rate := range expected {
+		if math.Abs(status.BurnRates[window]-rate) > 1e-9 {
+			t.Errorf("expected a %s burn rate of %f, got %f", window, rate, status.BurnRates[window])
+		}
+	}
+	if len(status.BurnRates) != len(expected) || math.Abs(status.BudgetConsumed-5.5) > 1e-9 {
+		t.Errorf("expected burn rates %+v and 5.5 of the budget consumed, got %+v and %f", expected, status.BurnRates, status.BudgetConsumed)
+	}
+
+	empty := newSLOWindow(SLOConfig{Route: "/test", Objective: 0.99}).status(now)
+	if empty.BudgetConsumed != 0 || empty.BurnRates["5m"] != 0 {
+		t.Errorf("expected no requests to burn nothing, got %+v", empty)
+	}
+}
+
+func TestSLOTrackerObserve(t *testing.T) {
+	tracker, err := NewSLOTracker("test", []SLOConfig{
+		{Route: "/a", Objective: 0.9},
+		{Route: "/a", Objective: 0.9, LatencyMilliseconds: 100},
+	})
+	if err != nil {
+		t.Fatalf("unable to create tracker: %+v", err)
+	}
+	tracker.Observe("/a", http.StatusInternalServerError, time.Millisecond)
+	tracker.Observe("/a", http.StatusOK, time.Second)
+	tracker.Observe("/a", http.StatusNotFound, time.Millisecond)
+	tracker.Observe("/b", http.StatusInternalServerError, time.Second)
+
+	statuses := tracker.Statuses()
+	if statuses[0].Name != "/a availability" || statuses[0].Requests != 3 || statuses[0].BadRequests != 1 {
+		t.Errorf("expected 1 of 3 requests to count against availability, got %+v", statuses[0])
+	}
+	if statuses[1].Name != "/a latency" || statuses[1].Requests != 3 || statuses[1].BadRequests != 1 {
+		t.Errorf("expected 1 of 3 requests to count against latency, got %+v", statuses[1])
+	}
+}
+
+func TestSLOConfig(t *testing.T) {
+	config := &SLOConfig{Route: "/a", Objective: 0.99, BudgetWindowMinutes: 30, BurnRateWindowsMinutes: []int{5, 0, 30, 60}}
+	if windows := config.BurnRateWindows(); !reflect.DeepEqual(windows, []time.Duration{5 * time.Minute, 30 * time.Minute}) {
+		t.Errorf("expected windows longer than the budget window to be dropped, got %+v", windows)
+	}
+	for _, invalid := range []SLOConfig{{Objective: 0.99}, {Route: "/a", Objective: 1}, {Route: "/a"}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", invalid)
+		}
+	}
+	if _, err := NewSLOTracker("test", []SLOConfig{{Route: "/a", Objective: 0.9}, {Route: "/a", Objective: 0.99}}); err == nil {
+		t.Errorf("expected duplicate names to be rejected")
+	}
+	if formatWindow(90*time.Minute) != "90m" || formatWindow(2*time.Hour) != "2h" {
+		t.Errorf("unexpected window names: %s and %s", formatWindow(90*time.Minute), formatWindow(2*time.Hour))
+	}
+}
@@ -1,10 +1,20 @@
 package telemetry
 
 import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/utils"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
@@ -12,20 +22,163 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
-func SetUpJaegerTracerProvider(aggregatorURL string, service string) (*tracesdk.TracerProvider, error) {
-	logrus.Infof("setting up jaeger tracer provider at %s for service %s", aggregatorURL, service)
+const (
+	TraceExporterNone     = "none"
+	TraceExporterJaeger   = "jaeger"
+	TraceExporterOTLPGRPC = "otlp-grpc"
+	TraceExporterOTLPHTTP = "otlp-http"
+
+	SamplerAlways      = "always"
+	SamplerNever       = "never"
+	SamplerRatio       = "ratio"
+	SamplerParentRatio = "parent-ratio"
+	SamplerRateLimited = "rate-limited"
+)
+
+type TracingConfig struct {
+	// Exporter is one of none, jaeger, otlp-grpc or otlp-http; the default is none
+	Exporter string
+	// Endpoint is the collector url for jaeger, or host:port for otlp.  If it's empty, otlp
+	// uses OTEL_EXPORTER_OTLP_ENDPOINT, or else localhost.
+	Endpoint string
+	// Insecure turns off TLS for otlp
+	Insecure bool
+	// Headers are sent with every otlp export, for example for authentication
+	Headers map[string]string
+
+	// Sampler is one of always, never, ratio, parent-ratio or rate-limited; the default is
+	// always.  parent-ratio and rate-limited follow the parent's decision when there is one,
+	// so that traces aren't broken up across services.
+	Sampler string
+	// SampleRatio is the fraction of traces, greater than 0 and at most 1, that ratio and
+	// parent-ratio sample; use the never sampler to sample none
+	SampleRatio      float64
+	SamplesPerSecond float64
+
+	// ResourceAttributes are added to those describing the process: service name, version,
+	// git SHA, host and pod name
+	ResourceAttributes map[string]string
 
-	exporter, err := jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(aggregatorURL)))
+	// ExportMetrics also pushes the metrics served on /metrics to the otlp endpoint, every
+	// MetricsIntervalSeconds; the default is 30.  It requires an otlp Exporter.
+	ExportMetrics          bool
+	MetricsIntervalSeconds int
+}
+
+func (c *TracingConfig) ExporterOrDefault() string {
+	if c.Exporter == "" {
+		return TraceExporterNone
+	}
+	return c.Exporter
+}
+
+func (c *TracingConfig) SamplerOrDefault() string {
+	if c.Sampler == "" {
+		return SamplerAlways
+	}
+	return c.Sampler
+}
+
+func (c *TracingConfig) sampler() (tracesdk.Sampler, error) {
+	switch c.SamplerOrDefault() {
+	case SamplerAlways:
+		return tracesdk.AlwaysSample(), nil
+	case SamplerNever:
+		return tracesdk.NeverSample(), nil
+	case SamplerRatio, SamplerParentRatio:
+		if c.SampleRatio <= 0 || c.SampleRatio > 1 {
+			return nil, errors.Errorf("%s sampler requires 0 < SampleRatio <= 1, got %f", c.Sampler, c.SampleRatio)
+		}
+		if c.Sampler == SamplerRatio {
+			return tracesdk.TraceIDRatioBased(c.SampleRatio), nil
+		}
+		return tracesdk.ParentBased(tracesdk.TraceIDRatioBased(c.SampleRatio)), nil
+	case SamplerRateLimited:
+		if c.SamplesPerSecond <= 0 {
+			return nil, errors.Errorf("rate-limited sampler requires SamplesPerSecond > 0")
+		}
+		return tracesdk.ParentBased(NewRateLimitedSampler(c.SamplesPerSecond)), nil
+	default:
+		return nil, errors.Errorf("invalid sampler: %s", c.Sampler)
+	}
+}
+
+func (c *TracingConfig) exporter(ctx context.Context) (tracesdk.SpanExporter, error) {
+	switch c.ExporterOrDefault() {
+	case TraceExporterJaeger:
+		exporter, err := jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(c.Endpoint)))
+		return exporter, errors.Wrapf(err, "unable to instantiate jaeger exporter")
+	case TraceExporterOTLPGRPC:
+		var options []otlptracegrpc.Option
+		if c.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			options = append(options, otlptracegrpc.WithHeaders(c.Headers))
+		}
+		exporter, err := otlptracegrpc.New(ctx, options...)
+		return exporter, errors.Wrapf(err, "unable to instantiate otlp grpc exporter")
+	case TraceExporterOTLPHTTP:
+		var options []otlptracehttp.Option
+		if c.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			options = append(options, otlptracehttp.WithHeaders(c.Headers))
+		}
+		exporter, err := otlptracehttp.New(ctx, options...)
+		return exporter, errors.Wrapf(err, "unable to instantiate otlp http exporter")
+	default:
+		return nil, errors.Errorf("invalid trace exporter: %s", c.Exporter)
+	}
+}
+
+func (c *TracingConfig) resource(service string) *resource.Resource {
+	version := utils.VersionInfo()
+	attributes := []attribute.KeyValue{
+		semconv.ServiceNameKey.String(service),
+		semconv.ServiceVersionKey.String(version["Version"]),
+		attribute.String("vcs.revision", version["GitSHA"]),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		attributes = append(attributes, semconv.HostNameKey.String(hostname))
+	}
+	// set from the downward api by the chart
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		attributes = append(attributes, semconv.K8SPodNameKey.String(pod))
+	}
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		attributes = append(attributes, semconv.K8SNamespaceNameKey.String(namespace))
+	}
+	for key, value := range c.ResourceAttributes {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attributes...)
+}
+
+// SetUpTracerProvider sets up, and installs as the global provider, a tracer provider which
+// exports as configured
+func SetUpTracerProvider(ctx context.Context, config *TracingConfig, service string) (*tracesdk.TracerProvider, error) {
+	logrus.Infof("setting up %s tracer provider at '%s' for service %s, sampling %s", config.ExporterOrDefault(), config.Endpoint, service, config.SamplerOrDefault())
+
+	sampler, err := config.sampler()
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to instantiate jaeger tracer provider")
+		return nil, err
+	}
+	exporter, err := config.exporter(ctx)
+	if err != nil {
+		return nil, err
 	}
 	tracerProvider := tracesdk.NewTracerProvider(
-		tracesdk.WithSampler(tracesdk.AlwaysSample()),
+		tracesdk.WithSampler(sampler),
 		tracesdk.WithBatcher(exporter),
-		tracesdk.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String(service),
-		)),
+		tracesdk.WithResource(config.resource(service)),
 	)
 
 	otel.SetTracerProvider(tracerProvider)
@@ -40,3 +193,48 @@ func SetUpNoopTracerProvider() trace.TracerProvider {
 	otel.SetTracerProvider(tracerProvider)
 	return tracerProvider
 }
+
+// rateLimitedSampler samples up to a fixed number of traces per second, using a token bucket
+// which holds up to a second's worth (and at least one), so that bursts are smoothed out
+type rateLimitedSampler struct {
+	perSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimitedSampler(perSecond float64) tracesdk.Sampler {
+	return &rateLimitedSampler{perSecond: perSecond, tokens: perSecond, last: time.Now()}
+}
+
+func (s *rateLimitedSampler) ShouldSample(parameters tracesdk.SamplingParameters) tracesdk.SamplingResult {
+	decision := tracesdk.Drop
+	if s.take() {
+		decision = tracesdk.RecordAndSample
+	}
+	return tracesdk.SamplingResult{
+		Decision:   decision,
+		Tracestate: trace.SpanContextFromContext(parameters.ParentContext).TraceState(),
+	}
+}
+
+func (s *rateLimitedSampler) take() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.tokens += now.Sub(s.last).Seconds() * s.perSecond
+	if capacity := math.Max(s.perSecond, 1); s.tokens > capacity {
+		s.tokens = capacity
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+func (s *rateLimitedSampler) Description() string {
+	return "RateLimitedSampler"
+}
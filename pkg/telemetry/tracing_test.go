@@ -0,0 +1,247 @@
+package telemetry
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is an in-process stand-in for an otel collector, which records what it receives
+// over otlp grpc, and traces over otlp http
+type collector struct {
+	collectortrace.UnimplementedTraceServiceServer
+	collectormetrics.UnimplementedMetricsServiceServer
+
+	mu      sync.Mutex
+	spans   []*tracepb.ResourceSpans
+	metrics []*metricspb.ResourceMetrics
+}
+
+func (c *collector) Export(ctx context.Context, request *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spans = append(c.spans, request.ResourceSpans...)
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+// metricsService adapts collector to the metrics service, whose Export method clashes with
+// the trace service's
+type metricsService struct {
+	*collector
+}
+
+func (m metricsService) Export(ctx context.Context, request *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = append(m.metrics, request.ResourceMetrics...)
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request := &collectortrace.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(body, request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, _ := c.Export(r.Context(), request)
+	out, _ := proto.Marshal(response)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(out)
+}
+
+// startGRPCCollector returns a collector and the host:port it listens on
+func startGRPCCollector(t *testing.T) (*collector, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %+v", err)
+	}
+	c := &collector{}
+	server := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(server, c)
+	collectormetrics.RegisterMetricsServiceServer(server, metricsService{c})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return c, listener.Addr().String()
+}
+
+func startHTTPCollector(t *testing.T) (*collector, string) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	t.Cleanup(server.Close)
+	return c, strings.TrimPrefix(server.URL, "http://")
+}
+
+func (c *collector) receivedSpans() []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []*tracepb.Span
+	for _, resourceSpans := range c.spans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			spans = append(spans, scopeSpans.Spans...)
+		}
+	}
+	return spans
+}
+
+func stringAttributes(attributes []*commonpb.KeyValue) map[string]string {
+	out := map[string]string{}
+	for _, attribute := range attributes {
+		out[attribute.Key] = attribute.Value.GetStringValue()
+	}
+	return out
+}
+
+func TestTracingExportsOverOTLP(t *testing.T) {
+	for name, start := range map[string]func(t *testing.T) (*collector, string){
+		TraceExporterOTLPGRPC: startGRPCCollector,
+		TraceExporterOTLPHTTP: startHTTPCollector,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, endpoint := start(t)
+			config := &TracingConfig{
+				Exporter:           name,
+				Endpoint:           endpoint,
+				Insecure:           true,
+				ResourceAttributes: map[string]string{"deployment.environment": "test"},
+			}
+			tp, err := SetUpTracerProvider(context.Background(), config, "test-service")
+			if err != nil {
+				t.Fatalf("unable to set up tracer provider: %+v", err)
+			}
+			_, span := tp.Tracer("test").Start(context.Background(), "test span")
+			span.End()
+			if err := tp.Shutdown(context.Background()); err != nil {
+				t.Fatalf("unable to flush spans: %+v", err)
+			}
+
+			spans := c.receivedSpans()
+			if len(spans) != 1 || spans[0].Name != "test span" {
+				t.Fatalf("expected to receive test span, got %+v", spans)
+			}
+			attributes := stringAttributes(c.spans[0].Resource.Attributes)
+			if attributes["service.name"] != "test-service" || attributes["deployment.environment"] != "test" {
+				t.Errorf("expected service name and configured resource attributes, got %+v", attributes)
+			}
+		})
+	}
+}
+
+func TestTracingSamplers(t *testing.T) {
+	for _, testCase := range []struct {
+		config   TracingConfig
+		min, max int
+	}{
+		{TracingConfig{Sampler: SamplerAlways}, 10, 10},
+		{TracingConfig{Sampler: SamplerNever}, 0, 0},
+		{TracingConfig{Sampler: SamplerRatio, SampleRatio: 1}, 10, 10},
+		{TracingConfig{Sampler: SamplerParentRatio, SampleRatio: 1}, 10, 10},
+		// the bucket starts with a second's worth
+		{TracingConfig{Sampler: SamplerRateLimited, SamplesPerSecond: 2}, 2, 3},
+	} {
+		t.Run(testCase.config.Sampler, func(t *testing.T) {
+			c, endpoint := startGRPCCollector(t)
+			config := testCase.config
+			config.Exporter, config.Endpoint, config.Insecure = TraceExporterOTLPGRPC, endpoint, true
+			tp, err := SetUpTracerProvider(context.Background(), &config, "test-service")
+			if err != nil {
+				t.Fatalf("unable to set up tracer provider: %+v", err)
+			}
+			for i := 0; i < 10; i++ {
+				_, span := tp.Tracer("test").Start(context.Background(), "test span")
+				span.End()
+			}
+			if err := tp.Shutdown(context.Background()); err != nil {
+				t.Fatalf("unable to flush spans: %+v", err)
+			}
+			if spans := len(c.receivedSpans()); spans < testCase.min || spans > testCase.max {
+				t.Errorf("expected %d to %d spans, got %d", testCase.min, testCase.max, spans)
+			}
+		})
+	}
+}
+
+func TestInvalidSamplers(t *testing.T) {
+	for _, config := range []*TracingConfig{
+		{Sampler: SamplerRatio},
+		{Sampler: SamplerParentRatio, SampleRatio: -1},
+		{Sampler: SamplerRatio, SampleRatio: 2},
+		{Sampler: SamplerRateLimited},
+		{Sampler: "sometimes"},
+	} {
+		if _, err := config.sampler(); err == nil {
+			t.Errorf("expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestMetricsExportOverOTLP(t *testing.T) {
+	c, endpoint := startGRPCCollector(t)
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total", Help: "requests"}, []string{"code"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_duration_seconds", Help: "durations", Buckets: []float64{1, 2}})
+	registry.MustRegister(counter, histogram)
+	counter.WithLabelValues("200").Add(3)
+	for _, duration := range []float64{0.5, 0.5, 1.5, 5} {
+		histogram.Observe(duration)
+	}
+
+	config := &TracingConfig{Exporter: TraceExporterOTLPGRPC, Endpoint: endpoint, Insecure: true, ExportMetrics: true, MetricsIntervalSeconds: 3600}
+	exporter, err := StartMetricsExporter(context.Background(), config, "test-service", registry)
+	if err != nil {
+		t.Fatalf("unable to start metrics exporter: %+v", err)
+	}
+	// shutting down exports the final values
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unable to export metrics: %+v", err)
+	}
+
+	if len(c.metrics) != 1 {
+		t.Fatalf("expected one export, got %d", len(c.metrics))
+	}
+	if name := stringAttributes(c.metrics[0].Resource.Attributes)["service.name"]; name != "test-service" {
+		t.Errorf("expected service name test-service, got %s", name)
+	}
+	received := map[string]*metricspb.Metric{}
+	for _, metric := range c.metrics[0].ScopeMetrics[0].Metrics {
+		received[metric.Name] = metric
+	}
+
+	sum := received["test_requests_total"].GetSum()
+	if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+		t.Fatalf("expected a cumulative monotonic sum, got %+v", received["test_requests_total"])
+	}
+	if point := sum.DataPoints[0]; point.GetAsDouble() != 3 || stringAttributes(point.Attributes)["code"] != "200" {
+		t.Errorf("expected 3 requests with code 200, got %+v", point)
+	}
+
+	histogramData := received["test_duration_seconds"].GetHistogram()
+	if histogramData == nil {
+		t.Fatalf("expected a histogram, got %+v", received["test_duration_seconds"])
+	}
+	point := histogramData.DataPoints[0]
+	if point.Count != 4 || point.GetSum() != 7.5 {
+		t.Errorf("expected 4 observations summing to 7.5, got %+v", point)
+	}
+	if counts := point.BucketCounts; len(counts) != 3 || counts[0] != 2 || counts[1] != 1 || counts[2] != 1 {
+		t.Errorf("expected per-bucket counts [2 1 1], got %+v", counts)
+	}
+}
@@ -0,0 +1,16 @@
+package utils
+
+// these are set at build time via -ldflags "-X github.com/mattfenwick/scaling/pkg/utils.version=..."
+var (
+	version   = "development"
+	gitSHA    = "development"
+	buildTime = "development"
+)
+
+func VersionInfo() map[string]string {
+	return map[string]string{
+		"Version":   version,
+		"GitSHA":    gitSHA,
+		"BuildTime": buildTime,
+	}
+}
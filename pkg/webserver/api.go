@@ -1,6 +1,12 @@
 package webserver
 
-import "github.com/google/uuid"
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+)
 
 // users
 
@@ -15,7 +21,7 @@ type CreateUserResponse struct {
 }
 
 type GetUserRequest struct {
-	UserId uuid.UUID
+	UserId uuid.UUID `path:"userid"`
 }
 
 type GetUserResponse struct {
@@ -34,8 +40,8 @@ type GetUsersResponse struct {
 }
 
 type SearchUsersRequest struct {
-	NamePattern  string
-	EmailPattern string
+	NamePattern  string `query:"name"`
+	EmailPattern string `query:"email"`
 	// TODO other stuff?
 }
 
@@ -45,7 +51,7 @@ type SearchUsersResponse struct {
 }
 
 type GetUserMessagesRequest struct {
-	UserId uuid.UUID
+	UserId uuid.UUID `path:"userid"`
 	// TODO paginate
 }
 
@@ -56,7 +62,7 @@ type GetUserMessagesResponse struct {
 }
 
 type GetUserTimelineRequest struct {
-	UserId uuid.UUID
+	UserId uuid.UUID `path:"userid"`
 	// TODO paginate
 }
 
@@ -79,7 +85,7 @@ type CreateMessageResponse struct {
 }
 
 type GetMessageRequest struct {
-	MessageId uuid.UUID
+	MessageId uuid.UUID `path:"messageid"`
 }
 
 type GetMessageResponse struct {
@@ -98,7 +104,7 @@ type GetMessagesResponse struct {
 }
 
 type SearchMessagesRequest struct {
-	LiteralString string
+	LiteralString string `query:"q"`
 }
 
 type SearchMessagesResponse struct {
@@ -109,7 +115,7 @@ type SearchMessagesResponse struct {
 // follow/upvote
 
 type FollowRequest struct {
-	FolloweeUserId uuid.UUID
+	FolloweeUserId uuid.UUID `path:"userid"`
 	FollowerUserId uuid.UUID
 }
 
@@ -119,16 +125,18 @@ type FollowResponse struct {
 
 type CreateUpvoteRequest struct {
 	UserId    uuid.UUID
-	MessageId uuid.UUID
+	MessageId uuid.UUID `path:"messageid"`
 }
 
+// CreateUpvoteResponse has the id of the upvote: a user upvotes a message at most once, so
+// upvoting again gets the id of the first upvote, and doesn't change the count
 type CreateUpvoteResponse struct {
 	UpvoteId uuid.UUID
 	Request  *CreateUpvoteRequest
 }
 
 type GetFollowersOfUserRequest struct {
-	UserId uuid.UUID
+	UserId uuid.UUID `path:"userid"`
 	// TODO paginate
 }
 
@@ -136,3 +144,67 @@ type GetFollowersOfUserResponse struct {
 	Followers []GetUserResponse
 	Request   *GetFollowersOfUserRequest
 }
+
+// health
+
+type HealthCheckResult struct {
+	Name                string
+	Healthy             bool
+	Error               string `json:",omitempty"`
+	LatencyMilliseconds float64
+	CheckedAt           time.Time
+}
+
+type HealthResponse struct {
+	Live        bool
+	Ready       bool
+	ManualReady bool
+	Checks      []*HealthCheckResult
+}
+
+type SetReadinessRequest struct {
+	Ready bool
+}
+
+type SetReadinessResponse struct {
+	Request *SetReadinessRequest
+}
+
+// diagnostics
+
+type ActionTiming struct {
+	Name                 string
+	Start                time.Time
+	DurationMilliseconds float64
+	Error                string `json:",omitempty"`
+}
+
+type EventLoopDump struct {
+	QueueDepth    int
+	QueueCapacity int
+	Workers       int
+	RecentActions []*ActionTiming
+}
+
+// TimelineEvent is pushed to timeline streams when a message is created
+type TimelineEvent struct {
+	MessageId    uuid.UUID
+	SenderUserId uuid.UUID
+	Content      string
+	CreatedAt    time.Time
+}
+
+type DumpResponse struct {
+	Version       map[string]string
+	Config        any
+	StartedAt     time.Time
+	UptimeSeconds float64
+	Goroutines    int
+	DBStats       sql.DBStats
+	TableSizes    map[string]int
+	EventLoop     *EventLoopDump
+	Streams       int
+	// Webhooks counts deliveries by webhook, then by status
+	Webhooks map[string]map[string]int
+	SLOs     []*telemetry.SLOStatus
+}
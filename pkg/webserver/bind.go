@@ -0,0 +1,121 @@
+package webserver
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+
+	"github.com/mattfenwick/collections/pkg/json"
+	"github.com/pkg/errors"
+)
+
+// Request fields are bound from the json body, and then from url parameters:
+//   - `path:"name"` fields come from the `{name}` segment of the route's path template
+//   - `query:"name"` fields come from the `name` query parameter
+const (
+	pathTag  = "path"
+	queryTag = "query"
+)
+
+// handle adapts a Responder method to a Route handler
+func handle[Req, Resp any](f func(context.Context, *Req) (*Resp, error)) func(ctx context.Context, body string, values url.Values) (any, error) {
+	return func(ctx context.Context, body string, values url.Values) (any, error) {
+		req, err := bindRequest[Req](body, values)
+		if err != nil {
+			return nil, WithStatus(http.StatusBadRequest, err)
+		}
+		return f(ctx, req)
+	}
+}
+
+// handleStream adapts a Responder's Stream method to a Route's Stream
+func handleStream[Req, Item any](f func(context.Context, *Req, func(*Item) error) error) StreamFunc {
+	return func(ctx context.Context, body string, values url.Values, onItem func(any) error) error {
+		req, err := bindRequest[Req](body, values)
+		if err != nil {
+			return WithStatus(http.StatusBadRequest, err)
+		}
+		return f(ctx, req, func(item *Item) error {
+			return onItem(item)
+		})
+	}
+}
+
+func bindRequest[A any](body string, values url.Values) (*A, error) {
+	req := new(A)
+	if body != "" {
+		parsed, err := json.ParseString[A](body)
+		if err != nil {
+			return nil, err
+		}
+		req = parsed
+	}
+
+	v := reflect.ValueOf(req).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, ok := paramName(field)
+		if !ok || !values.Has(name) {
+			continue
+		}
+		if err := setField(v.Field(i), values.Get(name)); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse parameter %s from '%s'", name, values.Get(name))
+		}
+	}
+	return req, nil
+}
+
+func paramName(field reflect.StructField) (string, bool) {
+	if name, ok := field.Tag.Lookup(pathTag); ok {
+		return name, true
+	}
+	return field.Tag.Lookup(queryTag)
+}
+
+func setField(field reflect.Value, raw string) error {
+	if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(raw))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return errors.Errorf("unsupported parameter type %s", field.Type())
+	}
+	return nil
+}
+
+// requestParams is the inverse of bindRequest: it pulls the path and query parameters out of a request
+func requestParams(request any) (map[string]string, map[string]string) {
+	pathParams, queryParams := map[string]string{}, map[string]string{}
+	v := reflect.Indirect(reflect.ValueOf(request))
+	if v.Kind() != reflect.Struct {
+		return pathParams, queryParams
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := fmt.Sprintf("%v", v.Field(i).Interface())
+		if name, ok := field.Tag.Lookup(pathTag); ok {
+			pathParams[name] = value
+		} else if name, ok := field.Tag.Lookup(queryTag); ok && value != "" {
+			queryParams[name] = value
+		}
+	}
+	return pathParams, queryParams
+}
@@ -0,0 +1,235 @@
+package webserver
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+)
+
+type CacheConfig struct {
+	// Enabled caches users, messages, timelines and follower lists in process
+	Enabled bool
+	// Size is how many entries each cache holds; the default is 10000
+	Size int
+	// TTLSeconds bounds how long an entry is used for; the default is 60.  Writes invalidate
+	// entries as soon as this replica hears of them, so this only matters if it doesn't.
+	TTLSeconds int
+}
+
+func (c *CacheConfig) SizeOrDefault() int {
+	if c.Size <= 0 {
+		return 10000
+	}
+	return c.Size
+}
+
+func (c *CacheConfig) TTL() time.Duration {
+	if c.TTLSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.TTLSeconds) * time.Second
+}
+
+// Cache is an LRU cache whose entries also expire.  Concurrent misses for a key share a
+// single load, so that a popular key going missing doesn't send a burst of queries to
+// postgres.  A nil *Cache caches nothing, so callers don't have to check whether caching
+// is enabled.
+//
+// Entries may be tagged with the keys of other things they depend on, such as the senders
+// of a timeline's messages, so that they can be invalidated when those change.
+type Cache[K comparable, V any] struct {
+	name    string
+	size    int
+	ttl     time.Duration
+	metrics *telemetry.Metrics
+
+	mu      sync.Mutex
+	entries map[K]*list.Element
+	lru     *list.List
+	tagged  map[K]map[K]bool
+	loads   map[K]*cacheLoad[K, V]
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	tags      []K
+	expiresAt time.Time
+}
+
+// cacheLoad is a load in progress.  Invalidations which happen while it runs are recorded
+// on it, so that it isn't stored if it may already be stale; loads of other keys aren't
+// affected.  Its fields, other than done, are guarded by the cache's mu.
+type cacheLoad[K comparable, V any] struct {
+	done  chan struct{}
+	value V
+	tags  []K
+	err   error
+
+	invalidated bool
+	// invalidatedTags are in the order they were invalidated in, so that callers which
+	// joined the load can tell which invalidations happened before they did
+	invalidatedTags []K
+}
+
+// isStale is true if the load's key was invalidated, or any of its tags are among the first
+// tagInvalidations tags invalidated while it ran.  It must be called with mu held, once the
+// load is done.
+func (l *cacheLoad[K, V]) isStale(tagInvalidations int) bool {
+	if l.invalidated {
+		return true
+	}
+	for _, invalidated := range l.invalidatedTags[:tagInvalidations] {
+		for _, tag := range l.tags {
+			if tag == invalidated {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func NewCache[K comparable, V any](name string, config *CacheConfig, metrics *telemetry.Metrics) *Cache[K, V] {
+	if !config.Enabled {
+		return nil
+	}
+	return &Cache[K, V]{
+		name:    name,
+		size:    config.SizeOrDefault(),
+		ttl:     config.TTL(),
+		metrics: metrics,
+		entries: map[K]*list.Element{},
+		lru:     list.New(),
+		tagged:  map[K]map[K]bool{},
+		loads:   map[K]*cacheLoad[K, V]{},
+	}
+}
+
+// Get returns the cached value of key, or else loads it.  Callers sharing a load get its
+// result even if it fails because the ctx of the caller which started it was cancelled.
+// If one of the load's tags was invalidated before a caller joined it, that caller loads
+// again instead, since the load may predate the write.  Errors aren't cached.
+func (c *Cache[K, V]) Get(ctx context.Context, key K, load func(ctx context.Context) (V, []K, error)) (V, error) {
+	if c == nil {
+		value, _, err := load(ctx)
+		return value, err
+	}
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry[K, V])
+		if time.Now().Before(entry.expiresAt) {
+			c.lru.MoveToFront(element)
+			c.mu.Unlock()
+			c.metrics.RecordCacheRequest(c.name, "hit")
+			return entry.value, nil
+		}
+		c.remove(element, "expired")
+	}
+	if pending, ok := c.loads[key]; ok {
+		joined := len(pending.invalidatedTags)
+		c.mu.Unlock()
+		c.metrics.RecordCacheRequest(c.name, "shared")
+		select {
+		case <-pending.done:
+		case <-ctx.Done():
+			var zero V
+			return zero, ctx.Err()
+		}
+		c.mu.Lock()
+		stale := pending.err == nil && pending.isStale(joined)
+		c.mu.Unlock()
+		if stale {
+			return c.Get(ctx, key, load)
+		}
+		return pending.value, pending.err
+	}
+	pending := &cacheLoad[K, V]{done: make(chan struct{})}
+	c.loads[key] = pending
+	c.mu.Unlock()
+	c.metrics.RecordCacheRequest(c.name, "miss")
+
+	value, tags, err := load(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending.value, pending.tags, pending.err = value, tags, err
+	close(pending.done)
+	if c.loads[key] == pending {
+		delete(c.loads, key)
+	}
+	if err == nil && !pending.isStale(len(pending.invalidatedTags)) {
+		c.store(key, value, tags)
+	}
+	return value, err
+}
+
+// Invalidate drops key, and stops a load of it in progress from being stored
+func (c *Cache[K, V]) Invalidate(key K) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pending, ok := c.loads[key]; ok {
+		pending.invalidated = true
+		// later callers start a fresh load, rather than sharing one which may be stale
+		delete(c.loads, key)
+	}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element, "invalidated")
+	}
+}
+
+// InvalidateTagged drops every entry tagged with tag, and stops loads in progress which
+// turn out to be tagged with it from being stored
+func (c *Cache[K, V]) InvalidateTagged(tag K) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a load's tags aren't known until it's done, so they're checked then
+	for _, pending := range c.loads {
+		pending.invalidatedTags = append(pending.invalidatedTags, tag)
+	}
+	for key := range c.tagged[tag] {
+		c.remove(c.entries[key], "invalidated")
+	}
+}
+
+// store must be called with mu held
+func (c *Cache[K, V]) store(key K, value V, tags []K) {
+	if element, ok := c.entries[key]; ok {
+		c.remove(element, "replaced")
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry[K, V]{key: key, value: value, tags: tags, expiresAt: time.Now().Add(c.ttl)})
+	for _, tag := range tags {
+		if c.tagged[tag] == nil {
+			c.tagged[tag] = map[K]bool{}
+		}
+		c.tagged[tag][key] = true
+	}
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back(), "evicted")
+	}
+	c.metrics.SetCacheEntries(c.name, c.lru.Len())
+}
+
+// remove must be called with mu held
+func (c *Cache[K, V]) remove(element *list.Element, reason string) {
+	entry := element.Value.(*cacheEntry[K, V])
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	for _, tag := range entry.tags {
+		delete(c.tagged[tag], entry.key)
+		if len(c.tagged[tag]) == 0 {
+			delete(c.tagged, tag)
+		}
+	}
+	c.metrics.RecordCacheRemoval(c.name, reason)
+	c.metrics.SetCacheEntries(c.name, c.lru.Len())
+}
@@ -0,0 +1,158 @@
+package webserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestCache(t *testing.T) *Cache[string, string] {
+	return NewCache[string, string]("test", &CacheConfig{Enabled: true, Size: 10}, newTestMetrics(t))
+}
+
+// blockingLoad returns a load which waits for release, and a channel which is closed once
+// the load has started
+func blockingLoad(value string, tags []string, release chan struct{}, loads *int32) (func(ctx context.Context) (string, []string, error), chan struct{}) {
+	started := make(chan struct{})
+	return func(ctx context.Context) (string, []string, error) {
+		atomic.AddInt32(loads, 1)
+		close(started)
+		<-release
+		return value, tags, nil
+	}, started
+}
+
+func cached(c *Cache[string, string], key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+func TestCacheSharesLoads(t *testing.T) {
+	c := newTestCache(t)
+	var loads int32
+	release := make(chan struct{})
+	load, started := blockingLoad("value", nil, release, &loads)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = c.Get(context.Background(), "key", load)
+	}()
+	<-started
+	results := make([]string, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.Get(context.Background(), "key", load)
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("expected 1 load, got %d", loads)
+	}
+	for _, result := range results {
+		if result != "value" {
+			t.Errorf("expected value, got %s", result)
+		}
+	}
+	if !cached(c, "key") {
+		t.Errorf("expected key to be cached")
+	}
+}
+
+func TestCacheInvalidateOnlyAffectsItsKey(t *testing.T) {
+	c := newTestCache(t)
+	var loads int32
+	releaseA, releaseB := make(chan struct{}), make(chan struct{})
+	loadA, startedA := blockingLoad("a", nil, releaseA, &loads)
+	loadB, startedB := blockingLoad("b", nil, releaseB, &loads)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() { defer wg.Done(); _, _ = c.Get(context.Background(), "a", loadA) }()
+	go func() { defer wg.Done(); _, _ = c.Get(context.Background(), "b", loadB) }()
+	<-startedA
+	<-startedB
+	c.Invalidate("a")
+	close(releaseA)
+	close(releaseB)
+	wg.Wait()
+
+	if cached(c, "a") {
+		t.Errorf("expected a's load, which was invalidated, not to be stored")
+	}
+	if !cached(c, "b") {
+		t.Errorf("expected b's load to be stored despite a's invalidation")
+	}
+}
+
+func TestCacheInvalidateTagged(t *testing.T) {
+	c := newTestCache(t)
+	var loads int32
+	releaseTagged, releaseOther := make(chan struct{}), make(chan struct{})
+	loadTagged, startedTagged := blockingLoad("tagged", []string{"tag"}, releaseTagged, &loads)
+	loadOther, startedOther := blockingLoad("other", []string{"other tag"}, releaseOther, &loads)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() { defer wg.Done(); _, _ = c.Get(context.Background(), "tagged", loadTagged) }()
+	go func() { defer wg.Done(); _, _ = c.Get(context.Background(), "other", loadOther) }()
+	<-startedTagged
+	<-startedOther
+	c.InvalidateTagged("tag")
+	c.mu.Lock()
+	_, otherLoading := c.loads["other"]
+	c.mu.Unlock()
+	if !otherLoading {
+		t.Errorf("expected the unrelated load to still be shareable")
+	}
+
+	// joining after the invalidation: a load that may predate the write mustn't be shared
+	var joined string
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		joined, _ = c.Get(context.Background(), "tagged", func(ctx context.Context) (string, []string, error) {
+			atomic.AddInt32(&loads, 1)
+			return "reloaded", []string{"tag"}, nil
+		})
+	}()
+	// the unrelated load is still shared
+	var shared string
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shared, _ = c.Get(context.Background(), "other", func(ctx context.Context) (string, []string, error) {
+			t.Errorf("expected other's load to be shared")
+			return "", nil, nil
+		})
+	}()
+	close(releaseTagged)
+	close(releaseOther)
+	wg.Wait()
+
+	if joined != "reloaded" {
+		t.Errorf("expected a caller joining after the invalidation to reload, got %s", joined)
+	}
+	if shared != "other" {
+		t.Errorf("expected other, got %s", shared)
+	}
+	if !cached(c, "other") {
+		t.Errorf("expected other's load to be stored")
+	}
+
+	c.InvalidateTagged("tag")
+	if cached(c, "tagged") {
+		t.Errorf("expected entries tagged with tag to be dropped")
+	}
+	if !cached(c, "other") {
+		t.Errorf("expected other to be kept")
+	}
+}
@@ -1,94 +1,294 @@
 package webserver
 
 import (
+	"bufio"
+	"container/list"
 	"context"
+	stdjson "encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
+	"github.com/mattfenwick/collections/pkg/json"
 	"github.com/mattfenwick/scaling/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 type Client struct {
 	URL   string
 	Resty *resty.Client
+
+	responses *responseCache
 }
 
+// clientCacheSize is how many GET responses a Client keeps for revalidation
+const clientCacheSize = 1000
+
 func NewClient(url string) *Client {
 	return &Client{
-		URL:   url,
-		Resty: resty.New().SetBaseURL(url).SetTransport(utils.OtelTransport()),
+		URL:       url,
+		Resty:     resty.New().SetBaseURL(url).SetTransport(NewDecompressingTransport(utils.OtelTransport())),
+		responses: newResponseCache(clientCacheSize),
 	}
 }
 
-// users
-
-func (c *Client) CreateUser(ctx context.Context, request *CreateUserRequest) (*CreateUserResponse, error) {
-	out, _, err := utils.RestyIssueRequest[CreateUserResponse](ctx, c.Resty, "POST", UserPath, request, nil)
+// issueRequest fills in the path template and query string from the request's
+// `path` and `query` tags; the request is only sent as a body for non-GETs
+func issueRequest[A any](ctx context.Context, c *Client, verb string, pathTemplate string, request any) (*A, error) {
+	pathParams, queryParams := requestParams(request)
+	path, err := ExpandPath(pathTemplate, pathParams)
+	if err != nil {
+		return nil, err
+	}
+	if verb == "GET" {
+		return issueConditionalGet[A](ctx, c, path, queryParams)
+	}
+	out, _, err := utils.RestyIssueRequest[A](ctx, c.Resty, verb, path, request, queryParams)
 	return out, err
 }
 
-func (c *Client) GetUser(ctx context.Context, request *GetUserRequest) (*GetUserResponse, error) {
-	params := map[string]string{"userid": request.UserId.String()}
-	out, _, err := utils.RestyIssueRequest[GetUserResponse](ctx, c.Resty, "GET", UserPath, nil, params)
-	return out, err
+// FollowUser is the old name of Follow.
+//
+// Deprecated: use Follow.
+func (c *Client) FollowUser(ctx context.Context, request *FollowRequest) (*FollowResponse, error) {
+	return c.Follow(ctx, request)
 }
 
-func (c *Client) GetUsers(ctx context.Context, request *GetUsersRequest) (*GetUsersResponse, error) {
-	out, _, err := utils.RestyIssueRequest[GetUsersResponse](ctx, c.Resty, "GET", UsersPath, nil, nil)
-	return out, err
+// UpvoteMessage is the old name of CreateUpvote.
+//
+// Deprecated: use CreateUpvote.
+func (c *Client) UpvoteMessage(ctx context.Context, request *CreateUpvoteRequest) (*CreateUpvoteResponse, error) {
+	return c.CreateUpvote(ctx, request)
 }
 
-func (c *Client) SearchUsers(ctx context.Context, request *SearchUsersRequest) (*SearchUsersResponse, error) {
-	out, _, err := utils.RestyIssueRequest[SearchUsersResponse](ctx, c.Resty, "POST", UsersPath, request, nil)
-	return out, err
+// issueConditionalGet revalidates the response it last saw, if any, so that an unchanged
+// response isn't sent again
+func issueConditionalGet[A any](ctx context.Context, c *Client, path string, queryParams map[string]string) (*A, error) {
+	key := path + "?" + encodeQuery(queryParams)
+	request := c.Resty.R().SetContext(ctx).SetQueryParams(queryParams)
+	cached, ok := c.responses.Get(key)
+	if ok {
+		request.SetHeader("If-None-Match", cached.etag)
+	}
+	response, err := request.Get(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to issue GET to %s", path)
+	}
+
+	var body string
+	switch {
+	case response.StatusCode() == http.StatusNotModified && ok:
+		logrus.Debugf("GET to %s not modified", path)
+		body = cached.body
+	case response.IsSuccess():
+		body = response.String()
+		if etag := response.Header().Get("ETag"); etag != "" {
+			c.responses.Put(key, &cachedResponse{etag: etag, body: body})
+		}
+	default:
+		return nil, errors.Errorf("bad status code for GET to path %s: %d, response %s", path, response.StatusCode(), response.String())
+	}
+	return json.ParseString[A](body)
 }
 
-func (c *Client) GetUserTimeline(ctx context.Context, request *GetUserTimelineRequest) (*GetUserTimelineResponse, error) {
-	out, _, err := utils.RestyIssueRequest[GetUserTimelineResponse](ctx, c.Resty, "POST", UserTimelinePath, request, nil)
-	return out, err
+func encodeQuery(queryParams map[string]string) string {
+	values := url.Values{}
+	for name, value := range queryParams {
+		values.Set(name, value)
+	}
+	return values.Encode()
 }
 
-func (c *Client) GetUserMessages(ctx context.Context, request *GetUserMessagesRequest) (*GetUserMessagesResponse, error) {
-	out, _, err := utils.RestyIssueRequest[GetUserMessagesResponse](ctx, c.Resty, "POST", UserMessagesPath, request, nil)
-	return out, err
+type cachedResponse struct {
+	etag string
+	body string
 }
 
-// messages
+// responseCache keeps the most recently used responses
+type responseCache struct {
+	size int
 
-func (c *Client) CreateMessage(ctx context.Context, request *CreateMessageRequest) (*CreateMessageResponse, error) {
-	out, _, err := utils.RestyIssueRequest[CreateMessageResponse](ctx, c.Resty, "POST", MessagePath, request, nil)
-	return out, err
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
 }
 
-func (c *Client) GetMessage(ctx context.Context, request *GetMessageRequest) (*GetMessageResponse, error) {
-	params := map[string]string{"messageid": request.MessageId.String()}
-	out, _, err := utils.RestyIssueRequest[GetMessageResponse](ctx, c.Resty, "GET", MessagePath, nil, params)
-	return out, err
+type responseCacheEntry struct {
+	key      string
+	response *cachedResponse
 }
 
-func (c *Client) GetMessages(ctx context.Context, request *GetMessagesRequest) (*GetMessagesResponse, error) {
-	out, _, err := utils.RestyIssueRequest[GetMessagesResponse](ctx, c.Resty, "GET", MessagesPath, request, nil)
-	return out, err
+func newResponseCache(size int) *responseCache {
+	return &responseCache{size: size, entries: map[string]*list.Element{}, lru: list.New()}
 }
 
-func (c *Client) SearchMessages(ctx context.Context, request *SearchMessagesRequest) (*SearchMessagesResponse, error) {
-	out, _, err := utils.RestyIssueRequest[SearchMessagesResponse](ctx, c.Resty, "POST", MessagesPath, request, nil)
-	return out, err
+func (r *responseCache) Get(key string) (*cachedResponse, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	element, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+	r.lru.MoveToFront(element)
+	return element.Value.(*responseCacheEntry).response, true
 }
 
-// follow/upvote
+func (r *responseCache) Put(key string, response *cachedResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if element, ok := r.entries[key]; ok {
+		element.Value.(*responseCacheEntry).response = response
+		r.lru.MoveToFront(element)
+		return
+	}
+	r.entries[key] = r.lru.PushFront(&responseCacheEntry{key: key, response: response})
+	for r.lru.Len() > r.size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+}
 
-func (c *Client) FollowUser(ctx context.Context, request *FollowRequest) (*FollowResponse, error) {
-	out, _, err := utils.RestyIssueRequest[FollowResponse](ctx, c.Resty, "POST", FollowPath, request, nil)
-	return out, err
+// ListStreamer is implemented by clients which can read lists item by item, rather than
+// holding the whole list in memory.  Each method stops at the first error from onItem.
+type ListStreamer interface {
+	StreamUsers(ctx context.Context, request *GetUsersRequest, onItem func(*GetUserResponse) error) error
+	StreamSearchUsers(ctx context.Context, request *SearchUsersRequest, onItem func(*GetUserResponse) error) error
+	StreamUserTimeline(ctx context.Context, request *GetUserTimelineRequest, onItem func(*GetMessageResponse) error) error
+	StreamUserMessages(ctx context.Context, request *GetUserMessagesRequest, onItem func(*GetMessageResponse) error) error
+	StreamMessages(ctx context.Context, request *GetMessagesRequest, onItem func(*GetMessageResponse) error) error
+	StreamSearchMessages(ctx context.Context, request *SearchMessagesRequest, onItem func(*GetMessageResponse) error) error
+	StreamFollowers(ctx context.Context, request *GetFollowersOfUserRequest, onItem func(*GetUserResponse) error) error
 }
 
-func (c *Client) GetFollowers(ctx context.Context, request *GetFollowersOfUserRequest) (*GetFollowersOfUserResponse, error) {
-	params := map[string]string{"userid": request.UserId.String()}
-	out, _, err := utils.RestyIssueRequest[GetFollowersOfUserResponse](ctx, c.Resty, "GET", FollowersPath, nil, params)
-	return out, err
+var _ ListStreamer = &Client{}
+
+func (c *Client) StreamUsers(ctx context.Context, request *GetUsersRequest, onItem func(*GetUserResponse) error) error {
+	return streamList(ctx, c, V1UsersPath, request, onItem)
 }
 
-func (c *Client) UpvoteMessage(ctx context.Context, request *CreateUpvoteRequest) (*CreateUpvoteResponse, error) {
-	out, _, err := utils.RestyIssueRequest[CreateUpvoteResponse](ctx, c.Resty, "POST", UpvotePath, request, nil)
-	return out, err
+func (c *Client) StreamSearchUsers(ctx context.Context, request *SearchUsersRequest, onItem func(*GetUserResponse) error) error {
+	return streamList(ctx, c, V1UsersSearchPath, request, onItem)
+}
+
+func (c *Client) StreamUserTimeline(ctx context.Context, request *GetUserTimelineRequest, onItem func(*GetMessageResponse) error) error {
+	return streamList(ctx, c, V1UserTimelinePath, request, onItem)
+}
+
+func (c *Client) StreamUserMessages(ctx context.Context, request *GetUserMessagesRequest, onItem func(*GetMessageResponse) error) error {
+	return streamList(ctx, c, V1UserMessagesPath, request, onItem)
+}
+
+func (c *Client) StreamMessages(ctx context.Context, request *GetMessagesRequest, onItem func(*GetMessageResponse) error) error {
+	return streamList(ctx, c, V1MessagesPath, request, onItem)
+}
+
+func (c *Client) StreamSearchMessages(ctx context.Context, request *SearchMessagesRequest, onItem func(*GetMessageResponse) error) error {
+	return streamList(ctx, c, V1MessagesSearchPath, request, onItem)
+}
+
+func (c *Client) StreamFollowers(ctx context.Context, request *GetFollowersOfUserRequest, onItem func(*GetUserResponse) error) error {
+	return streamList(ctx, c, V1UserFollowersPath, request, onItem)
+}
+
+// streamList GETs a list as NDJSON, decoding each item as it's read
+func streamList[Item any](ctx context.Context, c *Client, pathTemplate string, request any, onItem func(*Item) error) error {
+	pathParams, queryParams := requestParams(request)
+	path, err := ExpandPath(pathTemplate, pathParams)
+	if err != nil {
+		return err
+	}
+	if query := encodeQuery(queryParams); query != "" {
+		path += "?" + query
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, "GET", c.URL+path, nil)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create request")
+	}
+	httpRequest.Header.Set("Accept", NDJSONContentType)
+	// don't use resty's request: it reads the whole body before returning
+	response, err := c.Resty.GetClient().Do(httpRequest)
+	if err != nil {
+		return errors.Wrapf(err, "unable to issue GET to %s", path)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return errors.Errorf("bad status code for GET to path %s: %d, response %s", path, response.StatusCode, body)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != NDJSONContentType {
+		return errors.Errorf("expected %s from GET to path %s, got %s", NDJSONContentType, path, contentType)
+	}
+
+	decoder := stdjson.NewDecoder(response.Body)
+	for {
+		item := new(Item)
+		if err := decoder.Decode(item); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "unable to decode item from GET to path %s", path)
+		}
+		if err := onItem(item); err != nil {
+			return err
+		}
+	}
+}
+
+// TimelineStreamer is implemented by clients which can hold open a timeline stream
+type TimelineStreamer interface {
+	StreamTimeline(ctx context.Context, userId uuid.UUID, onEvent func(*TimelineEvent)) error
+}
+
+var _ TimelineStreamer = &Client{}
+
+// StreamTimeline calls onEvent for each message pushed to userId's timeline stream.  It
+// blocks until ctx is done or the server ends the stream.
+func (c *Client) StreamTimeline(ctx context.Context, userId uuid.UUID, onEvent func(*TimelineEvent)) error {
+	path, err := ExpandPath(V1UserTimelineStreamPath, map[string]string{"userid": userId.String()})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", c.URL+path, nil)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create request")
+	}
+	request.Header.Set("accept", "text/event-stream")
+	// don't use resty's request: it reads the whole body before returning
+	response, err := c.Resty.GetClient().Do(request)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open stream")
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return errors.Errorf("unable to open stream: status code %d", response.StatusCode)
+	}
+
+	// events are separated by blank lines; of the fields, only data is needed
+	scanner := bufio.NewScanner(response.Body)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				event, err := json.ParseString[TimelineEvent](strings.Join(data, "\n"))
+				if err != nil {
+					return errors.Wrapf(err, "unable to parse event")
+				}
+				onEvent(event)
+			}
+			data = nil
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.Wrapf(scanner.Err(), "unable to read stream")
 }
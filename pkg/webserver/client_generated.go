@@ -0,0 +1,76 @@
+// Code generated by cmd/hack from responder.go; DO NOT EDIT.
+
+package webserver
+
+import "context"
+
+// API is the part of Responder which is exposed to clients
+type API interface {
+	CreateUser(context.Context, *CreateUserRequest) (*CreateUserResponse, error)
+	GetUser(context.Context, *GetUserRequest) (*GetUserResponse, error)
+	GetUserTimeline(context.Context, *GetUserTimelineRequest) (*GetUserTimelineResponse, error)
+	GetUserMessages(context.Context, *GetUserMessagesRequest) (*GetUserMessagesResponse, error)
+	GetUsers(context.Context, *GetUsersRequest) (*GetUsersResponse, error)
+	SearchUsers(context.Context, *SearchUsersRequest) (*SearchUsersResponse, error)
+	CreateMessage(context.Context, *CreateMessageRequest) (*CreateMessageResponse, error)
+	GetMessage(context.Context, *GetMessageRequest) (*GetMessageResponse, error)
+	GetMessages(context.Context, *GetMessagesRequest) (*GetMessagesResponse, error)
+	SearchMessages(context.Context, *SearchMessagesRequest) (*SearchMessagesResponse, error)
+	Follow(context.Context, *FollowRequest) (*FollowResponse, error)
+	GetFollowers(context.Context, *GetFollowersOfUserRequest) (*GetFollowersOfUserResponse, error)
+	CreateUpvote(context.Context, *CreateUpvoteRequest) (*CreateUpvoteResponse, error)
+}
+
+var _ API = &Client{}
+
+func (c *Client) CreateUser(ctx context.Context, request *CreateUserRequest) (*CreateUserResponse, error) {
+	return issueRequest[CreateUserResponse](ctx, c, "POST", V1UsersPath, request)
+}
+
+func (c *Client) GetUser(ctx context.Context, request *GetUserRequest) (*GetUserResponse, error) {
+	return issueRequest[GetUserResponse](ctx, c, "GET", V1UserPath, request)
+}
+
+func (c *Client) GetUserTimeline(ctx context.Context, request *GetUserTimelineRequest) (*GetUserTimelineResponse, error) {
+	return issueRequest[GetUserTimelineResponse](ctx, c, "GET", V1UserTimelinePath, request)
+}
+
+func (c *Client) GetUserMessages(ctx context.Context, request *GetUserMessagesRequest) (*GetUserMessagesResponse, error) {
+	return issueRequest[GetUserMessagesResponse](ctx, c, "GET", V1UserMessagesPath, request)
+}
+
+func (c *Client) GetUsers(ctx context.Context, request *GetUsersRequest) (*GetUsersResponse, error) {
+	return issueRequest[GetUsersResponse](ctx, c, "GET", V1UsersPath, request)
+}
+
+func (c *Client) SearchUsers(ctx context.Context, request *SearchUsersRequest) (*SearchUsersResponse, error) {
+	return issueRequest[SearchUsersResponse](ctx, c, "GET", V1UsersSearchPath, request)
+}
+
+func (c *Client) CreateMessage(ctx context.Context, request *CreateMessageRequest) (*CreateMessageResponse, error) {
+	return issueRequest[CreateMessageResponse](ctx, c, "POST", V1MessagesPath, request)
+}
+
+func (c *Client) GetMessage(ctx context.Context, request *GetMessageRequest) (*GetMessageResponse, error) {
+	return issueRequest[GetMessageResponse](ctx, c, "GET", V1MessagePath, request)
+}
+
+func (c *Client) GetMessages(ctx context.Context, request *GetMessagesRequest) (*GetMessagesResponse, error) {
+	return issueRequest[GetMessagesResponse](ctx, c, "GET", V1MessagesPath, request)
+}
+
+func (c *Client) SearchMessages(ctx context.Context, request *SearchMessagesRequest) (*SearchMessagesResponse, error) {
+	return issueRequest[SearchMessagesResponse](ctx, c, "GET", V1MessagesSearchPath, request)
+}
+
+func (c *Client) Follow(ctx context.Context, request *FollowRequest) (*FollowResponse, error) {
+	return issueRequest[FollowResponse](ctx, c, "POST", V1UserFollowersPath, request)
+}
+
+func (c *Client) GetFollowers(ctx context.Context, request *GetFollowersOfUserRequest) (*GetFollowersOfUserResponse, error) {
+	return issueRequest[GetFollowersOfUserResponse](ctx, c, "GET", V1UserFollowersPath, request)
+}
+
+func (c *Client) CreateUpvote(ctx context.Context, request *CreateUpvoteRequest) (*CreateUpvoteResponse, error) {
+	return issueRequest[CreateUpvoteResponse](ctx, c, "POST", V1MessageUpvotesPath, request)
+}
@@ -0,0 +1,245 @@
+package webserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	JSONContentType = "application/json"
+	// NDJSONContentType is newline-delimited json: one list item per line
+	NDJSONContentType = "application/x-ndjson"
+
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+
+	// responses smaller than this aren't worth compressing
+	minCompressSize = 1024
+)
+
+// ListResponse is implemented by responses which are mostly a list, so that clients can
+// ask for them as NDJSON, and read the items as they arrive.  The rest of the response
+// isn't sent as NDJSON: it's the request, echoed back.
+type ListResponse interface {
+	// Items returns the list, which must be a slice
+	Items() any
+}
+
+var listResponseType = reflect.TypeOf((*ListResponse)(nil)).Elem()
+
+func (r *GetUsersResponse) Items() any           { return r.Users }
+func (r *SearchUsersResponse) Items() any        { return r.Users }
+func (r *GetUserMessagesResponse) Items() any    { return r.Messages }
+func (r *GetUserTimelineResponse) Items() any    { return r.Messages }
+func (r *GetMessagesResponse) Items() any        { return r.Messages }
+func (r *SearchMessagesResponse) Items() any     { return r.Messages }
+func (r *GetFollowersOfUserResponse) Items() any { return r.Followers }
+
+// listItemType finds the item type of a ListResponse type, or nil if it isn't one
+func listItemType(response reflect.Type) reflect.Type {
+	if !reflect.PointerTo(response).Implements(listResponseType) {
+		return nil
+	}
+	return reflect.TypeOf(reflect.New(response).Interface().(ListResponse).Items()).Elem()
+}
+
+// acceptsNDJSON is true if the request's Accept header lists NDJSON
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			if strings.TrimSpace(strings.Split(mediaType, ";")[0]) == NDJSONContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks zstd or gzip from an Accept-Encoding header, preferring
+// whichever the client weights higher, and zstd on a tie.  An empty result means identity.
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestWeight := "", 0.0
+	for _, candidate := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(candidate, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		weight := 1.0
+		for _, param := range parts[1:] {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && name == "q" {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					parsed = 0
+				}
+				weight = parsed
+			}
+		}
+		if (coding != EncodingZstd && coding != EncodingGzip) || weight <= 0 {
+			continue
+		}
+		if weight > bestWeight || (weight == bestWeight && coding == EncodingZstd) {
+			best, bestWeight = coding, weight
+		}
+	}
+	return best
+}
+
+// encodeBody writes response as json, or as NDJSON
+func encodeBody(w io.Writer, response any, ndjson bool) error {
+	encoder := json.NewEncoder(w)
+	if !ndjson {
+		return errors.Wrapf(encoder.Encode(response), "unable to encode response")
+	}
+	items := reflect.ValueOf(response.(ListResponse).Items())
+	for i := 0; i < items.Len(); i++ {
+		if err := encoder.Encode(items.Index(i).Interface()); err != nil {
+			return errors.Wrapf(err, "unable to encode item %d", i)
+		}
+	}
+	return nil
+}
+
+// bodyBuffers are pooled, so that encoding a response doesn't allocate a buffer every time;
+// buffers which grew past maxPooledBodySize aren't kept, so one huge response doesn't pin
+// its memory
+var bodyBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+const maxPooledBodySize = 1 << 20
+
+// encodeBuffered encodes response once, into a pooled buffer, so that its size and ETag
+// can be sent as headers before it's written.  Call release once done with the buffer.
+func encodeBuffered(response any, ndjson bool) (body *bytes.Buffer, etag string, release func(), err error) {
+	body = bodyBuffers.Get().(*bytes.Buffer)
+	body.Reset()
+	release = func() {
+		if body.Cap() <= maxPooledBodySize {
+			bodyBuffers.Put(body)
+		}
+	}
+	if err := encodeBody(body, response, ndjson); err != nil {
+		release()
+		return nil, "", nil, err
+	}
+	sum := sha256.Sum256(body.Bytes())
+	return body, strongETag(sum[:]), release, nil
+}
+
+// compressors are pooled, since a zstd encoder in particular is expensive to set up
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	zstdWriters = sync.Pool{New: func() any {
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(errors.Wrapf(err, "unable to create zstd encoder"))
+		}
+		return encoder
+	}}
+)
+
+// compress wraps w with encoding's compressor; closing it flushes the compressor, but
+// doesn't close w
+func compress(w io.Writer, encoding string) io.WriteCloser {
+	switch encoding {
+	case EncodingGzip:
+		writer := gzipWriters.Get().(*gzip.Writer)
+		writer.Reset(w)
+		return &pooledWriter{WriteCloser: writer, release: func() { gzipWriters.Put(writer) }}
+	case EncodingZstd:
+		writer := zstdWriters.Get().(*zstd.Encoder)
+		writer.Reset(w)
+		return &pooledWriter{WriteCloser: writer, release: func() { zstdWriters.Put(writer) }}
+	}
+	return nopWriteCloser{Writer: w}
+}
+
+type pooledWriter struct {
+	io.WriteCloser
+	release func()
+}
+
+func (p *pooledWriter) Close() error {
+	err := p.WriteCloser.Close()
+	p.release()
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// DecompressingTransport asks for zstd or gzip responses, and decompresses them, so that
+// callers read plain bodies whatever the server chose.  Requests which set their own
+// Accept-Encoding are left alone.
+type DecompressingTransport struct {
+	Base http.RoundTripper
+}
+
+func NewDecompressingTransport(base http.RoundTripper) *DecompressingTransport {
+	return &DecompressingTransport{Base: base}
+}
+
+func (t *DecompressingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Header.Get("Accept-Encoding") != "" {
+		return t.Base.RoundTrip(request)
+	}
+	request = request.Clone(request.Context())
+	request.Header.Set("Accept-Encoding", EncodingZstd+", "+EncodingGzip)
+	response, err := t.Base.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.ReadCloser
+	switch strings.ToLower(response.Header.Get("Content-Encoding")) {
+	case EncodingGzip:
+		reader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			response.Body.Close()
+			return nil, errors.Wrapf(err, "unable to read gzip response")
+		}
+		body = &decompressedBody{Reader: reader, close: reader.Close, body: response.Body}
+	case EncodingZstd:
+		// with a concurrency of 1, the decoder runs in the caller's goroutine
+		reader, err := zstd.NewReader(response.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			response.Body.Close()
+			return nil, errors.Wrapf(err, "unable to read zstd response")
+		}
+		body = &decompressedBody{Reader: reader, close: func() error { reader.Close(); return nil }, body: response.Body}
+	default:
+		return response, nil
+	}
+	response.Body = body
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+	return response, nil
+}
+
+type decompressedBody struct {
+	io.Reader
+	close func() error
+	body  io.ReadCloser
+}
+
+func (d *decompressedBody) Close() error {
+	err := d.close()
+	if bodyErr := d.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
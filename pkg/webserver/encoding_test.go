@@ -0,0 +1,136 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mattfenwick/collections/pkg/json"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for acceptEncoding, expected := range map[string]string{
+		"":                          "",
+		"identity":                  "",
+		"br":                        "",
+		"gzip":                      EncodingGzip,
+		"GZIP":                      EncodingGzip,
+		"gzip, zstd":                EncodingZstd,
+		"zstd;q=0.5, gzip":          EncodingGzip,
+		"zstd, gzip;q=0.9":          EncodingZstd,
+		"gzip;q=0, zstd;q=0":        "",
+		"gzip;q=bad, zstd;q=0.1":    EncodingZstd,
+		" gzip ; q=0.8 , br;q=1.0 ": EncodingGzip,
+	} {
+		if actual := negotiateEncoding(acceptEncoding); actual != expected {
+			t.Errorf("%q: expected %q, got %q", acceptEncoding, expected, actual)
+		}
+	}
+}
+
+// serveEncoded serves response, compressed with encoding whatever the client asked for, so
+// that each of DecompressingTransport's decoders can be tested
+func serveEncoded(encoding string, response any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept-Encoding", encoding)
+		writeResponse(w, r, http.StatusOK, response)
+	}
+}
+
+func TestDecompressingTransport(t *testing.T) {
+	var users []GetUserResponse
+	for i := 0; i < 100; i++ {
+		users = append(users, GetUserResponse{Name: fmt.Sprintf("user %d", i)})
+	}
+	response := &GetUsersResponse{Users: users, Request: &GetUsersRequest{}}
+	expected := json.MustMarshalToString(response)
+	client := &http.Client{Transport: NewDecompressingTransport(http.DefaultTransport)}
+
+	for _, encoding := range []string{EncodingZstd, EncodingGzip, ""} {
+		server := httptest.NewServer(serveEncoded(encoding, response))
+		httpResponse, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("%q: unable to GET: %+v", encoding, err)
+		}
+		body, err := io.ReadAll(httpResponse.Body)
+		httpResponse.Body.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("%q: unable to read body: %+v", encoding, err)
+		}
+		decoded, err := json.ParseString[GetUsersResponse](string(body))
+		if err != nil || json.MustMarshalToString(decoded) != expected {
+			t.Errorf("%q: expected the response back, got %s (%+v)", encoding, body, err)
+		}
+		if encoding != "" && (!httpResponse.Uncompressed || httpResponse.Header.Get("Content-Encoding") != "") {
+			t.Errorf("%q: expected the response to be marked as decompressed, got %+v", encoding, httpResponse.Header)
+		}
+	}
+}
+
+func TestDecompressingTransportAsksForCompression(t *testing.T) {
+	acceptEncodings := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncodings <- r.Header.Get("Accept-Encoding")
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: NewDecompressingTransport(http.DefaultTransport)}
+
+	if response, err := client.Get(server.URL); err == nil {
+		response.Body.Close()
+	}
+	if acceptEncoding := <-acceptEncodings; negotiateEncoding(acceptEncoding) != EncodingZstd {
+		t.Errorf("expected the transport to ask for zstd, got %q", acceptEncoding)
+	}
+
+	// a caller's own Accept-Encoding is left alone
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Accept-Encoding", "identity")
+	if response, err := client.Do(request); err == nil {
+		response.Body.Close()
+	}
+	if acceptEncoding := <-acceptEncodings; acceptEncoding != "identity" {
+		t.Errorf("expected the caller's Accept-Encoding, got %q", acceptEncoding)
+	}
+}
+
+func TestSmallResponsesAreNotCompressed(t *testing.T) {
+	recorder := getResponse(&GetUserResponse{Name: "abc"}, map[string]string{"Accept-Encoding": EncodingGzip})
+	if recorder.Header().Get("Content-Encoding") != "" || !strings.Contains(recorder.Body.String(), "abc") {
+		t.Errorf("expected a small response to be sent as is, got %+v", recorder.Header())
+	}
+}
+
+func TestClientStreamsCompressedNDJSON(t *testing.T) {
+	responder := &streamResponder{fail: -1}
+	for i := 0; i < 100; i++ {
+		responder.users = append(responder.users, &GetUserResponse{Name: fmt.Sprintf("user %d", i)})
+	}
+	encodings := make(chan string, 1)
+	router := NewRouter(V1Routes(responder), newTestMetrics(t), &AccessLogConfig{Disabled: true})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r)
+		encodings <- w.Header().Get("Content-Encoding")
+	}))
+	defer server.Close()
+
+	var received []*GetUserResponse
+	err := NewClient(server.URL).StreamUsers(context.Background(), &GetUsersRequest{}, func(user *GetUserResponse) error {
+		received = append(received, user)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to stream users: %+v", err)
+	}
+	if encoding := <-encodings; encoding != EncodingZstd {
+		t.Errorf("expected the stream to be compressed with zstd, got %q", encoding)
+	}
+	if !reflect.DeepEqual(received, responder.users) {
+		t.Errorf("expected %d users, got %d", len(responder.users), len(received))
+	}
+}
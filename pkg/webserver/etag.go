@@ -0,0 +1,37 @@
+package webserver
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// GETs may be stored by clients, but must be revalidated before every use, since writes
+// can change them at any time
+const getCacheControl = "no-cache"
+
+// strongETag identifies a response body by the sha256 of its content, so that replicas
+// agree on it
+func strongETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// weakETag marks etag as identifying the content rather than the exact bytes, as for a
+// compressed response
+func weakETag(etag string) string {
+	return "W/" + etag
+}
+
+// etagMatches implements If-None-Match, which uses weak comparison: a W/ prefix on either
+// side is ignored
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
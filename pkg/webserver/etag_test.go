@@ -0,0 +1,72 @@
+package webserver
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func getResponse(response any, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/test", nil)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	writeResponse(recorder, request, http.StatusOK, response)
+	return recorder
+}
+
+func TestConditionalGet(t *testing.T) {
+	response := &GetUserResponse{Name: "abc", Email: "abc@example.com"}
+	first := getResponse(response, nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("expected a 200 with a strong ETag, got %d and %q", first.Code, etag)
+	}
+	if length := first.Header().Get("Content-Length"); length != strconv.Itoa(first.Body.Len()) {
+		t.Errorf("expected a Content-Length of %d, got %s", first.Body.Len(), length)
+	}
+	if cacheControl := first.Header().Get("Cache-Control"); cacheControl != getCacheControl {
+		t.Errorf("expected Cache-Control %s, got %s", getCacheControl, cacheControl)
+	}
+
+	notModified := getResponse(response, map[string]string{"If-None-Match": `"other", ` + etag})
+	if notModified.Code != http.StatusNotModified || notModified.Body.Len() != 0 {
+		t.Errorf("expected an empty 304 for a matching ETag, got %d with %d bytes", notModified.Code, notModified.Body.Len())
+	}
+
+	changed := getResponse(&GetUserResponse{Name: "def"}, map[string]string{"If-None-Match": etag})
+	if changed.Code != http.StatusOK || changed.Header().Get("ETag") == etag {
+		t.Errorf("expected a 200 with a new ETag for a changed response, got %d and %q", changed.Code, changed.Header().Get("ETag"))
+	}
+}
+
+func TestCompressedResponsesHaveWeakETags(t *testing.T) {
+	// big enough to be worth compressing
+	response := &GetUserResponse{Name: strings.Repeat("a", 2*minCompressSize)}
+	plain := getResponse(response, nil)
+	compressed := getResponse(response, map[string]string{"Accept-Encoding": EncodingGzip})
+
+	etag := compressed.Header().Get("ETag")
+	if compressed.Header().Get("Content-Encoding") != EncodingGzip || etag != weakETag(plain.Header().Get("ETag")) {
+		t.Fatalf("expected a gzipped response with the weak form of %s, got %q", plain.Header().Get("ETag"), etag)
+	}
+	reader, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatalf("unable to read gzip: %+v", err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil || string(body) != plain.Body.String() {
+		t.Errorf("expected the decompressed body to match the plain one, got %+v", err)
+	}
+
+	// the strong and weak forms of an ETag match each other
+	notModified := getResponse(response, map[string]string{"Accept-Encoding": EncodingGzip, "If-None-Match": plain.Header().Get("ETag")})
+	if notModified.Code != http.StatusNotModified {
+		t.Errorf("expected a 304, got %d", notModified.Code)
+	}
+}
@@ -0,0 +1,193 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrEventLoopFull    = errors.New("event loop queue full")
+	ErrEventLoopStopped = errors.New("event loop shutting down")
+)
+
+type Action struct {
+	Name string
+	F    func(ctx context.Context) error
+
+	ctx        context.Context
+	enqueuedAt time.Time
+	result     chan error
+}
+
+// EventLoop is a bounded queue of actions processed by a fixed pool of workers.
+// Submitting to a full queue fails immediately rather than blocking, so that
+// callers can shed load.
+type EventLoop struct {
+	actions       chan *Action
+	workers       int
+	actionTimeout time.Duration
+	metrics       *telemetry.Metrics
+
+	// closeLock guards closing actions, so that submitters never send on a closed channel
+	closeLock sync.RWMutex
+	closed    bool
+	done      sync.WaitGroup
+
+	recentLock    sync.Mutex
+	recentActions []*ActionTiming
+}
+
+const maxRecentActions = 50
+
+func NewEventLoop(ctx context.Context, queueSize int, workers int, actionTimeout time.Duration, metrics *telemetry.Metrics) *EventLoop {
+	e := &EventLoop{
+		actions:       make(chan *Action, queueSize),
+		workers:       workers,
+		actionTimeout: actionTimeout,
+		metrics:       metrics,
+	}
+	for i := 0; i < workers; i++ {
+		e.done.Add(1)
+		go e.work(ctx)
+	}
+	return e
+}
+
+func (e *EventLoop) work(ctx context.Context) {
+	defer e.done.Done()
+	for {
+		select {
+		case a, ok := <-e.actions:
+			if !ok {
+				return
+			}
+			e.metrics.SetEventLoopQueueDepth(len(e.actions))
+			a.result <- e.run(a)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *EventLoop) run(a *Action) error {
+	e.metrics.RecordEventLoopWait(a.Name, a.enqueuedAt)
+
+	// the submitter may have given up while the action was queued
+	if err := a.ctx.Err(); err != nil {
+		e.metrics.RecordEventLoopExpired(a.Name)
+		return errors.Wrapf(err, "action %s expired while queued", a.Name)
+	}
+
+	ctx, cancel := a.ctx, func() {}
+	if e.actionTimeout > 0 {
+		ctx, cancel = context.WithTimeout(a.ctx, e.actionTimeout)
+	}
+	defer cancel()
+
+	start := time.Now()
+	err := a.F(ctx)
+	e.metrics.RecordEventLoopDuration(a.Name, err, start)
+	e.recordAction(a.Name, err, start)
+	return err
+}
+
+// Do runs f on the event loop and waits for it to finish.  The action's deadline is
+// tied to ctx: if ctx is done first, Do returns and the action is skipped or cancelled.
+func (e *EventLoop) Do(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	a := &Action{
+		Name:       name,
+		F:          f,
+		ctx:        ctx,
+		enqueuedAt: time.Now(),
+		result:     make(chan error, 1),
+	}
+	if err := e.submit(a); err != nil {
+		return err
+	}
+	select {
+	case err := <-a.result:
+		return err
+	case <-ctx.Done():
+		return WithStatus(http.StatusGatewayTimeout, errors.Wrapf(ctx.Err(), "gave up waiting for action %s", name))
+	}
+}
+
+func (e *EventLoop) submit(a *Action) error {
+	e.closeLock.RLock()
+	defer e.closeLock.RUnlock()
+	if e.closed {
+		return WithStatus(http.StatusServiceUnavailable, ErrEventLoopStopped)
+	}
+	select {
+	case e.actions <- a:
+		e.metrics.SetEventLoopQueueDepth(len(e.actions))
+		return nil
+	default:
+		e.metrics.RecordEventLoopShed(a.Name)
+		return WithStatus(http.StatusServiceUnavailable, ErrEventLoopFull)
+	}
+}
+
+// Stop rejects new actions, then waits for the workers to finish the ones already queued
+func (e *EventLoop) Stop(ctx context.Context) error {
+	e.closeLock.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.actions)
+	}
+	e.closeLock.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		e.done.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "timed out draining event loop")
+	}
+}
+
+func (e *EventLoop) Depth() int {
+	return len(e.actions)
+}
+
+func (e *EventLoop) Capacity() int {
+	return cap(e.actions)
+}
+
+func (e *EventLoop) Workers() int {
+	return e.workers
+}
+
+func (e *EventLoop) recordAction(name string, err error, start time.Time) {
+	timing := &ActionTiming{
+		Name:                 name,
+		Start:                start,
+		DurationMilliseconds: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		timing.Error = err.Error()
+	}
+
+	e.recentLock.Lock()
+	defer e.recentLock.Unlock()
+	e.recentActions = append(e.recentActions, timing)
+	if len(e.recentActions) > maxRecentActions {
+		e.recentActions = e.recentActions[len(e.recentActions)-maxRecentActions:]
+	}
+}
+
+func (e *EventLoop) RecentActions() []*ActionTiming {
+	e.recentLock.Lock()
+	defer e.recentLock.Unlock()
+	return copy(e.recentActions)
+}
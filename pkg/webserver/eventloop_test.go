@@ -0,0 +1,100 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestEventLoopShedsWhenFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := NewEventLoop(ctx, 1, 1, 0, newTestMetrics(t))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	blocked := make(chan error, 2)
+	go func() {
+		blocked <- e.Do(ctx, "block", func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	// the worker is busy, so this one waits in the queue
+	go func() {
+		blocked <- e.Do(ctx, "queued", func(ctx context.Context) error { return nil })
+	}()
+	for e.Depth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := e.Do(ctx, "shed", func(ctx context.Context) error {
+		t.Errorf("expected the action to be shed, not run")
+		return nil
+	})
+	if !errors.Is(err, ErrEventLoopFull) || errorStatusCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 for a full queue, got %d: %+v", errorStatusCode(err), err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-blocked; err != nil {
+			t.Errorf("expected the accepted actions to succeed, got %+v", err)
+		}
+	}
+
+	if err := e.Stop(ctx); err != nil {
+		t.Fatalf("unable to stop: %+v", err)
+	}
+	err = e.Do(ctx, "stopped", func(ctx context.Context) error { return nil })
+	if !errors.Is(err, ErrEventLoopStopped) || errorStatusCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 once stopped, got %d: %+v", errorStatusCode(err), err)
+	}
+}
+
+func TestEventLoopSkipsExpiredActions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := NewEventLoop(ctx, 1, 1, 0, newTestMetrics(t))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = e.Do(ctx, "block", func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	expiring, expire := context.WithCancel(ctx)
+	ran := make(chan struct{}, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- e.Do(expiring, "expiring", func(ctx context.Context) error {
+			ran <- struct{}{}
+			return nil
+		})
+	}()
+	for e.Depth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	expire()
+	if err := <-result; errorStatusCode(err) != http.StatusGatewayTimeout {
+		t.Errorf("expected a 504 once the caller gave up, got %d: %+v", errorStatusCode(err), err)
+	}
+
+	close(release)
+	if err := e.Stop(ctx); err != nil {
+		t.Fatalf("unable to stop: %+v", err)
+	}
+	select {
+	case <-ran:
+		t.Errorf("expected the expired action to be skipped")
+	default:
+	}
+}
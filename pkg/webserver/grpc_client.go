@@ -0,0 +1,95 @@
+package webserver
+
+import (
+	"context"
+
+	pb "github.com/mattfenwick/scaling/pkg/webserver/scalingpb"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// GRPCClient is the gRPC counterpart of Client
+type GRPCClient struct {
+	Address string
+	Conn    *grpc.ClientConn
+	Scaling pb.ScalingClient
+}
+
+var _ API = &GRPCClient{}
+
+func NewGRPCClient(address string) (*GRPCClient, error) {
+	conn, err := grpc.Dial(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to dial %s", address)
+	}
+	return &GRPCClient{Address: address, Conn: conn, Scaling: pb.NewScalingClient(conn)}, nil
+}
+
+func (c *GRPCClient) Close() error {
+	return c.Conn.Close()
+}
+
+// call converts a request to protobuf, issues it, and converts the response back
+func call[Req, In, Out, Resp any](ctx context.Context, request *Req, to func(*Req) In, f func(context.Context, In, ...grpc.CallOption) (Out, error), from func(Out) (*Resp, error)) (*Resp, error) {
+	out, err := f(ctx, to(request))
+	if err != nil {
+		return nil, err
+	}
+	return from(out)
+}
+
+func (c *GRPCClient) CreateUser(ctx context.Context, request *CreateUserRequest) (*CreateUserResponse, error) {
+	return call(ctx, request, createUserRequestToProto, c.Scaling.CreateUser, createUserResponseFromProto)
+}
+
+func (c *GRPCClient) GetUser(ctx context.Context, request *GetUserRequest) (*GetUserResponse, error) {
+	return call(ctx, request, getUserRequestToProto, c.Scaling.GetUser, getUserResponseFromProto)
+}
+
+func (c *GRPCClient) GetUserTimeline(ctx context.Context, request *GetUserTimelineRequest) (*GetUserTimelineResponse, error) {
+	return call(ctx, request, getUserTimelineRequestToProto, c.Scaling.GetUserTimeline, getUserTimelineResponseFromProto)
+}
+
+func (c *GRPCClient) GetUserMessages(ctx context.Context, request *GetUserMessagesRequest) (*GetUserMessagesResponse, error) {
+	return call(ctx, request, getUserMessagesRequestToProto, c.Scaling.GetUserMessages, getUserMessagesResponseFromProto)
+}
+
+func (c *GRPCClient) GetUsers(ctx context.Context, request *GetUsersRequest) (*GetUsersResponse, error) {
+	return call(ctx, request, getUsersRequestToProto, c.Scaling.GetUsers, getUsersResponseFromProto)
+}
+
+func (c *GRPCClient) SearchUsers(ctx context.Context, request *SearchUsersRequest) (*SearchUsersResponse, error) {
+	return call(ctx, request, searchUsersRequestToProto, c.Scaling.SearchUsers, searchUsersResponseFromProto)
+}
+
+func (c *GRPCClient) CreateMessage(ctx context.Context, request *CreateMessageRequest) (*CreateMessageResponse, error) {
+	return call(ctx, request, createMessageRequestToProto, c.Scaling.CreateMessage, createMessageResponseFromProto)
+}
+
+func (c *GRPCClient) GetMessage(ctx context.Context, request *GetMessageRequest) (*GetMessageResponse, error) {
+	return call(ctx, request, getMessageRequestToProto, c.Scaling.GetMessage, getMessageResponseFromProto)
+}
+
+func (c *GRPCClient) GetMessages(ctx context.Context, request *GetMessagesRequest) (*GetMessagesResponse, error) {
+	return call(ctx, request, getMessagesRequestToProto, c.Scaling.GetMessages, getMessagesResponseFromProto)
+}
+
+func (c *GRPCClient) SearchMessages(ctx context.Context, request *SearchMessagesRequest) (*SearchMessagesResponse, error) {
+	return call(ctx, request, searchMessagesRequestToProto, c.Scaling.SearchMessages, searchMessagesResponseFromProto)
+}
+
+func (c *GRPCClient) Follow(ctx context.Context, request *FollowRequest) (*FollowResponse, error) {
+	return call(ctx, request, followRequestToProto, c.Scaling.Follow, followResponseFromProto)
+}
+
+func (c *GRPCClient) GetFollowers(ctx context.Context, request *GetFollowersOfUserRequest) (*GetFollowersOfUserResponse, error) {
+	return call(ctx, request, getFollowersRequestToProto, c.Scaling.GetFollowers, getFollowersResponseFromProto)
+}
+
+func (c *GRPCClient) CreateUpvote(ctx context.Context, request *CreateUpvoteRequest) (*CreateUpvoteResponse, error) {
+	return call(ctx, request, createUpvoteRequestToProto, c.Scaling.CreateUpvote, createUpvoteResponseFromProto)
+}
@@ -0,0 +1,326 @@
+package webserver
+
+import (
+	"github.com/google/uuid"
+	"github.com/mattfenwick/collections/pkg/slice"
+	pb "github.com/mattfenwick/scaling/pkg/webserver/scalingpb"
+	"github.com/pkg/errors"
+)
+
+// conversions between the api types and their protobuf mirrors.  uuids travel as strings,
+// so converting from protobuf can fail.
+
+func parseUUID(field string, s string) (uuid.UUID, error) {
+	id, err := uuid.Parse(s)
+	return id, errors.Wrapf(err, "unable to parse uuid for %s from '%s'", field, s)
+}
+
+// users
+
+func createUserRequestFromProto(in *pb.CreateUserRequest) (*CreateUserRequest, error) {
+	return &CreateUserRequest{Name: in.Name, Email: in.Email}, nil
+}
+
+func createUserRequestToProto(in *CreateUserRequest) *pb.CreateUserRequest {
+	return &pb.CreateUserRequest{Name: in.Name, Email: in.Email}
+}
+
+func createUserResponseToProto(in *CreateUserResponse) *pb.CreateUserResponse {
+	return &pb.CreateUserResponse{UserId: in.UserId.String(), Request: createUserRequestToProto(in.Request)}
+}
+
+func createUserResponseFromProto(in *pb.CreateUserResponse) (*CreateUserResponse, error) {
+	userId, err := parseUUID("UserId", in.UserId)
+	if err != nil {
+		return nil, err
+	}
+	req, _ := createUserRequestFromProto(in.Request)
+	return &CreateUserResponse{UserId: userId, Request: req}, nil
+}
+
+func getUserRequestFromProto(in *pb.GetUserRequest) (*GetUserRequest, error) {
+	userId, err := parseUUID("UserId", in.UserId)
+	return &GetUserRequest{UserId: userId}, err
+}
+
+func getUserRequestToProto(in *GetUserRequest) *pb.GetUserRequest {
+	return &pb.GetUserRequest{UserId: in.UserId.String()}
+}
+
+func getUserResponseToProto(in *GetUserResponse) *pb.GetUserResponse {
+	return &pb.GetUserResponse{UserId: in.UserId.String(), Name: in.Name, Email: in.Email}
+}
+
+func getUserResponseFromProto(in *pb.GetUserResponse) (*GetUserResponse, error) {
+	userId, err := parseUUID("UserId", in.UserId)
+	return &GetUserResponse{UserId: userId, Name: in.Name, Email: in.Email}, err
+}
+
+func usersToProto(users []GetUserResponse) []*pb.GetUserResponse {
+	return slice.Map(func(u GetUserResponse) *pb.GetUserResponse { return getUserResponseToProto(&u) }, users)
+}
+
+func usersFromProto(users []*pb.GetUserResponse) ([]GetUserResponse, error) {
+	out := make([]GetUserResponse, len(users))
+	for i, u := range users {
+		user, err := getUserResponseFromProto(u)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = *user
+	}
+	return out, nil
+}
+
+func getUsersRequestFromProto(in *pb.GetUsersRequest) (*GetUsersRequest, error) {
+	return &GetUsersRequest{}, nil
+}
+
+func getUsersRequestToProto(in *GetUsersRequest) *pb.GetUsersRequest {
+	return &pb.GetUsersRequest{}
+}
+
+func getUsersResponseToProto(in *GetUsersResponse) *pb.GetUsersResponse {
+	return &pb.GetUsersResponse{Users: usersToProto(in.Users), Request: &pb.GetUsersRequest{}}
+}
+
+func getUsersResponseFromProto(in *pb.GetUsersResponse) (*GetUsersResponse, error) {
+	users, err := usersFromProto(in.Users)
+	return &GetUsersResponse{Users: users, Request: &GetUsersRequest{}}, err
+}
+
+func searchUsersRequestFromProto(in *pb.SearchUsersRequest) (*SearchUsersRequest, error) {
+	return &SearchUsersRequest{NamePattern: in.NamePattern, EmailPattern: in.EmailPattern}, nil
+}
+
+func searchUsersRequestToProto(in *SearchUsersRequest) *pb.SearchUsersRequest {
+	return &pb.SearchUsersRequest{NamePattern: in.NamePattern, EmailPattern: in.EmailPattern}
+}
+
+func searchUsersResponseToProto(in *SearchUsersResponse) *pb.SearchUsersResponse {
+	return &pb.SearchUsersResponse{Users: usersToProto(in.Users), Request: searchUsersRequestToProto(in.Request)}
+}
+
+func searchUsersResponseFromProto(in *pb.SearchUsersResponse) (*SearchUsersResponse, error) {
+	users, err := usersFromProto(in.Users)
+	req, _ := searchUsersRequestFromProto(in.Request)
+	return &SearchUsersResponse{Users: users, Request: req}, err
+}
+
+func getUserMessagesRequestFromProto(in *pb.GetUserMessagesRequest) (*GetUserMessagesRequest, error) {
+	userId, err := parseUUID("UserId", in.UserId)
+	return &GetUserMessagesRequest{UserId: userId}, err
+}
+
+func getUserMessagesRequestToProto(in *GetUserMessagesRequest) *pb.GetUserMessagesRequest {
+	return &pb.GetUserMessagesRequest{UserId: in.UserId.String()}
+}
+
+func getUserMessagesResponseToProto(in *GetUserMessagesResponse) *pb.GetUserMessagesResponse {
+	return &pb.GetUserMessagesResponse{UserId: in.UserId.String(), Messages: messagesToProto(in.Messages), Request: getUserMessagesRequestToProto(in.Request)}
+}
+
+func getUserMessagesResponseFromProto(in *pb.GetUserMessagesResponse) (*GetUserMessagesResponse, error) {
+	req, err := getUserMessagesRequestFromProto(in.Request)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := messagesFromProto(in.Messages)
+	return &GetUserMessagesResponse{UserId: req.UserId, Messages: messages, Request: req}, err
+}
+
+func getUserTimelineRequestFromProto(in *pb.GetUserTimelineRequest) (*GetUserTimelineRequest, error) {
+	userId, err := parseUUID("UserId", in.UserId)
+	return &GetUserTimelineRequest{UserId: userId}, err
+}
+
+func getUserTimelineRequestToProto(in *GetUserTimelineRequest) *pb.GetUserTimelineRequest {
+	return &pb.GetUserTimelineRequest{UserId: in.UserId.String()}
+}
+
+func getUserTimelineResponseToProto(in *GetUserTimelineResponse) *pb.GetUserTimelineResponse {
+	return &pb.GetUserTimelineResponse{UserId: in.UserId.String(), Messages: messagesToProto(in.Messages), Request: getUserTimelineRequestToProto(in.Request)}
+}
+
+func getUserTimelineResponseFromProto(in *pb.GetUserTimelineResponse) (*GetUserTimelineResponse, error) {
+	req, err := getUserTimelineRequestFromProto(in.Request)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := messagesFromProto(in.Messages)
+	return &GetUserTimelineResponse{UserId: req.UserId, Messages: messages, Request: req}, err
+}
+
+// messages
+
+func createMessageRequestFromProto(in *pb.CreateMessageRequest) (*CreateMessageRequest, error) {
+	senderUserId, err := parseUUID("SenderUserId", in.SenderUserId)
+	return &CreateMessageRequest{SenderUserId: senderUserId, Content: in.Content}, err
+}
+
+func createMessageRequestToProto(in *CreateMessageRequest) *pb.CreateMessageRequest {
+	return &pb.CreateMessageRequest{SenderUserId: in.SenderUserId.String(), Content: in.Content}
+}
+
+func createMessageResponseToProto(in *CreateMessageResponse) *pb.CreateMessageResponse {
+	return &pb.CreateMessageResponse{MessageId: in.MessageId.String(), Request: createMessageRequestToProto(in.Request)}
+}
+
+func createMessageResponseFromProto(in *pb.CreateMessageResponse) (*CreateMessageResponse, error) {
+	messageId, err := parseUUID("MessageId", in.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	req, err := createMessageRequestFromProto(in.Request)
+	return &CreateMessageResponse{MessageId: messageId, Request: req}, err
+}
+
+func getMessageRequestFromProto(in *pb.GetMessageRequest) (*GetMessageRequest, error) {
+	messageId, err := parseUUID("MessageId", in.MessageId)
+	return &GetMessageRequest{MessageId: messageId}, err
+}
+
+func getMessageRequestToProto(in *GetMessageRequest) *pb.GetMessageRequest {
+	return &pb.GetMessageRequest{MessageId: in.MessageId.String()}
+}
+
+func getMessageResponseToProto(in *GetMessageResponse) *pb.GetMessageResponse {
+	return &pb.GetMessageResponse{
+		MessageId:    in.MessageId.String(),
+		SenderUserId: in.SenderUserId.String(),
+		Content:      in.Content,
+		UpvoteCount:  int64(in.UpvoteCount),
+	}
+}
+
+func getMessageResponseFromProto(in *pb.GetMessageResponse) (*GetMessageResponse, error) {
+	messageId, err := parseUUID("MessageId", in.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	senderUserId, err := parseUUID("SenderUserId", in.SenderUserId)
+	return &GetMessageResponse{MessageId: messageId, SenderUserId: senderUserId, Content: in.Content, UpvoteCount: int(in.UpvoteCount)}, err
+}
+
+func messagesToProto(messages []GetMessageResponse) []*pb.GetMessageResponse {
+	return slice.Map(func(m GetMessageResponse) *pb.GetMessageResponse { return getMessageResponseToProto(&m) }, messages)
+}
+
+func messagesFromProto(messages []*pb.GetMessageResponse) ([]GetMessageResponse, error) {
+	out := make([]GetMessageResponse, len(messages))
+	for i, m := range messages {
+		message, err := getMessageResponseFromProto(m)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = *message
+	}
+	return out, nil
+}
+
+func getMessagesRequestFromProto(in *pb.GetMessagesRequest) (*GetMessagesRequest, error) {
+	return &GetMessagesRequest{}, nil
+}
+
+func getMessagesRequestToProto(in *GetMessagesRequest) *pb.GetMessagesRequest {
+	return &pb.GetMessagesRequest{}
+}
+
+func getMessagesResponseToProto(in *GetMessagesResponse) *pb.GetMessagesResponse {
+	return &pb.GetMessagesResponse{Messages: messagesToProto(in.Messages), Request: &pb.GetMessagesRequest{}}
+}
+
+func getMessagesResponseFromProto(in *pb.GetMessagesResponse) (*GetMessagesResponse, error) {
+	messages, err := messagesFromProto(in.Messages)
+	return &GetMessagesResponse{Messages: messages, Request: &GetMessagesRequest{}}, err
+}
+
+func searchMessagesRequestFromProto(in *pb.SearchMessagesRequest) (*SearchMessagesRequest, error) {
+	return &SearchMessagesRequest{LiteralString: in.LiteralString}, nil
+}
+
+func searchMessagesRequestToProto(in *SearchMessagesRequest) *pb.SearchMessagesRequest {
+	return &pb.SearchMessagesRequest{LiteralString: in.LiteralString}
+}
+
+func searchMessagesResponseToProto(in *SearchMessagesResponse) *pb.SearchMessagesResponse {
+	return &pb.SearchMessagesResponse{Messages: messagesToProto(in.Messages), Request: searchMessagesRequestToProto(in.Request)}
+}
+
+func searchMessagesResponseFromProto(in *pb.SearchMessagesResponse) (*SearchMessagesResponse, error) {
+	messages, err := messagesFromProto(in.Messages)
+	req, _ := searchMessagesRequestFromProto(in.Request)
+	return &SearchMessagesResponse{Messages: messages, Request: req}, err
+}
+
+// follow/upvote
+
+func followRequestFromProto(in *pb.FollowRequest) (*FollowRequest, error) {
+	followeeUserId, err := parseUUID("FolloweeUserId", in.FolloweeUserId)
+	if err != nil {
+		return nil, err
+	}
+	followerUserId, err := parseUUID("FollowerUserId", in.FollowerUserId)
+	return &FollowRequest{FolloweeUserId: followeeUserId, FollowerUserId: followerUserId}, err
+}
+
+func followRequestToProto(in *FollowRequest) *pb.FollowRequest {
+	return &pb.FollowRequest{FolloweeUserId: in.FolloweeUserId.String(), FollowerUserId: in.FollowerUserId.String()}
+}
+
+func followResponseToProto(in *FollowResponse) *pb.FollowResponse {
+	return &pb.FollowResponse{Request: followRequestToProto(in.Request)}
+}
+
+func followResponseFromProto(in *pb.FollowResponse) (*FollowResponse, error) {
+	req, err := followRequestFromProto(in.Request)
+	return &FollowResponse{Request: req}, err
+}
+
+func getFollowersRequestFromProto(in *pb.GetFollowersOfUserRequest) (*GetFollowersOfUserRequest, error) {
+	userId, err := parseUUID("UserId", in.UserId)
+	return &GetFollowersOfUserRequest{UserId: userId}, err
+}
+
+func getFollowersRequestToProto(in *GetFollowersOfUserRequest) *pb.GetFollowersOfUserRequest {
+	return &pb.GetFollowersOfUserRequest{UserId: in.UserId.String()}
+}
+
+func getFollowersResponseToProto(in *GetFollowersOfUserResponse) *pb.GetFollowersOfUserResponse {
+	return &pb.GetFollowersOfUserResponse{Followers: usersToProto(in.Followers), Request: getFollowersRequestToProto(in.Request)}
+}
+
+func getFollowersResponseFromProto(in *pb.GetFollowersOfUserResponse) (*GetFollowersOfUserResponse, error) {
+	followers, err := usersFromProto(in.Followers)
+	if err != nil {
+		return nil, err
+	}
+	req, err := getFollowersRequestFromProto(in.Request)
+	return &GetFollowersOfUserResponse{Followers: followers, Request: req}, err
+}
+
+func createUpvoteRequestFromProto(in *pb.CreateUpvoteRequest) (*CreateUpvoteRequest, error) {
+	userId, err := parseUUID("UserId", in.UserId)
+	if err != nil {
+		return nil, err
+	}
+	messageId, err := parseUUID("MessageId", in.MessageId)
+	return &CreateUpvoteRequest{UserId: userId, MessageId: messageId}, err
+}
+
+func createUpvoteRequestToProto(in *CreateUpvoteRequest) *pb.CreateUpvoteRequest {
+	return &pb.CreateUpvoteRequest{UserId: in.UserId.String(), MessageId: in.MessageId.String()}
+}
+
+func createUpvoteResponseToProto(in *CreateUpvoteResponse) *pb.CreateUpvoteResponse {
+	return &pb.CreateUpvoteResponse{UpvoteId: in.UpvoteId.String(), Request: createUpvoteRequestToProto(in.Request)}
+}
+
+func createUpvoteResponseFromProto(in *pb.CreateUpvoteResponse) (*CreateUpvoteResponse, error) {
+	upvoteId, err := parseUUID("UpvoteId", in.UpvoteId)
+	if err != nil {
+		return nil, err
+	}
+	req, err := createUpvoteRequestFromProto(in.Request)
+	return &CreateUpvoteResponse{UpvoteId: upvoteId, Request: req}, err
+}
@@ -0,0 +1,119 @@
+package webserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	pb "github.com/mattfenwick/scaling/pkg/webserver/scalingpb"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// roundTrip converts in to protobuf and back, and checks nothing was lost on the way
+func roundTrip[A, P any](t *testing.T, in *A, to func(*A) P, from func(P) (*A, error)) {
+	out, err := from(to(in))
+	if err != nil {
+		t.Errorf("unable to convert %T back from protobuf: %+v", in, err)
+	} else if !reflect.DeepEqual(in, out) {
+		t.Errorf("expected %T to round trip, sent %+v, got %+v", in, in, out)
+	}
+}
+
+func TestGRPCConversionsRoundTrip(t *testing.T) {
+	userId, otherUserId, messageId := uuid.New(), uuid.New(), uuid.New()
+	users := []GetUserResponse{{UserId: userId, Name: "abc", Email: "abc@example.com"}, {UserId: otherUserId, Name: "def"}}
+	messages := []GetMessageResponse{{MessageId: messageId, SenderUserId: userId, Content: "hello", UpvoteCount: 3}}
+
+	createUser := &CreateUserRequest{Name: "abc", Email: "abc@example.com"}
+	roundTrip(t, createUser, createUserRequestToProto, createUserRequestFromProto)
+	roundTrip(t, &CreateUserResponse{UserId: userId, Request: createUser}, createUserResponseToProto, createUserResponseFromProto)
+	roundTrip(t, &GetUserRequest{UserId: userId}, getUserRequestToProto, getUserRequestFromProto)
+	roundTrip(t, &users[0], getUserResponseToProto, getUserResponseFromProto)
+	roundTrip(t, &GetUsersResponse{Users: users, Request: &GetUsersRequest{}}, getUsersResponseToProto, getUsersResponseFromProto)
+	searchUsers := &SearchUsersRequest{NamePattern: "a", EmailPattern: "example"}
+	roundTrip(t, searchUsers, searchUsersRequestToProto, searchUsersRequestFromProto)
+	roundTrip(t, &SearchUsersResponse{Users: users, Request: searchUsers}, searchUsersResponseToProto, searchUsersResponseFromProto)
+	roundTrip(t, &GetUserMessagesResponse{UserId: userId, Messages: messages, Request: &GetUserMessagesRequest{UserId: userId}}, getUserMessagesResponseToProto, getUserMessagesResponseFromProto)
+	roundTrip(t, &GetUserTimelineResponse{UserId: userId, Messages: messages, Request: &GetUserTimelineRequest{UserId: userId}}, getUserTimelineResponseToProto, getUserTimelineResponseFromProto)
+
+	createMessage := &CreateMessageRequest{SenderUserId: userId, Content: "hello"}
+	roundTrip(t, createMessage, createMessageRequestToProto, createMessageRequestFromProto)
+	roundTrip(t, &CreateMessageResponse{MessageId: messageId, Request: createMessage}, createMessageResponseToProto, createMessageResponseFromProto)
+	roundTrip(t, &GetMessageRequest{MessageId: messageId}, getMessageRequestToProto, getMessageRequestFromProto)
+	roundTrip(t, &messages[0], getMessageResponseToProto, getMessageResponseFromProto)
+	roundTrip(t, &GetMessagesResponse{Messages: messages, Request: &GetMessagesRequest{}}, getMessagesResponseToProto, getMessagesResponseFromProto)
+	searchMessages := &SearchMessagesRequest{LiteralString: "hell"}
+	roundTrip(t, searchMessages, searchMessagesRequestToProto, searchMessagesRequestFromProto)
+	roundTrip(t, &SearchMessagesResponse{Messages: messages, Request: searchMessages}, searchMessagesResponseToProto, searchMessagesResponseFromProto)
+
+	follow := &FollowRequest{FolloweeUserId: userId, FollowerUserId: otherUserId}
+	roundTrip(t, follow, followRequestToProto, followRequestFromProto)
+	roundTrip(t, &FollowResponse{Request: follow}, followResponseToProto, followResponseFromProto)
+	roundTrip(t, &GetFollowersOfUserResponse{Followers: users, Request: &GetFollowersOfUserRequest{UserId: userId}}, getFollowersResponseToProto, getFollowersResponseFromProto)
+	upvote := &CreateUpvoteRequest{UserId: otherUserId, MessageId: messageId}
+	roundTrip(t, upvote, createUpvoteRequestToProto, createUpvoteRequestFromProto)
+	roundTrip(t, &CreateUpvoteResponse{UpvoteId: uuid.New(), Request: upvote}, createUpvoteResponseToProto, createUpvoteResponseFromProto)
+}
+
+func TestGRPCConversionsRejectBadUUIDs(t *testing.T) {
+	if _, err := getUserRequestFromProto(&pb.GetUserRequest{UserId: "not-a-uuid"}); err == nil {
+		t.Errorf("expected a bad user id to fail")
+	}
+	if _, err := createUpvoteRequestFromProto(&pb.CreateUpvoteRequest{UserId: uuid.New().String(), MessageId: ""}); err == nil {
+		t.Errorf("expected a missing message id to fail")
+	}
+	if _, err := getUsersResponseFromProto(&pb.GetUsersResponse{Users: []*pb.GetUserResponse{{UserId: "123"}}}); err == nil {
+		t.Errorf("expected a bad id in a list to fail")
+	}
+}
+
+// grpcResponder knows one user
+type grpcResponder struct {
+	Responder
+	user *GetUserResponse
+}
+
+func (r *grpcResponder) GetUser(ctx context.Context, request *GetUserRequest) (*GetUserResponse, error) {
+	if request.UserId != r.user.UserId {
+		return nil, nil
+	}
+	return r.user, nil
+}
+
+func (r *grpcResponder) GetUsers(ctx context.Context, request *GetUsersRequest) (*GetUsersResponse, error) {
+	return nil, WithStatus(http.StatusServiceUnavailable, errors.Errorf("event loop queue full"))
+}
+
+func TestGRPCMatchesHTTP(t *testing.T) {
+	responder := &grpcResponder{user: &GetUserResponse{UserId: uuid.New(), Name: "abc"}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %+v", err)
+	}
+	server := NewGRPCServer(responder, &AccessLogConfig{Disabled: true}, trace.NewNoopTracerProvider(), newTestMetrics(t))
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+	client, err := NewGRPCClient(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to create client: %+v", err)
+	}
+	defer client.Close()
+
+	user, err := client.GetUser(context.Background(), &GetUserRequest{UserId: responder.user.UserId})
+	if err != nil || !reflect.DeepEqual(user, responder.user) {
+		t.Errorf("expected %+v, got %+v and %+v", responder.user, user, err)
+	}
+	// the same status codes as http: nil responses are not found, and StatusErrors keep their status
+	if _, err := client.GetUser(context.Background(), &GetUserRequest{UserId: uuid.New()}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected not found for an unknown user, got %+v", err)
+	}
+	if _, err := client.GetUsers(context.Background(), &GetUsersRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected unavailable for a 503, got %+v", err)
+	}
+}
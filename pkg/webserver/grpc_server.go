@@ -0,0 +1,173 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	pb "github.com/mattfenwick/scaling/pkg/webserver/scalingpb"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer serves the same API as the v1 http routes, over gRPC
+type GRPCServer struct {
+	pb.UnimplementedScalingServer
+	responder Responder
+}
+
+func NewGRPCServer(responder Responder, accessLog *AccessLogConfig, tp trace.TracerProvider, metrics *telemetry.Metrics) *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		otelgrpc.UnaryServerInterceptor(otelgrpc.WithTracerProvider(tp)),
+		accessLogUnaryInterceptor(accessLog),
+		metricsUnaryInterceptor(metrics),
+	))
+	pb.RegisterScalingServer(server, &GRPCServer{responder: responder})
+	return server
+}
+
+// accessLogUnaryInterceptor is the gRPC counterpart of accessLog
+func accessLogUnaryInterceptor(config *AccessLogConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		fields := telemetry.TraceFields(ctx)
+		fields["route"] = info.FullMethod
+		if withUserId, ok := req.(interface{ GetUserId() string }); ok && withUserId.GetUserId() != "" {
+			fields["user_id"] = withUserId.GetUserId()
+		}
+		logger := logrus.WithFields(fields)
+
+		start := time.Now()
+		resp, err := handler(telemetry.WithLogger(ctx, logger), req)
+		code := status.Code(err)
+		if !config.shouldLog(code == codes.Internal || code == codes.Unavailable || code == codes.Unknown) {
+			return resp, err
+		}
+		logger.WithFields(logrus.Fields{
+			"status":      code.String(),
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		}).Info("handled request")
+		return resp, err
+	}
+}
+
+func metricsUnaryInterceptor(metrics *telemetry.Metrics) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		code := status.Code(err)
+		metrics.RecordGRPCDuration(info.FullMethod, code.String(), start)
+		if err != nil {
+			telemetry.Logger(ctx).Errorf("grpc error: %s, code %s, error %+v", info.FullMethod, code, err)
+		}
+		return resp, err
+	}
+}
+
+// grpcStatus maps the http status codes chosen by the model onto gRPC codes
+func grpcStatus(err error) error {
+	var code codes.Code
+	switch errorStatusCode(err) {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+// serve converts a request from protobuf, runs it, and converts the response back.  As with
+// the http handlers, a nil response means not found.
+func serve[In, Req, Resp, Out any](ctx context.Context, in In, from func(In) (*Req, error), f func(context.Context, *Req) (*Resp, error), to func(*Resp) Out) (Out, error) {
+	var out Out
+	req, err := from(in)
+	if err != nil {
+		return out, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp, err := f(ctx, req)
+	if err != nil {
+		return out, grpcStatus(err)
+	} else if resp == nil {
+		return out, status.Error(codes.NotFound, "not found")
+	}
+	return to(resp), nil
+}
+
+func (s *GRPCServer) CreateUser(ctx context.Context, in *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	return serve(ctx, in, createUserRequestFromProto, s.responder.CreateUser, createUserResponseToProto)
+}
+
+func (s *GRPCServer) GetUser(ctx context.Context, in *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	return serve(ctx, in, getUserRequestFromProto, s.responder.GetUser, getUserResponseToProto)
+}
+
+func (s *GRPCServer) GetUserTimeline(ctx context.Context, in *pb.GetUserTimelineRequest) (*pb.GetUserTimelineResponse, error) {
+	return serve(ctx, in, getUserTimelineRequestFromProto, s.responder.GetUserTimeline, getUserTimelineResponseToProto)
+}
+
+func (s *GRPCServer) GetUserMessages(ctx context.Context, in *pb.GetUserMessagesRequest) (*pb.GetUserMessagesResponse, error) {
+	return serve(ctx, in, getUserMessagesRequestFromProto, s.responder.GetUserMessages, getUserMessagesResponseToProto)
+}
+
+func (s *GRPCServer) GetUsers(ctx context.Context, in *pb.GetUsersRequest) (*pb.GetUsersResponse, error) {
+	return serve(ctx, in, getUsersRequestFromProto, s.responder.GetUsers, getUsersResponseToProto)
+}
+
+func (s *GRPCServer) SearchUsers(ctx context.Context, in *pb.SearchUsersRequest) (*pb.SearchUsersResponse, error) {
+	return serve(ctx, in, searchUsersRequestFromProto, s.responder.SearchUsers, searchUsersResponseToProto)
+}
+
+func (s *GRPCServer) CreateMessage(ctx context.Context, in *pb.CreateMessageRequest) (*pb.CreateMessageResponse, error) {
+	return serve(ctx, in, createMessageRequestFromProto, s.responder.CreateMessage, createMessageResponseToProto)
+}
+
+func (s *GRPCServer) GetMessage(ctx context.Context, in *pb.GetMessageRequest) (*pb.GetMessageResponse, error) {
+	return serve(ctx, in, getMessageRequestFromProto, s.responder.GetMessage, getMessageResponseToProto)
+}
+
+func (s *GRPCServer) GetMessages(ctx context.Context, in *pb.GetMessagesRequest) (*pb.GetMessagesResponse, error) {
+	return serve(ctx, in, getMessagesRequestFromProto, s.responder.GetMessages, getMessagesResponseToProto)
+}
+
+func (s *GRPCServer) SearchMessages(ctx context.Context, in *pb.SearchMessagesRequest) (*pb.SearchMessagesResponse, error) {
+	return serve(ctx, in, searchMessagesRequestFromProto, s.responder.SearchMessages, searchMessagesResponseToProto)
+}
+
+func (s *GRPCServer) Follow(ctx context.Context, in *pb.FollowRequest) (*pb.FollowResponse, error) {
+	return serve(ctx, in, followRequestFromProto, s.responder.Follow, followResponseToProto)
+}
+
+func (s *GRPCServer) GetFollowers(ctx context.Context, in *pb.GetFollowersOfUserRequest) (*pb.GetFollowersOfUserResponse, error) {
+	return serve(ctx, in, getFollowersRequestFromProto, s.responder.GetFollowers, getFollowersResponseToProto)
+}
+
+func (s *GRPCServer) CreateUpvote(ctx context.Context, in *pb.CreateUpvoteRequest) (*pb.CreateUpvoteResponse, error) {
+	return serve(ctx, in, createUpvoteRequestFromProto, s.responder.CreateUpvote, createUpvoteResponseToProto)
+}
+
+// stopGRPCServer drains in-flight calls, falling back to a hard stop when ctx expires
+func stopGRPCServer(ctx context.Context, server *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		return errors.Wrapf(ctx.Err(), "grpc server didn't drain in time")
+	}
+}
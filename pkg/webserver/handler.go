@@ -2,22 +2,22 @@ package webserver
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/mattfenwick/collections/pkg/json"
+	"github.com/mattfenwick/collections/pkg/slice"
 	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/mattfenwick/scaling/pkg/utils"
 	"github.com/pkg/errors"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
-
-	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
 )
 
 func isNil(v any) bool {
@@ -26,8 +26,35 @@ func isNil(v any) bool {
 	return v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil())
 }
 
+// StatusError lets a handler choose the http status code returned for an error
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (s *StatusError) Error() string {
+	return s.Err.Error()
+}
+
+func (s *StatusError) Unwrap() error {
+	return s.Err
+}
+
+func WithStatus(code int, err error) error {
+	return &StatusError{Code: code, Err: err}
+}
+
+func errorStatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code
+	}
+	return 500
+}
+
 func RequestHandler(r *http.Request, process func(ctx context.Context, body string, urlParams url.Values) (any, error)) (int, any, error) {
-	logrus.Debugf("handling request: %s to %s", r.Method, r.URL.Path)
+	log := telemetry.Logger(r.Context())
+	log.Debugf("handling request: %s to %s", r.Method, r.URL.Path)
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -39,78 +66,146 @@ func RequestHandler(r *http.Request, process func(ctx context.Context, body stri
 	childCtx, childCancel := context.WithTimeout(ctx, 5*time.Second)
 	defer childCancel()
 
+	values := r.URL.Query()
+	for name, value := range PathParams(ctx) {
+		values.Set(name, value)
+	}
+
 	span.AddEvent("start process")
-	response, err := process(childCtx, string(body), r.URL.Query())
+	response, err := process(childCtx, string(body), values)
 	span.AddEvent("finish process")
 
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
-		return 500, nil, err
+		return errorStatusCode(err), nil, err
 	}
 
 	return 200, response, nil
 }
 
 func Handler(maxSize int64, methodHandlers map[string]func(ctx context.Context, body string, values url.Values) (any, error)) func(w http.ResponseWriter, r *http.Request) {
+	return ListHandler(maxSize, methodHandlers, nil)
+}
+
+// ListHandler is Handler, except that requests for NDJSON are served by streamHandlers,
+// where one exists for the method
+func ListHandler(maxSize int64, methodHandlers map[string]func(ctx context.Context, body string, values url.Values) (any, error), streamHandlers map[string]StreamFunc) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var code int
 		var response any
 		var err error
 
-		start := time.Now()
-		defer func() {
-			telemetry.RecordAPIDuration(r.URL.Path, r.Method, code, start)
-		}()
+		log := telemetry.Logger(r.Context())
 
 		if r.ContentLength > maxSize {
-			logrus.Errorf("content length too large")
+			log.Errorf("content length too large")
 			http.Error(w, "content length too large", 400)
 			return
 		}
 
 		handler, ok := methodHandlers[r.Method]
 		if !ok {
-			logrus.Errorf("method %s not allowed for %s", r.Method, r.URL.Path)
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			code = http.StatusMethodNotAllowed
+			log.Errorf("method %s not allowed for %s", r.Method, r.URL.Path)
+			w.Header().Set("Allow", strings.Join(slice.Sort(maps.Keys(methodHandlers)), ", "))
+			http.Error(w, "method not allowed", code)
+			return
+		}
+
+		if stream, ok := streamHandlers[r.Method]; ok && acceptsNDJSON(r) {
+			serveStream(w, r, stream)
 			return
 		}
 
 		code, response, err = RequestHandler(r, handler)
-		logrus.Debugf("handled %s to %s: response %+v (is nil? %t) (provisional code %d), err %+v", r.Method, r.URL.Path, response, isNil(response), code, err)
+		log.Debugf("handled %s to %s: response %+v (is nil? %t) (provisional code %d), err %+v", r.Method, r.URL.Path, response, isNil(response), code, err)
 
-		logrus.Debugf("response code: %d; err? %t", code, err != nil)
+		log.Debugf("response code: %d; err? %t", code, err != nil)
 		if err != nil {
-			logrus.Errorf("http error: %s to %s, code %d, error %+v", r.Method, r.URL.Path, code, err)
+			log.Errorf("http error: %s to %s, code %d, error %+v", r.Method, r.URL.Path, code, err)
 			http.Error(w, err.Error(), code)
 			return
 		} else if isNil(response) { // response == nil {
 			code = 404
-			logrus.Errorf("http not found: %s to %s, code %d, error %+v", r.Method, r.URL.Path, code, err)
+			log.Errorf("http not found: %s to %s, code %d, error %+v", r.Method, r.URL.Path, code, err)
 			http.NotFound(w, r)
 			return
 		}
 
-		header := w.Header()
-		w.WriteHeader(code)
-		// header.Set(http.CanonicalHeaderKey("content-type"), "application/json")
-		header.Set("content-type", "application/json")
-		body := json.MustMarshalToString(response)
-		n, err := fmt.Fprint(w, body)
-		if err != nil {
-			logrus.Errorf("unable to print response body: %s", err.Error())
-		} else if n < len(body) {
-			logrus.Errorf("failed to print full body: %d / %d", n, len(body))
-		} else {
-			logrus.Debugf("wrote %d / %d bytes to response successfully", n, len(body))
+		writeResponse(w, r, code, response)
+	}
+}
+
+// writeResponse writes response as json, or as NDJSON if it's a list and the client asked
+// for that, compressed if the client accepts it and it's big enough to be worth it.  The
+// body is encoded once, into a buffer, to find its size and ETag before it's written.
+func writeResponse(w http.ResponseWriter, r *http.Request, code int, response any) {
+	log := telemetry.Logger(r.Context())
+	header := w.Header()
+
+	_, isList := response.(ListResponse)
+	ndjson := isList && acceptsNDJSON(r)
+	contentType := JSONContentType
+	if ndjson {
+		contentType = NDJSONContentType
+	}
+	if isList {
+		header.Add("Vary", "Accept")
+	}
+	header.Add("Vary", "Accept-Encoding")
+
+	body, etag, release, err := encodeBuffered(response, ndjson)
+	if err != nil {
+		log.Errorf("unable to encode response to %s to %s: %+v", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer release()
+	size := body.Len()
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if size < minCompressSize {
+		encoding = ""
+	}
+	if encoding != "" {
+		// the compressed bytes depend on the compressor, so can only promise the same content
+		etag = weakETag(etag)
+	}
+
+	if r.Method == "GET" && code == 200 {
+		header.Set("ETag", etag)
+		header.Set("Cache-Control", getCacheControl)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			log.Debugf("not modified: %s to %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
 	}
+	header.Set("Content-Type", contentType)
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	} else {
+		header.Set("Content-Length", strconv.Itoa(size))
+	}
+	w.WriteHeader(code)
+
+	// errors from here on can't change the response, which has started
+	out := compress(w, encoding)
+	if _, err := out.Write(body.Bytes()); err != nil {
+		log.Errorf("unable to write response body: %+v", err)
+	}
+	if err := out.Close(); err != nil {
+		log.Errorf("unable to finish response body: %+v", err)
+	} else {
+		log.Debugf("wrote %d byte %s response, encoding '%s'", size, contentType, encoding)
+	}
 }
 
 const (
 	// kubernetes
 	LivenessPath  = "/liveness"
 	ReadinessPath = "/readiness"
+	HealthzPath   = "/healthz"
 
 	// core model
 	UserPath         = "/user"
@@ -126,181 +221,145 @@ const (
 	// hacks
 	DumpPath  = "/dump"
 	SleepPath = "/sleep"
+
+	// AdminRoutePrefix labels the metrics of admin port routes, to tell them from api routes
+	// with the same path
+	AdminRoutePrefix = "admin_"
 )
 
-func SetupHTTPServer(responder Responder, tp trace.TracerProvider) *http.ServeMux {
+// versioned api
+const (
+	V1Prefix = "/v1"
+
+	V1UsersPath        = V1Prefix + "/users"
+	V1UsersSearchPath  = V1Prefix + "/users/search"
+	V1UserPath         = V1Prefix + "/users/{userid}"
+	V1UserTimelinePath = V1Prefix + "/users/{userid}/timeline"
+	// V1UserTimelineStreamPath serves server-sent events rather than json, so isn't in V1Routes
+	V1UserTimelineStreamPath = V1Prefix + "/users/{userid}/timeline/stream"
+	V1UserMessagesPath       = V1Prefix + "/users/{userid}/messages"
+	V1UserFollowersPath      = V1Prefix + "/users/{userid}/followers"
+	V1MessagesPath           = V1Prefix + "/messages"
+	V1MessagesSearchPath     = V1Prefix + "/messages/search"
+	V1MessagePath            = V1Prefix + "/messages/{messageid}"
+	V1MessageUpvotesPath     = V1Prefix + "/messages/{messageid}/upvotes"
+)
+
+// NewV1Router serves the versioned API, including timeline streams
+func NewV1Router(responder Responder, streamHeartbeat time.Duration, accessLog *AccessLogConfig, metrics *telemetry.Metrics) *Router {
+	v1Routes := V1Routes(responder)
+	utils.Die(ValidateRoutes(v1Routes))
+	router := NewRouter(v1Routes, metrics, accessLog)
+	router.Handle(V1UserTimelineStreamPath, instrument(metrics, accessLog, http.HandlerFunc(TimelineStreamHandler(responder, streamHeartbeat)), V1UserTimelineStreamPath))
+	return router
+}
+
+// SetupHTTPServer serves router, from NewV1Router, under V1Prefix, alongside the unversioned routes
+func SetupHTTPServer(responder Responder, router *Router, accessLog *AccessLogConfig, tp trace.TracerProvider, metrics *telemetry.Metrics) *http.ServeMux {
 	serveMux := http.NewServeMux()
 	//serveMux.Handle("/", otelhttp.NewHandler(http.HandlerFunc(handler), "handle"))
 
+	serveMux.Handle(V1Prefix+"/", router)
+	// everything else
+	serveMux.Handle("/", notFoundHandler(metrics, accessLog))
+
+	spec := GenerateOpenAPI(router.Routes)
+	serveMux.Handle(OpenAPIPath, instrument(metrics, accessLog, http.HandlerFunc(Handler(0,
+		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
+			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
+				return spec, nil
+			},
+		})), OpenAPIPath))
+
+	// unversioned routes are kept for existing clients
+
 	// kubernetes
-	serveMux.Handle(LivenessPath, otelhttp.NewHandler(http.HandlerFunc(Handler(0,
+	serveMux.Handle(LivenessPath, instrument(metrics, accessLog, http.HandlerFunc(Handler(0,
 		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
 			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
 				if responder.IsLive(ctx) {
 					return "", nil
 				} else {
-					return nil, errors.Errorf("not live")
+					return nil, WithStatus(http.StatusServiceUnavailable, errors.Errorf("not live"))
 				}
 			},
-		})), "handle liveness"))
+		})), LivenessPath))
 
-	serveMux.Handle(ReadinessPath, otelhttp.NewHandler(http.HandlerFunc(Handler(0,
+	serveMux.Handle(ReadinessPath, instrument(metrics, accessLog, http.HandlerFunc(Handler(0,
 		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
 			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
 				if responder.IsReady(ctx) {
 					return "", nil
 				} else {
-					return nil, errors.Errorf("not ready")
+					return nil, WithStatus(http.StatusServiceUnavailable, errors.Errorf("not ready"))
 				}
 			},
-		})), "handle readiness"))
+		})), ReadinessPath))
 
-	// users
-	serveMux.Handle(UserPath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
-		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"POST": func(ctx context.Context, body string, values url.Values) (any, error) {
-				user, err := json.ParseString[CreateUserRequest](body)
-				if err != nil {
-					return nil, err
-				}
-				return responder.CreateUser(ctx, user)
-			},
-			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
-				userId, err := uuid.Parse(values.Get("userid"))
-				if err != nil {
-					return nil, errors.Wrapf(err, "unable to parse uuid from '%s'", values.Get("userid"))
-				}
-				request := &GetUserRequest{
-					UserId: userId,
-				}
-				return responder.GetUser(ctx, request)
-			},
-		})), "handle user"))
+	serveMux.Handle(HealthzPath, instrument(metrics, accessLog, http.HandlerFunc(HealthzHandler(responder)), HealthzPath))
 
-	serveMux.Handle(UsersPath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
-		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
-				req := &GetUsersRequest{}
-				return responder.GetUsers(ctx, req)
-			},
-			"POST": func(ctx context.Context, body string, values url.Values) (any, error) {
-				req, err := json.ParseString[SearchUsersRequest](body)
-				if err != nil {
-					return nil, err
-				}
-				return responder.SearchUsers(ctx, req)
-			},
-		})), "handle users"))
-
-	serveMux.Handle(UserTimelinePath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
-		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"POST": func(ctx context.Context, body string, values url.Values) (any, error) {
-				req, err := json.ParseString[GetUserTimelineRequest](body)
-				if err != nil {
-					return nil, err
-				}
-				return responder.GetUserTimeline(ctx, req)
-			},
-		})), "handle user timeline"))
-
-	serveMux.Handle(UserMessagesPath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
-		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"POST": func(ctx context.Context, body string, values url.Values) (any, error) {
-				req, err := json.ParseString[GetUserMessagesRequest](body)
-				if err != nil {
-					return nil, err
-				}
-				return responder.GetUserMessages(ctx, req)
-			},
-		})), "handle user messages"))
-
-	// messages
+	// core model, routed from the `legacy:` annotations on Responder
+	legacy := NewRouter(LegacyRoutes(responder), metrics, accessLog)
+	for _, path := range legacy.Templates() {
+		serveMux.Handle(path, legacy)
+	}
 
-	serveMux.Handle(MessagePath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
+	// hacks
+	serveMux.Handle(DumpPath, instrument(metrics, accessLog, http.HandlerFunc(Handler(0,
 		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"POST": func(ctx context.Context, body string, values url.Values) (any, error) {
-				message, err := json.ParseString[CreateMessageRequest](body)
-				if err != nil {
-					return nil, err
-				}
-				return responder.CreateMessage(ctx, message)
-			},
 			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
-				messageId, err := uuid.Parse(values.Get("messageid"))
-				if err != nil {
-					return nil, errors.Wrapf(err, "unable to parse uuid from '%s'", values.Get("messageid"))
-				}
-				request := &GetMessageRequest{
-					MessageId: messageId,
-				}
-				return responder.GetMessage(ctx, request)
+				return responder.Dump(ctx)
 			},
-		})), "handle message"))
+		})), DumpPath))
 
-	serveMux.Handle(MessagesPath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
+	serveMux.Handle(SleepPath, instrument(metrics, accessLog, http.HandlerFunc(Handler(0,
 		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
 			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
-				req := &GetMessagesRequest{}
-				return responder.GetMessages(ctx, req)
-			},
-			"POST": func(ctx context.Context, body string, values url.Values) (any, error) {
-				req, err := json.ParseString[SearchMessagesRequest](body)
-				if err != nil {
-					return nil, err
-				}
-				return responder.SearchMessages(ctx, req)
+				return "", responder.Sleep(ctx, values.Get("seconds"))
 			},
-		})), "handle messages"))
+		})), SleepPath))
 
-	// follow/upvote
+	return serveMux
+}
 
-	serveMux.Handle(FollowPath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
+// SetupAdminHandlers adds operator-only handlers to the admin port's serveMux, such as the
+// manual readiness toggle, which would let anyone take a replica out of rotation if it were
+// on the api port
+func SetupAdminHandlers(serveMux *http.ServeMux, responder Responder, accessLog *AccessLogConfig, metrics *telemetry.Metrics) {
+	serveMux.Handle(ReadinessPath, instrument(metrics, accessLog, http.HandlerFunc(Handler(1000,
 		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
 			"POST": func(ctx context.Context, body string, values url.Values) (any, error) {
-				follow, err := json.ParseString[FollowRequest](body)
+				req, err := json.ParseString[SetReadinessRequest](body)
 				if err != nil {
 					return nil, err
 				}
-				return responder.Follow(ctx, follow)
+				return responder.SetReadiness(ctx, req)
 			},
-		})), "handle follow"))
-
-	serveMux.Handle(FollowersPath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
-		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
-				userId, err := uuid.Parse(values.Get("userid"))
-				if err != nil {
-					return nil, errors.Wrapf(err, "unable to parse uuid from '%s'", values.Get("userid"))
-				}
-				return responder.GetFollowers(ctx, &GetFollowersOfUserRequest{UserId: userId})
-			},
-		})), "handle followers"))
+		})), AdminRoutePrefix+ReadinessPath))
+}
 
-	serveMux.Handle(UpvotePath, otelhttp.NewHandler(http.HandlerFunc(Handler(1000,
-		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"POST": func(ctx context.Context, body string, values url.Values) (any, error) {
-				upvote, err := json.ParseString[CreateUpvoteRequest](body)
-				if err != nil {
-					return nil, err
-				}
-				return responder.CreateUpvote(ctx, upvote)
-			},
-		})), "handle create upvote"))
+// HealthzHandler reports every dependency check, with a 503 if the service isn't ready
+func HealthzHandler(responder Responder) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := 200
 
-	// hacks
-	serveMux.Handle(DumpPath, otelhttp.NewHandler(http.HandlerFunc(Handler(0,
-		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
-				return responder.Dump(ctx)
-			},
-		})), "handle dump"))
+		if r.Method != "GET" {
+			code = http.StatusMethodNotAllowed
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", code)
+			return
+		}
 
-	serveMux.Handle(SleepPath, otelhttp.NewHandler(http.HandlerFunc(Handler(0,
-		map[string]func(ctx context.Context, body string, values url.Values) (any, error){
-			"GET": func(ctx context.Context, body string, values url.Values) (any, error) {
-				return "", responder.Sleep(ctx, values.Get("seconds"))
-			},
-		})), "handle sleep"))
+		health, err := responder.Health(r.Context())
+		if err != nil {
+			code = 500
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if !health.Ready {
+			code = http.StatusServiceUnavailable
+		}
 
-	return serveMux
+		writeResponse(w, r, code, health)
+	}
 }
@@ -0,0 +1,134 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTestMetrics creates metrics which aren't registered, so that tests can make as many as
+// they like
+func newTestMetrics(t *testing.T) *telemetry.Metrics {
+	metrics, err := telemetry.NewMetrics("test", nil)
+	if err != nil {
+		t.Fatalf("unable to create metrics: %+v", err)
+	}
+	return metrics
+}
+
+// legacyResponder only answers the requests the legacy routes test makes
+type legacyResponder struct {
+	Responder
+	userId uuid.UUID
+	search *SearchUsersRequest
+}
+
+func (r *legacyResponder) GetUser(ctx context.Context, request *GetUserRequest) (*GetUserResponse, error) {
+	r.userId = request.UserId
+	return &GetUserResponse{UserId: request.UserId}, nil
+}
+
+func (r *legacyResponder) SearchUsers(ctx context.Context, request *SearchUsersRequest) (*SearchUsersResponse, error) {
+	r.search = request
+	return &SearchUsersResponse{Request: request}, nil
+}
+
+func TestLegacyRoutesBindLikeTheyUsedTo(t *testing.T) {
+	metrics := newTestMetrics(t)
+	responder := &legacyResponder{}
+	accessLog := &AccessLogConfig{Disabled: true}
+	router := NewV1Router(responder, 0, accessLog, metrics)
+	server := SetupHTTPServer(responder, router, accessLog, trace.NewNoopTracerProvider(), metrics)
+
+	userId := uuid.New()
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", UserPath+"?userid="+userId.String(), nil))
+	if recorder.Code != http.StatusOK || responder.userId != userId {
+		t.Errorf("expected the user id to be bound from the query, got %d and %s", recorder.Code, responder.userId)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", UsersPath, strings.NewReader(`{"NamePattern": "abc"}`)))
+	if recorder.Code != http.StatusOK || responder.search == nil || responder.search.NamePattern != "abc" {
+		t.Errorf("expected the search to be bound from the body, got %d and %+v", recorder.Code, responder.search)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("DELETE", UsersPath, nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected a 405 for an unrouted method, got %d", recorder.Code)
+	}
+}
+
+// streamResponder streams users, failing after `fail` of them if fail isn't negative
+type streamResponder struct {
+	Responder
+	users []*GetUserResponse
+	fail  int
+}
+
+func (r *streamResponder) GetUsers(ctx context.Context, request *GetUsersRequest) (*GetUsersResponse, error) {
+	return nil, errors.Errorf("lists for NDJSON should be streamed")
+}
+
+func (r *streamResponder) StreamUsers(ctx context.Context, request *GetUsersRequest, onItem func(*GetUserResponse) error) error {
+	for i, user := range r.users {
+		if i == r.fail {
+			return errors.Errorf("failed after %d users", i)
+		}
+		if err := onItem(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestListsAreStreamedAsNDJSON(t *testing.T) {
+	metrics := newTestMetrics(t)
+	responder := &streamResponder{users: []*GetUserResponse{{Name: "abc"}, {Name: "def"}}, fail: -1}
+	router := NewRouter(V1Routes(responder), metrics, &AccessLogConfig{Disabled: true})
+	getUsers := func() *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", V1UsersPath, nil)
+		request.Header.Set("Accept", NDJSONContentType)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := getUsers()
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != NDJSONContentType {
+		t.Fatalf("expected a 200 of NDJSON, got %d and %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	if recorder.Header().Get("Content-Length") != "" || recorder.Header().Get("ETag") != "" {
+		t.Errorf("expected no Content-Length or ETag for a stream, got %+v", recorder.Header())
+	}
+	expected := ""
+	for _, user := range responder.users {
+		line, err := json.Marshal(user)
+		if err != nil {
+			t.Fatalf("unable to marshal user: %+v", err)
+		}
+		expected += string(line) + "\n"
+	}
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("expected one user per line, got %q", body)
+	}
+
+	responder.fail = 0
+	if recorder := getUsers(); recorder.Code != http.StatusInternalServerError {
+		t.Errorf("expected a 500 for a failure before the first item, got %d", recorder.Code)
+	}
+
+	responder.fail = 1
+	if recorder := getUsers(); recorder.Code != http.StatusOK || strings.Count(recorder.Body.String(), "\n") != 1 {
+		t.Errorf("expected a failure after the first item to cut the stream short, got %d and %q", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,138 @@
+package webserver
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattfenwick/collections/pkg/slice"
+	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type HealthChecker struct {
+	Checks   []*HealthCheck
+	CacheFor time.Duration
+	Timeout  time.Duration
+
+	lock    sync.Mutex
+	results []*HealthCheckResult
+	expires time.Time
+}
+
+func NewHealthChecker(cacheFor time.Duration, checks ...*HealthCheck) *HealthChecker {
+	return &HealthChecker{
+		Checks:   checks,
+		CacheFor: cacheFor,
+		Timeout:  2 * time.Second,
+	}
+}
+
+// Run returns the most recent check results, rerunning the checks if the cached results are stale
+func (h *HealthChecker) Run(ctx context.Context) []*HealthCheckResult {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.results != nil && time.Now().Before(h.expires) {
+		return h.results
+	}
+
+	childCtx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	results := make([]*HealthCheckResult, len(h.Checks))
+	wg := sync.WaitGroup{}
+	for i, check := range h.Checks {
+		wg.Add(1)
+		go func(i int, check *HealthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := check.Check(childCtx)
+			result := &HealthCheckResult{
+				Name:                check.Name,
+				Healthy:             err == nil,
+				LatencyMilliseconds: float64(time.Since(start)) / float64(time.Millisecond),
+				CheckedAt:           start,
+			}
+			if err != nil {
+				logrus.Warnf("health check %s failed: %+v", check.Name, err)
+				result.Error = err.Error()
+			}
+			results[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+
+	h.results = results
+	h.expires = time.Now().Add(h.CacheFor)
+	return results
+}
+
+func PostgresPingCheck(db *sql.DB) *HealthCheck {
+	return &HealthCheck{
+		Name: "postgres",
+		Check: func(ctx context.Context) error {
+			return errors.Wrapf(db.PingContext(ctx), "unable to ping postgres")
+		},
+	}
+}
+
+// PostgresPoolCheck fails if every connection is in use and callers have
+// had to wait for a connection since the previous check
+func PostgresPoolCheck(db *sql.DB) *HealthCheck {
+	var lastWaitCount int64
+	return &HealthCheck{
+		Name: "postgres-pool",
+		Check: func(ctx context.Context) error {
+			stats := db.Stats()
+			waits := stats.WaitCount - lastWaitCount
+			lastWaitCount = stats.WaitCount
+			if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections && waits > 0 {
+				return errors.Errorf("pool saturated: %d/%d connections in use, %d new waits", stats.InUse, stats.MaxOpenConnections, waits)
+			}
+			return nil
+		},
+	}
+}
+
+func PostgresSchemaCheck(db *sql.DB, metrics *telemetry.Metrics) *HealthCheck {
+	return &HealthCheck{
+		Name: "postgres-schema",
+		Check: func(ctx context.Context) error {
+			missing, err := database.GetMissingTables(ctx, db, metrics)
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				return errors.Errorf("missing tables: %s", strings.Join(missing, ", "))
+			}
+			return nil
+		},
+	}
+}
+
+func EventLoopBacklogCheck(e *EventLoop) *HealthCheck {
+	return &HealthCheck{
+		Name: "event-loop",
+		Check: func(ctx context.Context) error {
+			depth, capacity := e.Depth(), e.Capacity()
+			if depth >= capacity {
+				return errors.Errorf("event loop backlog full: %d/%d", depth, capacity)
+			}
+			return nil
+		},
+	}
+}
+
+func allHealthy(results []*HealthCheckResult) bool {
+	return slice.All(func(r *HealthCheckResult) bool { return r.Healthy }, results)
+}
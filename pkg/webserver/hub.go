@@ -0,0 +1,165 @@
+package webserver
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+// Hub fans new messages out to open timeline streams.  Subscriptions are indexed by
+// sender, so publishing costs one map lookup plus one channel send per interested stream.
+//
+// Sends never block: a stream which falls a full buffer behind misses events, rather than
+// holding up the publisher and every other stream.
+type Hub struct {
+	bufferSize int
+	metrics    *telemetry.Metrics
+
+	mu           sync.Mutex
+	closed       bool
+	count        int
+	bySender     map[uuid.UUID]map[*Subscription]bool
+	bySubscriber map[uuid.UUID]map[*Subscription]bool
+}
+
+// Subscription is one open timeline stream.  Events is closed when the subscription
+// ends, either by Close or by the hub shutting down.
+type Subscription struct {
+	UserId uuid.UUID
+	Events chan *TimelineEvent
+
+	hub     *Hub
+	senders map[uuid.UUID]bool
+}
+
+func NewHub(bufferSize int, metrics *telemetry.Metrics) *Hub {
+	return &Hub{
+		bufferSize:   bufferSize,
+		metrics:      metrics,
+		bySender:     map[uuid.UUID]map[*Subscription]bool{},
+		bySubscriber: map[uuid.UUID]map[*Subscription]bool{},
+	}
+}
+
+// Subscribe opens a stream for userId, receiving messages from senders.  If the hub has
+// already been closed, the subscription's channel is closed immediately.
+func (h *Hub) Subscribe(userId uuid.UUID, senders []uuid.UUID) *Subscription {
+	sub := &Subscription{
+		UserId:  userId,
+		Events:  make(chan *TimelineEvent, h.bufferSize),
+		hub:     h,
+		senders: map[uuid.UUID]bool{},
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(sub.Events)
+		return sub
+	}
+	addToIndex(h.bySubscriber, userId, sub)
+	for _, sender := range senders {
+		sub.senders[sender] = true
+		addToIndex(h.bySender, sender, sub)
+	}
+	h.count++
+	h.metrics.SetStreamConnections(h.count)
+	return sub
+}
+
+// AddSender adds a sender to every open stream of subscriberId, so that a new follow
+// takes effect without the client reconnecting
+func (h *Hub) AddSender(subscriberId uuid.UUID, sender uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.bySubscriber[subscriberId] {
+		if !sub.senders[sender] {
+			sub.senders[sender] = true
+			addToIndex(h.bySender, sender, sub)
+		}
+	}
+}
+
+func (h *Hub) Publish(event *TimelineEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.bySender[event.SenderUserId] {
+		select {
+		case sub.Events <- event:
+			h.metrics.RecordStreamEvent("delivered")
+		default:
+			h.metrics.RecordStreamEvent("dropped")
+			logrus.Debugf("dropping event %s for slow stream of user %s", event.MessageId, sub.UserId)
+		}
+	}
+}
+
+// Close ends the subscription; it's safe to call more than once
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+func (h *Hub) unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !removeFromIndex(h.bySubscriber, sub.UserId, sub) {
+		return
+	}
+	for sender := range sub.senders {
+		removeFromIndex(h.bySender, sender, sub)
+	}
+	close(sub.Events)
+	h.count--
+	h.metrics.SetStreamConnections(h.count)
+}
+
+// Close ends every open stream, and rejects new ones.  Long-lived streams would otherwise
+// hold up the http server's graceful shutdown until its timeout.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, sub := range h.subscriptionsLocked() {
+		close(sub.Events)
+	}
+	h.bySender = map[uuid.UUID]map[*Subscription]bool{}
+	h.bySubscriber = map[uuid.UUID]map[*Subscription]bool{}
+	h.count = 0
+	h.metrics.SetStreamConnections(0)
+}
+
+func (h *Hub) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Hub) subscriptionsLocked() []*Subscription {
+	var out []*Subscription
+	for _, subs := range h.bySubscriber {
+		for sub := range subs {
+			out = append(out, sub)
+		}
+	}
+	return out
+}
+
+func addToIndex(index map[uuid.UUID]map[*Subscription]bool, key uuid.UUID, sub *Subscription) {
+	if _, ok := index[key]; !ok {
+		index[key] = map[*Subscription]bool{}
+	}
+	index[key][sub] = true
+}
+
+func removeFromIndex(index map[uuid.UUID]map[*Subscription]bool, key uuid.UUID, sub *Subscription) bool {
+	if !index[key][sub] {
+		return false
+	}
+	delete(index[key], sub)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package webserver
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// UnmatchedRoute labels requests to paths which don't match any route, so that scans and
+// typos don't each get their own metrics
+const UnmatchedRoute = "unmatched"
+
+// AccessLogConfig controls the line logged for each request, over http or gRPC
+type AccessLogConfig struct {
+	// Disabled turns the access log off
+	Disabled bool
+	// SampleRate is the fraction of requests which are logged, up to 1, the default.  Requests
+	// which fail with a server error are always logged, unless the access log is Disabled.
+	SampleRate float64
+}
+
+func (c *AccessLogConfig) SampleRateOrDefault() float64 {
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		return 1
+	}
+	return c.SampleRate
+}
+
+func (c *AccessLogConfig) shouldLog(serverError bool) bool {
+	return c.sampled(serverError, rand.Float64())
+}
+
+// sampled decides whether to log a request, given sample, which is uniformly random in [0, 1)
+func (c *AccessLogConfig) sampled(serverError bool, sample float64) bool {
+	if c.Disabled {
+		return false
+	}
+	return serverError || sample < c.SampleRateOrDefault()
+}
+
+func notFoundHandler(metrics *telemetry.Metrics, accessLogConfig *AccessLogConfig) http.Handler {
+	return instrument(metrics, accessLogConfig, http.NotFoundHandler(), UnmatchedRoute)
+}
+
+// instrument wraps the handler of route, a path or path template, with a span, a
+// per-request logger, an access log line and metrics
+func instrument(metrics *telemetry.Metrics, accessLogConfig *AccessLogConfig, handler http.Handler, route string) http.Handler {
+	return otelhttp.NewHandler(accessLog(metrics, accessLogConfig, handler, route), "handle "+route)
+}
+
+// accessLog runs inside the otelhttp span, so that the request's logger, which handlers
+// get from telemetry.Logger, carries the trace and span ids
+func accessLog(metrics *telemetry.Metrics, config *AccessLogConfig, next http.Handler, route string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.AddAPIInFlight(route, 1)
+		defer metrics.AddAPIInFlight(route, -1)
+
+		fields := telemetry.TraceFields(r.Context())
+		fields["route"] = route
+		fields["method"] = r.Method
+		if userId := requestUserId(r); userId != "" {
+			fields["user_id"] = userId
+		}
+		logger := logrus.WithFields(fields)
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		// the wrapped writer keeps the original's optional interfaces, such as http.Flusher
+		captured := httpsnoop.CaptureMetrics(next, w, r.WithContext(telemetry.WithLogger(r.Context(), logger)))
+		metrics.RecordAPIRequest(route, r.Method, captured.Code, captured.Duration, body.count, captured.Written)
+
+		if !config.shouldLog(captured.Code >= 500) {
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"path":        r.URL.Path,
+			"status":      captured.Code,
+			"bytes_in":    body.count,
+			"bytes":       captured.Written,
+			"duration_ms": float64(captured.Duration.Microseconds()) / 1000,
+			"remote_addr": r.RemoteAddr,
+		}).Info("handled request")
+	})
+}
+
+// requestUserId finds the user a request is about, from the v1 path or the legacy query
+func requestUserId(r *http.Request) string {
+	if userId, ok := PathParams(r.Context())["userid"]; ok {
+		return userId
+	}
+	return r.URL.Query().Get("userid")
+}
+
+// countingReader counts the bytes of a request body which the handler actually reads
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,64 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func accessLogLines(t *testing.T, config *AccessLogConfig, status int, requests int) int {
+	metrics := newTestMetrics(t)
+	handler := instrument(metrics, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}), "/test")
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	for i := 0; i < requests; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	}
+	lines := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "handled request" {
+			lines++
+		}
+	}
+	return lines
+}
+
+func TestAccessLog(t *testing.T) {
+	if lines := accessLogLines(t, &AccessLogConfig{}, http.StatusOK, 10); lines != 10 {
+		t.Errorf("expected every request to be logged by default, got %d of 10", lines)
+	}
+	if lines := accessLogLines(t, &AccessLogConfig{Disabled: true}, http.StatusInternalServerError, 10); lines != 0 {
+		t.Errorf("expected nothing to be logged when disabled, got %d", lines)
+	}
+	if lines := accessLogLines(t, &AccessLogConfig{SampleRate: 0.25}, http.StatusServiceUnavailable, 10); lines != 10 {
+		t.Errorf("expected server errors to always be logged, got %d of 10", lines)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	sampled := &AccessLogConfig{SampleRate: 0.25}
+	for _, testCase := range []struct {
+		config      *AccessLogConfig
+		serverError bool
+		sample      float64
+		expected    bool
+	}{
+		{config: sampled, sample: 0, expected: true},
+		{config: sampled, sample: 0.2, expected: true},
+		{config: sampled, sample: 0.25, expected: false},
+		{config: sampled, sample: 0.9, expected: false},
+		{config: sampled, serverError: true, sample: 0.9, expected: true},
+		{config: &AccessLogConfig{}, sample: 0.999, expected: true},
+		{config: &AccessLogConfig{SampleRate: 2}, sample: 0.999, expected: true},
+		{config: &AccessLogConfig{Disabled: true}, serverError: true, sample: 0, expected: false},
+	} {
+		if actual := testCase.config.sampled(testCase.serverError, testCase.sample); actual != testCase.expected {
+			t.Errorf("%+v, server error %t, sample %f: expected %t, got %t", testCase.config, testCase.serverError, testCase.sample, testCase.expected, actual)
+		}
+	}
+}
@@ -3,87 +3,259 @@ package webserver
 import (
 	"context"
 	"database/sql"
+	"runtime"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/mattfenwick/collections/pkg/json"
+	"github.com/google/uuid"
 	"github.com/mattfenwick/collections/pkg/slice"
 	"github.com/mattfenwick/scaling/pkg/database"
 	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/mattfenwick/scaling/pkg/utils"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 )
 
-type Action struct {
-	Name string
-	F    func() error
-}
-
 type Model struct {
-	Live    bool
-	Ready   bool
-	db      *sql.DB
-	tp      trace.TracerProvider
-	tracer  trace.Tracer
-	actions chan *Action
+	live      atomic.Bool
+	ready     atomic.Bool
+	db        *sql.DB
+	tp        trace.TracerProvider
+	tracer    trace.Tracer
+	metrics   *telemetry.Metrics
+	eventLoop *EventLoop
+	health    *HealthChecker
+	hub       *Hub
+	listener  *database.Listener
+
+	users     *Cache[uuid.UUID, *database.User]
+	messages  *Cache[uuid.UUID, *database.Message]
+	timelines *Cache[uuid.UUID, []*database.TimelineMessage]
+	followers *Cache[uuid.UUID, []*database.User]
+
+	effectiveConfig any
+	startedAt       time.Time
 }
 
-func NewModel(ctx context.Context, tp trace.TracerProvider, db *sql.DB) *Model {
-	actions := make(chan *Action, 1)
+// NewModel takes writes from listener, if given, so that every replica sees every write.
+// Otherwise, only this process's writes are seen.
+func NewModel(ctx context.Context, config *Config, effectiveConfig any, tp trace.TracerProvider, metrics *telemetry.Metrics, db *sql.DB, listener *database.Listener) *Model {
 	m := &Model{
-		Live:    true,
-		Ready:   true,
-		db:      db,
-		tp:      tp,
-		tracer:  tp.Tracer("model"),
-		actions: actions,
-	}
-	go func() {
-		for {
-			//logrus.Debugf("state: %s", json.MustMarshalToString(m))
-			select {
-			case a := <-actions:
-				start := time.Now()
-				err := a.F()
-				telemetry.RecordEventLoopDuration(a.Name, err, start)
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
+		db:              db,
+		tp:              tp,
+		tracer:          tp.Tracer("model"),
+		metrics:         metrics,
+		eventLoop:       NewEventLoop(ctx, config.EventLoopQueueSizeOrDefault(), config.EventLoopWorkersOrDefault(), config.EventLoopActionTimeout(), metrics),
+		hub:             NewHub(config.StreamBufferSizeOrDefault(), metrics),
+		listener:        listener,
+		users:           NewCache[uuid.UUID, *database.User]("users", &config.Cache, metrics),
+		messages:        NewCache[uuid.UUID, *database.Message]("messages", &config.Cache, metrics),
+		timelines:       NewCache[uuid.UUID, []*database.TimelineMessage]("timelines", &config.Cache, metrics),
+		followers:       NewCache[uuid.UUID, []*database.User]("followers", &config.Cache, metrics),
+		effectiveConfig: effectiveConfig,
+		startedAt:       time.Now(),
+	}
+	m.live.Store(true)
+	m.ready.Store(true)
+	m.health = NewHealthChecker(
+		config.HealthCacheDuration(),
+		PostgresPingCheck(db),
+		PostgresPoolCheck(db),
+		PostgresSchemaCheck(db, metrics),
+		EventLoopBacklogCheck(m.eventLoop))
+	if listener != nil {
+		listener.Subscribe(m.handleEvent)
+	}
 	return m
 }
 
-func (m *Model) Dump(ctx context.Context) (string, error) {
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	var out string
+// handleEvent applies writes, from any replica, to this replica's in-process state.  This
+// replica's own writes have already invalidated its caches, but doing so again is harmless.
+func (m *Model) handleEvent(event *database.Event) {
+	switch event.Kind {
+	case database.EventKindUser:
+		user, err := event.User()
+		if err != nil {
+			logrus.Errorf("unable to handle event: %+v", err)
+			return
+		}
+		m.users.Invalidate(user.UserId)
+	case database.EventKindMessage:
+		message, err := event.Message()
+		if err != nil {
+			logrus.Errorf("unable to handle event: %+v", err)
+			return
+		}
+		m.invalidateMessage(message)
+		m.publishMessage(message)
+	case database.EventKindFollower:
+		follower, err := event.Follower()
+		if err != nil {
+			logrus.Errorf("unable to handle event: %+v", err)
+			return
+		}
+		m.invalidateFollower(follower)
+		m.addFollower(follower)
+	case database.EventKindUpvote:
+		upvote, err := event.Upvote()
+		if err != nil {
+			logrus.Errorf("unable to handle event: %+v", err)
+			return
+		}
+		m.invalidateUpvote(upvote)
+	}
+}
+
+// invalidateMessage drops the message, in case it was cached as missing, and the timelines
+// it belongs in
+func (m *Model) invalidateMessage(message *database.Message) {
+	m.messages.Invalidate(message.MessageId)
+	m.timelines.InvalidateTagged(message.SenderUserId)
+}
+
+// invalidateFollower drops the followee's timeline, which now includes the follower's
+// messages, and follower list
+func (m *Model) invalidateFollower(follower *database.Follower) {
+	m.timelines.Invalidate(follower.FolloweeUserId)
+	m.followers.Invalidate(follower.FolloweeUserId)
+}
+
+// invalidateUpvote drops the timelines showing the upvoted message's count, which are
+// tagged by the ids of the messages they show
+func (m *Model) invalidateUpvote(upvote *database.Upvote) {
+	m.timelines.InvalidateTagged(upvote.MessageId)
+}
+
+func (m *Model) publishMessage(message *database.Message) {
+	m.hub.Publish(&TimelineEvent{
+		MessageId:    message.MessageId,
+		SenderUserId: message.SenderUserId,
+		Content:      message.Content,
+		CreatedAt:    message.CreatedAt,
+	})
+}
+
+// addFollower mirrors GetUserTimeline: the followee's timeline includes the follower's messages
+func (m *Model) addFollower(follower *database.Follower) {
+	m.hub.AddSender(follower.FolloweeUserId, follower.FollowerUserId)
+}
 
-	action := func() error {
-		out = json.MustMarshalToString([]string{"TODO"})
-		wg.Done()
+// Stop drains the event loop
+func (m *Model) Stop(ctx context.Context) error {
+	return m.eventLoop.Stop(ctx)
+}
+
+// CloseStreams ends every open timeline stream, and refuses new ones
+func (m *Model) CloseStreams() {
+	m.hub.Close()
+}
+
+func (m *Model) Dump(ctx context.Context) (_ *DumpResponse, err error) {
+	ctx, end := m.startSpan(ctx, "Dump")
+	defer end(&err)
+
+	// read from a single snapshot, so that table sizes and webhook deliveries agree
+	var tableSizes map[string]int
+	var webhooks map[string]map[string]int
+	snapshot := &database.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	err = database.WithTx(ctx, m.db, m.metrics, snapshot, func(tx *sql.Tx) error {
+		var err error
+		if tableSizes, err = database.GetTableSizes(ctx, tx, m.metrics); err != nil {
+			return err
+		}
+		webhooks, err = database.GetDeliveryCounts(ctx, tx, m.metrics)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := &DumpResponse{
+		Version:       utils.VersionInfo(),
+		Config:        m.effectiveConfig,
+		StartedAt:     m.startedAt,
+		UptimeSeconds: time.Since(m.startedAt).Seconds(),
+		Goroutines:    runtime.NumGoroutine(),
+		DBStats:       m.db.Stats(),
+		TableSizes:    tableSizes,
+		Streams:       m.hub.Count(),
+		Webhooks:      webhooks,
+		SLOs:          m.metrics.SLOStatuses(),
+	}
+
+	err = m.eventLoop.Do(ctx, "dump", func(ctx context.Context) error {
+		out.EventLoop = &EventLoopDump{
+			QueueDepth:    m.eventLoop.Depth(),
+			QueueCapacity: m.eventLoop.Capacity(),
+			Workers:       m.eventLoop.Workers(),
+			RecentActions: m.eventLoop.RecentActions(),
+		}
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return out, nil
+}
 
-	select {
-	case m.actions <- &Action{F: action, Name: "dump"}:
-		wg.Wait()
-		return out, nil
-	default:
-		return "", errors.Errorf("service unavailable")
+// startSpan starts the span of one of the model's methods.  Defer the returned func with a
+// pointer to the method's named error, so that failures are recorded on the span.
+func (m *Model) startSpan(ctx context.Context, name string) (context.Context, func(err *error)) {
+	ctx, span := m.tracer.Start(ctx, name)
+	return ctx, func(err *error) {
+		if *err != nil {
+			span.RecordError(*err)
+			// requests which the client got wrong, such as for missing users, aren't failures
+			if errorStatusCode(*err) >= 500 {
+				span.SetStatus(codes.Error, (*err).Error())
+			}
+		}
+		span.End()
 	}
 }
 
 func (m *Model) IsLive(ctx context.Context) bool {
-	return m.Live
+	return m.live.Load()
 }
 
+// IsReady requires both the manual readiness flag and every dependency check to be healthy
 func (m *Model) IsReady(ctx context.Context) bool {
-	return m.Ready
+	return m.ready.Load() && allHealthy(m.health.Run(ctx))
+}
+
+func (m *Model) SetReady(ready bool) {
+	logrus.Infof("setting readiness to %t", ready)
+	m.ready.Store(ready)
+}
+
+func (m *Model) SetReadiness(ctx context.Context, req *SetReadinessRequest) (_ *SetReadinessResponse, err error) {
+	_, end := m.startSpan(ctx, "SetReadiness")
+	defer end(&err)
+
+	m.SetReady(req.Ready)
+	return &SetReadinessResponse{Request: req}, nil
+}
+
+func (m *Model) Health(ctx context.Context) (_ *HealthResponse, err error) {
+	ctx, end := m.startSpan(ctx, "Health")
+	defer end(&err)
+
+	checks := m.health.Run(ctx)
+	manualReady := m.ready.Load()
+	return &HealthResponse{
+		Live:        m.live.Load(),
+		Ready:       manualReady && allHealthy(checks),
+		ManualReady: manualReady,
+		Checks:      checks,
+	}, nil
 }
 
-func (m *Model) Sleep(ctx context.Context, milliseconds string) error {
+func (m *Model) Sleep(ctx context.Context, milliseconds string) (err error) {
+	ctx, end := m.startSpan(ctx, "Sleep")
+	defer end(&err)
+
 	ms, err := strconv.Atoi(milliseconds)
 	if err != nil {
 		return errors.Wrapf(err, "unable to parse milliseconds: '%s'", milliseconds)
@@ -92,36 +264,52 @@ func (m *Model) Sleep(ctx context.Context, milliseconds string) error {
 		return errors.Errorf("milliseconds '%d' out of range", ms)
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-
-	action := func() error {
-		time.Sleep(time.Duration(ms) * time.Millisecond)
-		return nil
-	}
+	return m.eventLoop.Do(ctx, "sleep", func(ctx context.Context) error {
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
 
-	select {
-	case m.actions <- &Action{F: action, Name: "sleep"}:
-		wg.Wait()
-		return nil
-	default:
-		return errors.Errorf("service unavailable")
-	}
+// insertWithOutbox runs insert, and records the write in the outbox for webhook delivery,
+// in a single transaction
+func (m *Model) insertWithOutbox(ctx context.Context, kind string, record any, insert func(tx *sql.Tx) error) error {
+	return database.WithTx(ctx, m.db, m.metrics, nil, func(tx *sql.Tx) error {
+		if err := insert(tx); err != nil {
+			return err
+		}
+		return database.InsertOutboxEvent(ctx, tx, m.metrics, kind, record)
+	})
 }
 
 // users
 
-func (m *Model) CreateUser(ctx context.Context, req *CreateUserRequest) (*CreateUserResponse, error) {
+func (m *Model) CreateUser(ctx context.Context, req *CreateUserRequest) (_ *CreateUserResponse, err error) {
+	ctx, end := m.startSpan(ctx, "CreateUser")
+	defer end(&err)
+
 	newUser := database.NewUser(req.Name, req.Email)
-	err := database.InsertUser(ctx, m.db, newUser)
+	err = m.insertWithOutbox(ctx, database.EventKindUser, newUser, func(tx *sql.Tx) error {
+		return database.InsertUser(ctx, tx, m.metrics, newUser)
+	})
 	if err != nil {
 		return nil, err
 	}
+	m.users.Invalidate(newUser.UserId)
 	return &CreateUserResponse{Request: req, UserId: newUser.UserId}, nil
 }
 
-func (m *Model) GetUser(ctx context.Context, req *GetUserRequest) (*GetUserResponse, error) {
-	user, err := database.GetUser(ctx, m.db, req.UserId)
+func (m *Model) GetUser(ctx context.Context, req *GetUserRequest) (_ *GetUserResponse, err error) {
+	ctx, end := m.startSpan(ctx, "GetUser")
+	defer end(&err)
+
+	user, err := m.users.Get(ctx, req.UserId, func(ctx context.Context) (*database.User, []uuid.UUID, error) {
+		user, err := database.GetUser(ctx, m.db, m.metrics, req.UserId)
+		return user, nil, err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -140,22 +328,48 @@ func mapUser(d *database.User) GetUserResponse {
 	}
 }
 
-func (m *Model) GetUsers(ctx context.Context, req *GetUsersRequest) (*GetUsersResponse, error) {
-	users, err := database.GetUsers(ctx, m.db)
+func (m *Model) GetUsers(ctx context.Context, req *GetUsersRequest) (_ *GetUsersResponse, err error) {
+	ctx, end := m.startSpan(ctx, "GetUsers")
+	defer end(&err)
+
+	users, err := database.GetUsers(ctx, m.db, m.metrics)
 	if err != nil {
 		return nil, err
 	}
 	return &GetUsersResponse{Users: slice.Map(mapUser, users), Request: req}, nil
 }
 
-func (m *Model) SearchUsers(ctx context.Context, req *SearchUsersRequest) (*SearchUsersResponse, error) {
-	users, err := database.SearchUsers(ctx, m.db, req.NamePattern, req.EmailPattern)
+func (m *Model) StreamUsers(ctx context.Context, req *GetUsersRequest, onItem func(*GetUserResponse) error) (err error) {
+	ctx, end := m.startSpan(ctx, "StreamUsers")
+	defer end(&err)
+
+	return database.StreamUsers(ctx, m.db, m.metrics, func(user *database.User) error {
+		mappedUser := mapUser(user)
+		return onItem(&mappedUser)
+	})
+}
+
+func (m *Model) SearchUsers(ctx context.Context, req *SearchUsersRequest) (_ *SearchUsersResponse, err error) {
+	ctx, end := m.startSpan(ctx, "SearchUsers")
+	defer end(&err)
+
+	users, err := database.SearchUsers(ctx, m.db, m.metrics, req.NamePattern, req.EmailPattern)
 	if err != nil {
 		return nil, err
 	}
 	return &SearchUsersResponse{Users: slice.Map(mapUser, users), Request: req}, nil
 }
 
+func (m *Model) StreamSearchUsers(ctx context.Context, req *SearchUsersRequest, onItem func(*GetUserResponse) error) (err error) {
+	ctx, end := m.startSpan(ctx, "StreamSearchUsers")
+	defer end(&err)
+
+	return database.StreamSearchUsers(ctx, m.db, m.metrics, req.NamePattern, req.EmailPattern, func(user *database.User) error {
+		mappedUser := mapUser(user)
+		return onItem(&mappedUser)
+	})
+}
+
 func mapTimelineMessage(m *database.TimelineMessage) GetMessageResponse {
 	return GetMessageResponse{
 		MessageId:    m.MessageId,
@@ -165,30 +379,105 @@ func mapTimelineMessage(m *database.TimelineMessage) GetMessageResponse {
 	}
 }
 
-func (m *Model) GetUserTimeline(ctx context.Context, req *GetUserTimelineRequest) (*GetUserTimelineResponse, error) {
-	messages, err := database.GetUserTimeline(ctx, m.db, req.UserId)
+func (m *Model) GetUserTimeline(ctx context.Context, req *GetUserTimelineRequest) (_ *GetUserTimelineResponse, err error) {
+	ctx, end := m.startSpan(ctx, "GetUserTimeline")
+	defer end(&err)
+
+	messages, err := m.getUserTimeline(ctx, req.UserId)
 	if err != nil {
 		return nil, err
 	}
 	return &GetUserTimelineResponse{UserId: req.UserId, Messages: slice.Map(mapTimelineMessage, messages), Request: req}, nil
 }
 
-func (m *Model) GetUserMessages(ctx context.Context, req *GetUserMessagesRequest) (*GetUserMessagesResponse, error) {
-	messages, err := database.GetUserMessages(ctx, m.db, req.UserId)
+// StreamUserTimeline streams the cached timeline, which is already held whole
+func (m *Model) StreamUserTimeline(ctx context.Context, req *GetUserTimelineRequest, onItem func(*GetMessageResponse) error) (err error) {
+	ctx, end := m.startSpan(ctx, "StreamUserTimeline")
+	defer end(&err)
+
+	messages, err := m.getUserTimeline(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		mappedMessage := mapTimelineMessage(message)
+		if err := onItem(&mappedMessage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Model) getUserTimeline(ctx context.Context, userId uuid.UUID) ([]*database.TimelineMessage, error) {
+	return m.timelines.Get(ctx, userId, func(ctx context.Context) ([]*database.TimelineMessage, []uuid.UUID, error) {
+		messages, err := database.GetUserTimeline(ctx, m.db, m.metrics, userId)
+		if err != nil || m.timelines == nil {
+			return messages, nil, err
+		}
+		// tagged by sender, including those without any messages yet, for new messages, and by
+		// message, for upvotes
+		senders, err := database.GetTimelineSenders(ctx, m.db, m.metrics, userId)
+		if err != nil {
+			return nil, nil, err
+		}
+		tags := senders
+		for _, message := range messages {
+			tags = append(tags, message.MessageId)
+		}
+		return messages, tags, nil
+	})
+}
+
+// SubscribeTimeline streams new messages from the same senders as GetUserTimeline
+func (m *Model) SubscribeTimeline(ctx context.Context, userId uuid.UUID) (_ *Subscription, err error) {
+	ctx, end := m.startSpan(ctx, "SubscribeTimeline")
+	defer end(&err)
+
+	senders, err := database.GetTimelineSenders(ctx, m.db, m.metrics, userId)
+	if err != nil {
+		return nil, err
+	}
+	return m.hub.Subscribe(userId, senders), nil
+}
+
+func (m *Model) GetUserMessages(ctx context.Context, req *GetUserMessagesRequest) (_ *GetUserMessagesResponse, err error) {
+	ctx, end := m.startSpan(ctx, "GetUserMessages")
+	defer end(&err)
+
+	messages, err := database.GetUserMessages(ctx, m.db, m.metrics, req.UserId)
 	if err != nil {
 		return nil, err
 	}
 	return &GetUserMessagesResponse{UserId: req.UserId, Messages: slice.Map(mapTimelineMessage, messages), Request: req}, nil
 }
 
+func (m *Model) StreamUserMessages(ctx context.Context, req *GetUserMessagesRequest, onItem func(*GetMessageResponse) error) (err error) {
+	ctx, end := m.startSpan(ctx, "StreamUserMessages")
+	defer end(&err)
+
+	return database.StreamUserMessages(ctx, m.db, m.metrics, req.UserId, func(message *database.TimelineMessage) error {
+		mappedMessage := mapTimelineMessage(message)
+		return onItem(&mappedMessage)
+	})
+}
+
 // messages
 
-func (m *Model) CreateMessage(ctx context.Context, req *CreateMessageRequest) (*CreateMessageResponse, error) {
+func (m *Model) CreateMessage(ctx context.Context, req *CreateMessageRequest) (_ *CreateMessageResponse, err error) {
+	ctx, end := m.startSpan(ctx, "CreateMessage")
+	defer end(&err)
+
 	newMessage := database.NewMessage(req.SenderUserId, req.Content)
-	err := database.InsertMessage(ctx, m.db, newMessage)
+	err = m.insertWithOutbox(ctx, database.EventKindMessage, newMessage, func(tx *sql.Tx) error {
+		return database.InsertMessage(ctx, tx, m.metrics, newMessage)
+	})
 	if err != nil {
 		return nil, err
 	}
+	m.invalidateMessage(newMessage)
+	if m.listener == nil {
+		m.publishMessage(newMessage)
+	}
 	return &CreateMessageResponse{MessageId: newMessage.MessageId, Request: req}, nil
 }
 
@@ -200,8 +489,11 @@ func mapMessage(m *database.Message) GetMessageResponse {
 	}
 }
 
-func (m *Model) GetMessage(ctx context.Context, req *GetMessageRequest) (*GetMessageResponse, error) {
-	message, err := database.GetMessage(ctx, m.db, req.MessageId)
+func (m *Model) GetMessage(ctx context.Context, req *GetMessageRequest) (_ *GetMessageResponse, err error) {
+	ctx, end := m.startSpan(ctx, "GetMessage")
+	defer end(&err)
+
+	message, err := m.getMessage(ctx, req.MessageId)
 	if err != nil {
 		return nil, err
 	}
@@ -212,46 +504,144 @@ func (m *Model) GetMessage(ctx context.Context, req *GetMessageRequest) (*GetMes
 	return &mappedMessage, nil
 }
 
-func (m *Model) GetMessages(ctx context.Context, req *GetMessagesRequest) (*GetMessagesResponse, error) {
-	messages, err := database.GetMessages(ctx, m.db)
+func (m *Model) getMessage(ctx context.Context, messageId uuid.UUID) (*database.Message, error) {
+	return m.messages.Get(ctx, messageId, func(ctx context.Context) (*database.Message, []uuid.UUID, error) {
+		message, err := database.GetMessage(ctx, m.db, m.metrics, messageId)
+		return message, nil, err
+	})
+}
+
+func (m *Model) GetMessages(ctx context.Context, req *GetMessagesRequest) (_ *GetMessagesResponse, err error) {
+	ctx, end := m.startSpan(ctx, "GetMessages")
+	defer end(&err)
+
+	messages, err := database.GetMessages(ctx, m.db, m.metrics)
 	if err != nil {
 		return nil, err
 	}
 	return &GetMessagesResponse{Messages: slice.Map(mapMessage, messages), Request: req}, nil
 }
 
-func (m *Model) SearchMessages(ctx context.Context, req *SearchMessagesRequest) (*SearchMessagesResponse, error) {
-	messages, err := database.SearchMessages(ctx, m.db, req.LiteralString)
+func (m *Model) StreamMessages(ctx context.Context, req *GetMessagesRequest, onItem func(*GetMessageResponse) error) (err error) {
+	ctx, end := m.startSpan(ctx, "StreamMessages")
+	defer end(&err)
+
+	return database.StreamMessages(ctx, m.db, m.metrics, func(message *database.Message) error {
+		mappedMessage := mapMessage(message)
+		return onItem(&mappedMessage)
+	})
+}
+
+func (m *Model) SearchMessages(ctx context.Context, req *SearchMessagesRequest) (_ *SearchMessagesResponse, err error) {
+	ctx, end := m.startSpan(ctx, "SearchMessages")
+	defer end(&err)
+
+	messages, err := database.SearchMessages(ctx, m.db, m.metrics, req.LiteralString)
 	if err != nil {
 		return nil, err
 	}
 	return &SearchMessagesResponse{Messages: slice.Map(mapMessage, messages), Request: req}, nil
 }
 
+func (m *Model) StreamSearchMessages(ctx context.Context, req *SearchMessagesRequest, onItem func(*GetMessageResponse) error) (err error) {
+	ctx, end := m.startSpan(ctx, "StreamSearchMessages")
+	defer end(&err)
+
+	return database.StreamSearchMessages(ctx, m.db, m.metrics, req.LiteralString, func(message *database.Message) error {
+		mappedMessage := mapMessage(message)
+		return onItem(&mappedMessage)
+	})
+}
+
 // follow/upvote
 
-func (m *Model) Follow(ctx context.Context, req *FollowRequest) (*FollowResponse, error) {
+func (m *Model) Follow(ctx context.Context, req *FollowRequest) (_ *FollowResponse, err error) {
+	ctx, end := m.startSpan(ctx, "Follow")
+	defer end(&err)
+
 	newFollower := database.NewFollower(req.FolloweeUserId, req.FollowerUserId)
-	err := database.InsertFollower(ctx, m.db, newFollower)
+	err = m.insertWithOutbox(ctx, database.EventKindFollower, newFollower, func(tx *sql.Tx) error {
+		return database.InsertFollower(ctx, tx, m.metrics, newFollower)
+	})
 	if err != nil {
 		return nil, err
 	}
+	m.invalidateFollower(newFollower)
+	if m.listener == nil {
+		m.addFollower(newFollower)
+	}
 	return &FollowResponse{Request: req}, nil
 }
 
-func (m *Model) GetFollowers(ctx context.Context, req *GetFollowersOfUserRequest) (*GetFollowersOfUserResponse, error) {
-	followers, err := database.GetFollowersOfUser(ctx, m.db, req.UserId)
+func (m *Model) GetFollowers(ctx context.Context, req *GetFollowersOfUserRequest) (_ *GetFollowersOfUserResponse, err error) {
+	ctx, end := m.startSpan(ctx, "GetFollowers")
+	defer end(&err)
+
+	followers, err := m.getFollowers(ctx, req.UserId)
 	if err != nil {
 		return nil, err
 	}
 	return &GetFollowersOfUserResponse{Followers: slice.Map(mapUser, followers), Request: req}, nil
 }
 
-func (m *Model) CreateUpvote(ctx context.Context, req *CreateUpvoteRequest) (*CreateUpvoteResponse, error) {
+// StreamFollowers streams the cached followers, which are already held whole
+func (m *Model) StreamFollowers(ctx context.Context, req *GetFollowersOfUserRequest, onItem func(*GetUserResponse) error) (err error) {
+	ctx, end := m.startSpan(ctx, "StreamFollowers")
+	defer end(&err)
+
+	followers, err := m.getFollowers(ctx, req.UserId)
+	if err != nil {
+		return err
+	}
+	for _, follower := range followers {
+		mappedUser := mapUser(follower)
+		if err := onItem(&mappedUser); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Model) getFollowers(ctx context.Context, userId uuid.UUID) ([]*database.User, error) {
+	return m.followers.Get(ctx, userId, func(ctx context.Context) ([]*database.User, []uuid.UUID, error) {
+		followers, err := database.GetFollowersOfUser(ctx, m.db, m.metrics, userId)
+		return followers, nil, err
+	})
+}
+
+func (m *Model) CreateUpvote(ctx context.Context, req *CreateUpvoteRequest) (_ *CreateUpvoteResponse, err error) {
+	ctx, end := m.startSpan(ctx, "CreateUpvote")
+	defer end(&err)
+
 	newUpvote := database.NewUpvote(req.UserId, req.MessageId)
-	err := database.InsertUpvote(ctx, m.db, newUpvote)
+	upvoteId := newUpvote.UpvoteId
+	inserted := false
+	// a user upvotes a message at most once, which the unique index on upvotes enforces: a
+	// repeat upvote inserts nothing, and gets the id of the existing one
+	err = database.WithTx(ctx, m.db, m.metrics, nil, func(tx *sql.Tx) error {
+		var err error
+		inserted, err = database.InsertUpvoteIfAbsent(ctx, tx, m.metrics, newUpvote)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			existing, err := database.GetUpvote(ctx, tx, m.metrics, req.UserId, req.MessageId)
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				return errors.Errorf("upvote of %s by %s conflicted, but wasn't found", req.MessageId, req.UserId)
+			}
+			upvoteId = existing.UpvoteId
+			return nil
+		}
+		return database.InsertOutboxEvent(ctx, tx, m.metrics, database.EventKindUpvote, newUpvote)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &CreateUpvoteResponse{UpvoteId: newUpvote.UpvoteId, Request: req}, nil
+	if inserted {
+		m.invalidateUpvote(newUpvote)
+	}
+	return &CreateUpvoteResponse{UpvoteId: upvoteId, Request: req}, nil
 }
@@ -0,0 +1,81 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mattfenwick/scaling/pkg/database"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestModelSpansRecordErrors(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	model := &Model{tracer: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")}
+
+	for _, err := range []error{
+		nil,
+		&StatusError{Code: http.StatusNotFound, Err: errors.New("no such user")},
+		errors.New("unable to query"),
+	} {
+		_, end := model.startSpan(context.Background(), "test")
+		end(&err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	for i, expected := range []struct {
+		events int
+		status codes.Code
+	}{
+		{events: 0, status: codes.Unset},
+		// client errors are recorded, but the span didn't fail
+		{events: 1, status: codes.Unset},
+		{events: 1, status: codes.Error},
+	} {
+		if events := len(spans[i].Events()); events != expected.events {
+			t.Errorf("span %d: expected %d events, got %d", i, expected.events, events)
+		}
+		if status := spans[i].Status().Code; status != expected.status {
+			t.Errorf("span %d: expected status %s, got %s", i, expected.status, status)
+		}
+	}
+}
+
+func TestUpvoteEventsInvalidateTimelinesWithoutTheDatabase(t *testing.T) {
+	metrics := newTestMetrics(t)
+	// the model has no db, so looking the message up would panic
+	model := &Model{timelines: NewCache[uuid.UUID, []*database.TimelineMessage]("timelines", &CacheConfig{Enabled: true, Size: 10}, metrics)}
+	userId, messageId, otherUserId := uuid.New(), uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{userId, otherUserId} {
+		id := id
+		_, err := model.timelines.Get(context.Background(), id, func(ctx context.Context) ([]*database.TimelineMessage, []uuid.UUID, error) {
+			if id == userId {
+				return nil, []uuid.UUID{uuid.New(), messageId}, nil
+			}
+			return nil, []uuid.UUID{uuid.New()}, nil
+		})
+		if err != nil {
+			t.Fatalf("unable to load timeline: %+v", err)
+		}
+	}
+
+	payload := fmt.Sprintf(`{"upvote_id": "%s", "user_id": "%s", "message_id": "%s", "created_at": "2023-01-02T03:04:05.123456"}`, uuid.New(), otherUserId, messageId)
+	model.handleEvent(&database.Event{EventId: 1, Kind: database.EventKindUpvote, Payload: []byte(payload)})
+
+	model.timelines.mu.Lock()
+	defer model.timelines.mu.Unlock()
+	if _, ok := model.timelines.entries[userId]; ok {
+		t.Errorf("expected the timeline showing the upvoted message to be dropped")
+	}
+	if _, ok := model.timelines.entries[otherUserId]; !ok {
+		t.Errorf("expected other timelines to be kept")
+	}
+}
@@ -0,0 +1,242 @@
+package webserver
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const OpenAPIPath = "/openapi.json"
+
+// a subset of https://spec.openapis.org/oas/v3.0.3 -- just what the route table needs
+
+type OpenAPI struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       *OpenAPIInfo                     `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components *Components                      `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Operation struct {
+	OperationId string               `json:"operationId"`
+	Summary     string               `json:"summary"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// V1OpenAPI documents the v1 routes.  The routes' handlers are never called, so no responder is needed.
+func V1OpenAPI() *OpenAPI {
+	return GenerateOpenAPI(V1Routes((*Model)(nil)))
+}
+
+func GenerateOpenAPI(routes []*Route) *OpenAPI {
+	builder := &schemaBuilder{schemas: map[string]*Schema{}}
+	spec := &OpenAPI{
+		OpenAPI:    "3.0.3",
+		Info:       &OpenAPIInfo{Title: "scaling", Version: "v1"},
+		Paths:      map[string]map[string]*Operation{},
+		Components: &Components{Schemas: builder.schemas},
+	}
+	for _, route := range routes {
+		if _, ok := spec.Paths[route.Path]; !ok {
+			spec.Paths[route.Path] = map[string]*Operation{}
+		}
+		spec.Paths[route.Path][strings.ToLower(route.Method)] = builder.operation(route)
+	}
+	return spec
+}
+
+func (b *schemaBuilder) operation(route *Route) *Operation {
+	op := &Operation{
+		OperationId: operationId(route.Name),
+		Summary:     route.Name,
+		Responses: map[string]*Response{
+			"200": {
+				Description: "success",
+				Content:     map[string]*MediaType{JSONContentType: {Schema: b.schema(route.Response)}},
+			},
+			"400": {Description: "invalid request"},
+			"404": {Description: "not found"},
+			"500": {Description: "server error"},
+			"503": {Description: "overloaded or shutting down"},
+		},
+	}
+	if item := listItemType(route.Response); item != nil {
+		op.Responses["200"].Content[NDJSONContentType] = &MediaType{Schema: b.schema(item)}
+	}
+	for i := 0; i < route.Request.NumField(); i++ {
+		field := route.Request.Field(i)
+		if name, ok := field.Tag.Lookup(pathTag); ok {
+			op.Parameters = append(op.Parameters, &Parameter{Name: name, In: "path", Required: true, Schema: b.schema(field.Type)})
+		} else if name, ok := field.Tag.Lookup(queryTag); ok {
+			op.Parameters = append(op.Parameters, &Parameter{Name: name, In: "query", Schema: b.schema(field.Type)})
+		}
+	}
+	if route.Method != "GET" {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]*MediaType{JSONContentType: {Schema: b.schema(route.Request)}},
+		}
+	}
+	return op
+}
+
+// operationId turns a route name such as "get user timeline" into "getUserTimeline"
+func operationId(name string) string {
+	words := strings.Fields(name)
+	for i := 1; i < len(words); i++ {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	return strings.Join(words, "")
+}
+
+var (
+	uuidType = reflect.TypeOf(uuid.UUID{})
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+type schemaBuilder struct {
+	schemas map[string]*Schema
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) *Schema {
+	switch t {
+	case uuidType:
+		return &Schema{Type: "string", Format: "uuid"}
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		// refs can't carry siblings in 3.0, so nullability of struct pointers is implicit
+		return b.schema(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Nullable: t.Kind() == reflect.Slice, Items: b.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.schema(t.Elem())}
+	case reflect.Struct:
+		return b.structSchema(t)
+	default:
+		// interfaces: anything goes
+		return &Schema{}
+	}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) *Schema {
+	ref := &Schema{Ref: "#/components/schemas/" + t.Name()}
+	if _, ok := b.schemas[t.Name()]; ok {
+		return ref
+	}
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	// register before recursing, so that recursive types terminate
+	b.schemas[t.Name()] = s
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := jsonFieldName(field)
+		if !ok {
+			continue
+		}
+		s.Properties[name] = b.schema(field.Type)
+	}
+	return ref
+}
+
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name, true
+	}
+	return field.Name, true
+}
+
+// ValidateRoutes checks that each route's path template and request type agree
+// about path parameters, and that method/path pairs are unique
+func ValidateRoutes(routes []*Route) error {
+	seen := map[string]bool{}
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		if seen[key] {
+			return errors.Errorf("duplicate route %s", key)
+		}
+		seen[key] = true
+
+		templateParams := map[string]bool{}
+		for _, name := range parsePathTemplate(route.Path).Params {
+			templateParams[name] = true
+		}
+		fieldParams := map[string]bool{}
+		for i := 0; i < route.Request.NumField(); i++ {
+			if name, ok := route.Request.Field(i).Tag.Lookup(pathTag); ok {
+				fieldParams[name] = true
+				if !templateParams[name] {
+					return errors.Errorf("route %s: request field %s is tagged path:%q, which isn't in the path template", key, route.Request.Field(i).Name, name)
+				}
+			}
+		}
+		for name := range templateParams {
+			if !fieldParams[name] {
+				return errors.Errorf("route %s: path parameter %s isn't bound to any field of %s", key, name, route.Request.Name())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// specPath is docs/openapi.json, relative to this package
+const specPath = "../../docs/openapi.json"
+
+func TestV1RoutesAreValid(t *testing.T) {
+	if err := ValidateRoutes(V1Routes((*Model)(nil))); err != nil {
+		t.Fatalf("invalid v1 routes: %+v", err)
+	}
+}
+
+func TestValidateRoutesCatchesDrift(t *testing.T) {
+	type unboundRequest struct{}
+	type misnamedRequest struct {
+		UserId uuid.UUID `path:"user"`
+	}
+	get := func(ctx context.Context, req *GetUserRequest) (*GetUserResponse, error) { return nil, nil }
+	unbound := func(ctx context.Context, req *unboundRequest) (*GetUserResponse, error) { return nil, nil }
+	misnamed := func(ctx context.Context, req *misnamedRequest) (*GetUserResponse, error) { return nil, nil }
+
+	for name, routes := range map[string][]*Route{
+		"duplicate": {NewRoute("a", "GET", V1UserPath, 0, get), NewRoute("b", "GET", V1UserPath, 0, get)},
+		"unbound":   {NewRoute("a", "GET", V1UserPath, 0, unbound)},
+		"misnamed":  {NewRoute("a", "GET", V1UserPath, 0, misnamed)},
+	} {
+		if err := ValidateRoutes(routes); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestOpenAPISpecIsUpToDate fails when the handlers and docs/openapi.json drift apart: run
+// `make openapi` to regenerate it
+func TestOpenAPISpecIsUpToDate(t *testing.T) {
+	generated, err := json.Marshal(GenerateOpenAPI(V1Routes((*Model)(nil))))
+	if err != nil {
+		t.Fatalf("unable to marshal spec: %+v", err)
+	}
+	existing, err := os.ReadFile(specPath)
+	if err != nil {
+		t.Fatalf("unable to read %s: %+v", specPath, err)
+	}
+
+	var generatedSpec, existingSpec any
+	if err := json.Unmarshal(generated, &generatedSpec); err != nil {
+		t.Fatalf("unable to parse generated spec: %+v", err)
+	}
+	if err := json.Unmarshal(existing, &existingSpec); err != nil {
+		t.Fatalf("unable to parse %s: %+v", specPath, err)
+	}
+	if !reflect.DeepEqual(generatedSpec, existingSpec) {
+		t.Fatalf("%s is out of date with the route table: run `make openapi`", specPath)
+	}
+}
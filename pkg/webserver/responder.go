@@ -1,59 +1,85 @@
 package webserver
 
-import "context"
+import (
+	"context"
 
-/*
+	"github.com/google/uuid"
+)
 
-/user
- - POST => create user
- - GET => get user by uuid
-/user/timeline
- - GET => by user's uuid
-/user/messages
- - GET => by user's uuid
+// The http api is documented by the OpenAPI spec served at /openapi.json, which is
+// generated from V1Routes; a copy is checked in at docs/openapi.json.
+//
+// V1Routes and the Client methods are generated from the `route:` annotations below:
+// each annotation gives the http method, the path constant and, optionally, the maximum
+// request body size.  LegacyRoutes are generated from the `legacy:` annotations, in the
+// same form.  A `stream:` annotation names the ListStreamer method which serves the route's
+// NDJSON responses.  After changing an annotated method, run `make generate`.
 
-/users
- - POST => fancy search
- - GET => naive list of users
-
-/message
- - POST => create
- - GET => by message's uuid
-/messages
- - POST => fancy search
- - GET => naive list of messages
-
-/follow
- - POST
-/followers
- - GET => by user's uuid
-
-/upvote
- - POST
-
-*/
+//go:generate go run ../../cmd/hack
 
 type Responder interface {
+	// ListStreamer serves list requests for NDJSON row by row; see the `stream:` annotations
+	ListStreamer
+
 	Sleep(ctx context.Context, seconds string) error
+	// SubscribeTimeline backs the timeline stream; the caller must Close the subscription
+	SubscribeTimeline(ctx context.Context, userId uuid.UUID) (*Subscription, error)
 
+	// route: POST V1UsersPath 1000
+	// legacy: POST UserPath 1000
 	CreateUser(context.Context, *CreateUserRequest) (*CreateUserResponse, error)
+	// route: GET V1UserPath
+	// legacy: GET UserPath 1000
 	GetUser(context.Context, *GetUserRequest) (*GetUserResponse, error)
+	// route: GET V1UserTimelinePath
+	// legacy: POST UserTimelinePath 1000
+	// stream: StreamUserTimeline
 	GetUserTimeline(context.Context, *GetUserTimelineRequest) (*GetUserTimelineResponse, error) // TODO paginate
+	// route: GET V1UserMessagesPath
+	// legacy: POST UserMessagesPath 1000
+	// stream: StreamUserMessages
 	GetUserMessages(context.Context, *GetUserMessagesRequest) (*GetUserMessagesResponse, error) // TODO paginate
-	GetUsers(context.Context, *GetUsersRequest) (*GetUsersResponse, error)                      // TODO paginate
-	SearchUsers(context.Context, *SearchUsersRequest) (*SearchUsersResponse, error)             // TODO paginate
+	// route: GET V1UsersPath
+	// legacy: GET UsersPath 1000
+	// stream: StreamUsers
+	GetUsers(context.Context, *GetUsersRequest) (*GetUsersResponse, error) // TODO paginate
+	// route: GET V1UsersSearchPath
+	// legacy: POST UsersPath 1000
+	// stream: StreamSearchUsers
+	SearchUsers(context.Context, *SearchUsersRequest) (*SearchUsersResponse, error) // TODO paginate
 
+	// route: POST V1MessagesPath 1000
+	// legacy: POST MessagePath 1000
 	CreateMessage(context.Context, *CreateMessageRequest) (*CreateMessageResponse, error)
+	// route: GET V1MessagePath
+	// legacy: GET MessagePath 1000
 	GetMessage(context.Context, *GetMessageRequest) (*GetMessageResponse, error)
-	GetMessages(context.Context, *GetMessagesRequest) (*GetMessagesResponse, error)          // TODO pagniate
+	// route: GET V1MessagesPath
+	// legacy: GET MessagesPath 1000
+	// stream: StreamMessages
+	GetMessages(context.Context, *GetMessagesRequest) (*GetMessagesResponse, error) // TODO pagniate
+	// route: GET V1MessagesSearchPath
+	// legacy: POST MessagesPath 1000
+	// stream: StreamSearchMessages
 	SearchMessages(context.Context, *SearchMessagesRequest) (*SearchMessagesResponse, error) // TODO paginate
 
+	// route: POST V1UserFollowersPath 1000
+	// legacy: POST FollowPath 1000
 	Follow(context.Context, *FollowRequest) (*FollowResponse, error)
+	// route: GET V1UserFollowersPath
+	// legacy: GET FollowersPath 1000
+	// stream: StreamFollowers
 	GetFollowers(context.Context, *GetFollowersOfUserRequest) (*GetFollowersOfUserResponse, error)
+	// CreateUpvote used to record every upvote; now a repeat upvote of a message by the same
+	// user records nothing, and returns the id of the first one.
+	// route: POST V1MessageUpvotesPath 1000
+	// legacy: POST UpvotePath 1000
 	CreateUpvote(context.Context, *CreateUpvoteRequest) (*CreateUpvoteResponse, error)
 
 	IsLive(context.Context) bool
 	IsReady(context.Context) bool
+	SetReadiness(context.Context, *SetReadinessRequest) (*SetReadinessResponse, error)
+	Health(context.Context) (*HealthResponse, error)
 
-	Dump(ctx context.Context) (string, error)
+	Dump(ctx context.Context) (*DumpResponse, error)
 }
@@ -0,0 +1,209 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+)
+
+// Route binds a method and path template, such as `/v1/users/{userid}`, to a handler
+type Route struct {
+	Name    string
+	Method  string
+	Path    string
+	MaxSize int64
+	Handler func(ctx context.Context, body string, values url.Values) (any, error)
+	// Stream, if set, sends a list's items as they're read, to clients which ask for NDJSON
+	Stream   StreamFunc
+	Request  reflect.Type
+	Response reflect.Type
+}
+
+// StreamFunc calls onItem with each item of a list, stopping at the first error
+type StreamFunc func(ctx context.Context, body string, values url.Values, onItem func(any) error) error
+
+func NewRoute[Req, Resp any](name string, method string, path string, maxSize int64, f func(context.Context, *Req) (*Resp, error)) *Route {
+	return &Route{
+		Name:     name,
+		Method:   method,
+		Path:     path,
+		MaxSize:  maxSize,
+		Handler:  handle(f),
+		Request:  reflect.TypeOf((*Req)(nil)).Elem(),
+		Response: reflect.TypeOf((*Resp)(nil)).Elem(),
+	}
+}
+
+// NewListRoute is NewRoute for a list, whose items stream sends as they're read
+func NewListRoute[Req, Resp, Item any](name string, method string, path string, maxSize int64, f func(context.Context, *Req) (*Resp, error), stream func(context.Context, *Req, func(*Item) error) error) *Route {
+	route := NewRoute(name, method, path, maxSize, f)
+	route.Stream = handleStream(stream)
+	return route
+}
+
+type pathTemplate struct {
+	Path     string
+	Segments []string
+	// Params maps segment index to parameter name
+	Params map[int]string
+}
+
+func parsePathTemplate(path string) *pathTemplate {
+	t := &pathTemplate{Path: path, Segments: splitPath(path), Params: map[int]string{}}
+	for i, segment := range t.Segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			t.Params[i] = segment[1 : len(segment)-1]
+		}
+	}
+	return t
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func (t *pathTemplate) Match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(t.Segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range t.Segments {
+		if name, ok := t.Params[i]; ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[name] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (t *pathTemplate) Expand(params map[string]string) (string, error) {
+	out := make([]string, len(t.Segments))
+	for i, segment := range t.Segments {
+		if name, ok := t.Params[i]; ok {
+			value, ok := params[name]
+			if !ok {
+				return "", errors.Errorf("missing path parameter %s for %s", name, t.Path)
+			}
+			out[i] = url.PathEscape(value)
+		} else {
+			out[i] = segment
+		}
+	}
+	return "/" + strings.Join(out, "/"), nil
+}
+
+func ExpandPath(path string, params map[string]string) (string, error) {
+	return parsePathTemplate(path).Expand(params)
+}
+
+type routerEntry struct {
+	template *pathTemplate
+	handler  http.Handler
+}
+
+// Router dispatches on path templates; routes sharing a template share a handler, which
+// takes care of method dispatch.  Where several templates match, the one with the fewest
+// parameters wins, so `/v1/users/search` takes priority over `/v1/users/{userid}`.
+type Router struct {
+	Routes   []*Route
+	entries  []*routerEntry
+	notFound http.Handler
+}
+
+func NewRouter(routes []*Route, metrics *telemetry.Metrics, accessLog *AccessLogConfig) *Router {
+	var paths []string
+	methodHandlers := map[string]map[string]func(ctx context.Context, body string, values url.Values) (any, error){}
+	streamHandlers := map[string]map[string]StreamFunc{}
+	maxSizes := map[string]int64{}
+	for _, route := range routes {
+		if _, ok := methodHandlers[route.Path]; !ok {
+			paths = append(paths, route.Path)
+			methodHandlers[route.Path] = map[string]func(ctx context.Context, body string, values url.Values) (any, error){}
+			streamHandlers[route.Path] = map[string]StreamFunc{}
+		}
+		methodHandlers[route.Path][route.Method] = route.Handler
+		if route.Stream != nil {
+			streamHandlers[route.Path][route.Method] = route.Stream
+		}
+		if route.MaxSize > maxSizes[route.Path] {
+			maxSizes[route.Path] = route.MaxSize
+		}
+	}
+
+	router := &Router{Routes: routes, notFound: notFoundHandler(metrics, accessLog)}
+	for _, path := range paths {
+		router.entries = append(router.entries, &routerEntry{
+			template: parsePathTemplate(path),
+			handler:  instrument(metrics, accessLog, http.HandlerFunc(ListHandler(maxSizes[path], methodHandlers[path], streamHandlers[path])), path),
+		})
+	}
+	return router
+}
+
+// Handle adds a handler which doesn't fit the Route model, such as a stream.  It's up
+// to handler to check the method.
+func (router *Router) Handle(path string, handler http.Handler) {
+	router.entries = append(router.entries, &routerEntry{template: parsePathTemplate(path), handler: handler})
+}
+
+func (router *Router) match(path string) (*routerEntry, map[string]string) {
+	segments := splitPath(path)
+	var best *routerEntry
+	var bestParams map[string]string
+	for _, entry := range router.entries {
+		params, ok := entry.template.Match(segments)
+		if ok && (best == nil || len(entry.template.Params) < len(best.template.Params)) {
+			best, bestParams = entry, params
+		}
+	}
+	return best, bestParams
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entry, params := router.match(r.URL.Path)
+	if entry == nil {
+		router.notFound.ServeHTTP(w, r)
+		return
+	}
+	entry.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params)))
+}
+
+// Templates are the path templates router serves, which label the metrics of their requests
+func (router *Router) Templates() []string {
+	templates := make([]string, len(router.entries))
+	for i, entry := range router.entries {
+		templates[i] = entry.template.Path
+	}
+	return templates
+}
+
+// ValidateSLORoutes checks that every SLO is on one of router's templates, or on
+// UnmatchedRoute, since an SLO on any other route would never see a request
+func ValidateSLORoutes(configs []telemetry.SLOConfig, router *Router) error {
+	routes := map[string]bool{UnmatchedRoute: true}
+	for _, template := range router.Templates() {
+		routes[template] = true
+	}
+	for _, config := range configs {
+		if !routes[config.Route] {
+			return errors.Errorf("SLO %s is on unknown route %s", config.NameOrDefault(), config.Route)
+		}
+	}
+	return nil
+}
+
+type pathParamsKey struct{}
+
+func PathParams(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(pathParamsKey{}).(map[string]string)
+	return params
+}
@@ -0,0 +1,81 @@
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestValidateSLORoutes(t *testing.T) {
+	metrics := newTestMetrics(t)
+	router := NewV1Router((*Model)(nil), 0, &AccessLogConfig{}, metrics)
+
+	for _, route := range []string{V1UserPath, V1UserTimelineStreamPath, UnmatchedRoute} {
+		if err := ValidateSLORoutes([]telemetry.SLOConfig{{Route: route, Objective: 0.99}}, router); err != nil {
+			t.Errorf("expected an SLO on %s to be valid, got %+v", route, err)
+		}
+	}
+	// a concrete path, rather than its template, never labels a request
+	for _, route := range []string{"/v1/users/123", "/users", ""} {
+		if err := ValidateSLORoutes([]telemetry.SLOConfig{{Route: route, Objective: 0.99}}, router); err == nil {
+			t.Errorf("expected an SLO on %q to be invalid", route)
+		}
+	}
+}
+
+func TestMethodNotAllowedListsAllowedMethods(t *testing.T) {
+	metrics := newTestMetrics(t)
+	accessLog := &AccessLogConfig{Disabled: true}
+	router := NewV1Router((*Model)(nil), 0, accessLog, metrics)
+	server := SetupHTTPServer((*Model)(nil), router, accessLog, trace.NewNoopTracerProvider(), metrics)
+
+	for _, testCase := range []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{method: "DELETE", path: V1UsersPath, allow: "GET, POST"},
+		{method: "PUT", path: "/v1/users/" + uuid.New().String(), allow: "GET"},
+		{method: "POST", path: "/v1/users/" + uuid.New().String() + "/timeline/stream", allow: "GET"},
+		{method: "POST", path: HealthzPath, allow: "GET"},
+	} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(testCase.method, testCase.path, nil))
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != testCase.allow {
+			t.Errorf("%s %s: expected a 405 allowing %s, got %d allowing %q", testCase.method, testCase.path, testCase.allow, recorder.Code, recorder.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestRouterBindsPathParams(t *testing.T) {
+	var bound *GetUserRequest
+	getUser := func(ctx context.Context, request *GetUserRequest) (*GetUserResponse, error) {
+		bound = request
+		return &GetUserResponse{UserId: request.UserId}, nil
+	}
+	router := NewRouter([]*Route{NewRoute("get user", "GET", V1UserPath, 0, getUser)}, newTestMetrics(t), &AccessLogConfig{Disabled: true})
+
+	userId := uuid.New()
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/users/"+userId.String(), nil))
+	if recorder.Code != http.StatusOK || bound == nil || bound.UserId != userId {
+		t.Errorf("expected user id %s to be bound from the path, got %d and %+v", userId, recorder.Code, bound)
+	}
+
+	for path, code := range map[string]int{
+		"/v1/users/not-a-uuid":                      http.StatusBadRequest,
+		"/v1/users/" + userId.String() + "/unknown": http.StatusNotFound,
+		"/v1/users/":                                http.StatusNotFound,
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != code {
+			t.Errorf("%s: expected a %d, got %d", path, code, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Code generated by cmd/hack from responder.go; DO NOT EDIT.
+
+package webserver
+
+func V1Routes(responder Responder) []*Route {
+	return []*Route{
+		NewRoute("create user", "POST", V1UsersPath, 1000, responder.CreateUser),
+		NewRoute("get user", "GET", V1UserPath, 0, responder.GetUser),
+		NewListRoute("get user timeline", "GET", V1UserTimelinePath, 0, responder.GetUserTimeline, responder.StreamUserTimeline),
+		NewListRoute("get user messages", "GET", V1UserMessagesPath, 0, responder.GetUserMessages, responder.StreamUserMessages),
+		NewListRoute("get users", "GET", V1UsersPath, 0, responder.GetUsers, responder.StreamUsers),
+		NewListRoute("search users", "GET", V1UsersSearchPath, 0, responder.SearchUsers, responder.StreamSearchUsers),
+		NewRoute("create message", "POST", V1MessagesPath, 1000, responder.CreateMessage),
+		NewRoute("get message", "GET", V1MessagePath, 0, responder.GetMessage),
+		NewListRoute("get messages", "GET", V1MessagesPath, 0, responder.GetMessages, responder.StreamMessages),
+		NewListRoute("search messages", "GET", V1MessagesSearchPath, 0, responder.SearchMessages, responder.StreamSearchMessages),
+		NewRoute("follow", "POST", V1UserFollowersPath, 1000, responder.Follow),
+		NewListRoute("get followers", "GET", V1UserFollowersPath, 0, responder.GetFollowers, responder.StreamFollowers),
+		NewRoute("create upvote", "POST", V1MessageUpvotesPath, 1000, responder.CreateUpvote),
+	}
+}
+
+// LegacyRoutes are the unversioned routes kept for existing clients, which send path
+// parameters in the query string or the body
+func LegacyRoutes(responder Responder) []*Route {
+	return []*Route{
+		NewRoute("create user", "POST", UserPath, 1000, responder.CreateUser),
+		NewRoute("get user", "GET", UserPath, 1000, responder.GetUser),
+		NewListRoute("get user timeline", "POST", UserTimelinePath, 1000, responder.GetUserTimeline, responder.StreamUserTimeline),
+		NewListRoute("get user messages", "POST", UserMessagesPath, 1000, responder.GetUserMessages, responder.StreamUserMessages),
+		NewListRoute("get users", "GET", UsersPath, 1000, responder.GetUsers, responder.StreamUsers),
+		NewListRoute("search users", "POST", UsersPath, 1000, responder.SearchUsers, responder.StreamSearchUsers),
+		NewRoute("create message", "POST", MessagePath, 1000, responder.CreateMessage),
+		NewRoute("get message", "GET", MessagePath, 1000, responder.GetMessage),
+		NewListRoute("get messages", "GET", MessagesPath, 1000, responder.GetMessages, responder.StreamMessages),
+		NewListRoute("search messages", "POST", MessagesPath, 1000, responder.SearchMessages, responder.StreamSearchMessages),
+		NewRoute("follow", "POST", FollowPath, 1000, responder.Follow),
+		NewListRoute("get followers", "GET", FollowersPath, 1000, responder.GetFollowers, responder.StreamFollowers),
+		NewRoute("create upvote", "POST", UpvotePath, 1000, responder.CreateUpvote),
+	}
+}
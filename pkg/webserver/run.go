@@ -4,26 +4,264 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/mattfenwick/scaling/pkg/database"
-	"github.com/mattfenwick/scaling/pkg/utils"
+	"github.com/mattfenwick/scaling/pkg/outbox"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
-func Run(port int, tp trace.TracerProvider, db *sql.DB) {
-	addr := fmt.Sprintf(":%d", port)
+type Config struct {
+	Host          string
+	ContainerPort int
+	ServicePort   int
+
+	// GRPCContainerPort serves the API over gRPC as well, if set
+	GRPCContainerPort int
+	GRPCServicePort   int
+
+	// DrainSeconds is how long to keep serving after readiness has been
+	// flipped to false, giving load balancers time to stop sending traffic.
+	DrainSeconds int
+	// ShutdownTimeoutSeconds bounds how long in-flight requests get to finish.
+	ShutdownTimeoutSeconds int
+
+	// HealthCacheMilliseconds is how long dependency check results are reused,
+	// so that frequent probes don't hammer postgres.
+	HealthCacheMilliseconds int
+
+	// EventLoopQueueSize is how many actions may wait before new ones are shed with a 503
+	EventLoopQueueSize int
+	// EventLoopWorkers is how many actions are processed concurrently
+	EventLoopWorkers int
+	// EventLoopActionTimeoutMilliseconds caps each action's run time, in addition to the request's deadline
+	EventLoopActionTimeoutMilliseconds int
+
+	// StreamBufferSize is how many events a timeline stream may fall behind before it misses some
+	StreamBufferSize int
+	// StreamHeartbeatSeconds is how often idle timeline streams get a keepalive comment
+	StreamHeartbeatSeconds int
+
+	// Outbox configures webhook delivery of writes
+	Outbox outbox.Config
+
+	// EventRetentionMinutes is how long write events are kept for replicas to catch up on
+	EventRetentionMinutes int
+
+	// Cache configures in-process caching of hot reads
+	Cache CacheConfig
+
+	// SLOs are tracked from this replica's own requests, and reported by /dump and as metrics
+	SLOs []telemetry.SLOConfig
+
+	// AccessLog controls the line logged for each request
+	AccessLog AccessLogConfig
+}
+
+func (c *Config) DrainPeriod() time.Duration {
+	return time.Duration(c.DrainSeconds) * time.Second
+}
+
+func (c *Config) ShutdownTimeout() time.Duration {
+	if c.ShutdownTimeoutSeconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.ShutdownTimeoutSeconds) * time.Second
+}
+
+func (c *Config) HealthCacheDuration() time.Duration {
+	if c.HealthCacheMilliseconds <= 0 {
+		return 1 * time.Second
+	}
+	return time.Duration(c.HealthCacheMilliseconds) * time.Millisecond
+}
+
+func (c *Config) EventLoopQueueSizeOrDefault() int {
+	if c.EventLoopQueueSize <= 0 {
+		return 100
+	}
+	return c.EventLoopQueueSize
+}
+
+func (c *Config) EventLoopWorkersOrDefault() int {
+	if c.EventLoopWorkers <= 0 {
+		return 1
+	}
+	return c.EventLoopWorkers
+}
+
+func (c *Config) StreamBufferSizeOrDefault() int {
+	if c.StreamBufferSize <= 0 {
+		return 16
+	}
+	return c.StreamBufferSize
+}
+
+func (c *Config) StreamHeartbeat() time.Duration {
+	if c.StreamHeartbeatSeconds <= 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(c.StreamHeartbeatSeconds) * time.Second
+}
+
+func (c *Config) EventRetention() time.Duration {
+	if c.EventRetentionMinutes <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.EventRetentionMinutes) * time.Minute
+}
+
+func (c *Config) EventLoopActionTimeout() time.Duration {
+	return time.Duration(c.EventLoopActionTimeoutMilliseconds) * time.Millisecond
+}
+
+// Run serves until it receives SIGINT or SIGTERM.  effectiveConfig is reported
+// as-is by /dump, so secrets must already have been redacted.  Writes from other
+// replicas are picked up through listener; it may be nil if there's only one replica.
+// Operator-only handlers are added to admin, the admin port's serveMux.
+func Run(config *Config, effectiveConfig any, tp trace.TracerProvider, metrics *telemetry.Metrics, admin *http.ServeMux, db *sql.DB, listener *database.Listener) error {
+	addr := fmt.Sprintf(":%d", config.ContainerPort)
 
 	rootContext := context.Background()
 	ctx, cancel := context.WithTimeout(rootContext, 10*time.Second)
 	defer cancel()
-	utils.Die(database.InitializeSchema(ctx, db))
+	if err := database.InitializeSchema(ctx, db, metrics); err != nil {
+		return err
+	}
+
+	model := NewModel(rootContext, config, effectiveConfig, tp, metrics, db, listener)
+	router := NewV1Router(model, config.StreamHeartbeat(), &config.AccessLog, metrics)
+	if err := ValidateSLORoutes(config.SLOs, router); err != nil {
+		return err
+	}
+	if err := metrics.TrackSLOs(config.SLOs); err != nil {
+		return err
+	}
+	backgroundContext, stopBackground := context.WithCancel(rootContext)
+	defer stopBackground()
+	if listener != nil {
+		go listener.Run(backgroundContext)
+	}
+	go outbox.NewDispatcher(&config.Outbox, db, metrics).Run(backgroundContext)
+	SetupAdminHandlers(admin, model, &config.AccessLog, metrics)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: SetupHTTPServer(model, router, &config.AccessLog, tp, metrics),
+	}
+	var grpcServer *grpc.Server
+
+	// from here on, failures have to stop everything that's been started
+	failed := func(err error) error {
+		logrus.Errorf("shutting down after failure: %+v", err)
+		if shutdownErr := shutdown(config, server, grpcServer, model, listener, stopBackground, db); shutdownErr != nil {
+			logrus.Errorf("unable to shut down cleanly: %+v", shutdownErr)
+		}
+		return err
+	}
+
+	// both ports are bound before either is served, so that a failure to bind leaves
+	// nothing serving
+	var grpcListener net.Listener
+	if config.GRPCContainerPort > 0 {
+		grpcAddr := fmt.Sprintf(":%d", config.GRPCContainerPort)
+		var err error
+		grpcListener, err = net.Listen("tcp", grpcAddr)
+		if err != nil {
+			return failed(errors.Wrapf(err, "unable to listen on %s", grpcAddr))
+		}
+		grpcServer = NewGRPCServer(model, &config.AccessLog, tp, metrics)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	serverErrors := make(chan error, 2)
+	go func() {
+		logrus.Infof("listening on port %s", addr)
+		serverErrors <- errors.Wrapf(server.ListenAndServe(), "unable to serve on %s", addr)
+	}()
+	if grpcServer != nil {
+		go func() {
+			logrus.Infof("serving grpc on port %s", grpcListener.Addr())
+			serverErrors <- errors.Wrapf(grpcServer.Serve(grpcListener), "unable to serve grpc on %s", grpcListener.Addr())
+		}()
+	}
+
+	select {
+	case err := <-serverErrors:
+		return failed(err)
+	case <-signals:
+		logrus.Infof("received shutdown signal")
+	}
+
+	drain(config, model, signals)
+	return shutdown(config, server, grpcServer, model, listener, stopBackground, db)
+}
+
+// drain keeps serving after readiness has been flipped to false, until load balancers have
+// had time to stop sending traffic.  A second signal cuts it short.
+func drain(config *Config, model *Model, signals <-chan os.Signal) {
+	logrus.Infof("marking not ready, draining for %s", config.DrainPeriod())
+	model.SetReady(false)
+	select {
+	case <-time.After(config.DrainPeriod()):
+	case <-signals:
+		logrus.Warnf("received second shutdown signal, skipping the rest of the drain")
+	}
+}
+
+// shutdown stops everything Run started.  Each step is attempted even if an earlier one
+// failed, so that the database is always closed; the first error is returned, and the
+// rest are logged.
+func shutdown(config *Config, server *http.Server, grpcServer *grpc.Server, model *Model, listener *database.Listener, stopBackground func(), db *sql.DB) error {
+	var err error
+	check := func(stepErr error) {
+		if stepErr == nil {
+			return
+		}
+		if err == nil {
+			err = stepErr
+		} else {
+			logrus.Errorf("shutdown: %+v", stepErr)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout())
+	defer cancel()
+
+	// streams never go idle, so they have to be ended before the http server can drain
+	logrus.Infof("closing timeline streams")
+	model.CloseStreams()
+
+	logrus.Infof("shutting down http server")
+	check(errors.Wrapf(server.Shutdown(ctx), "unable to shut down http server"))
+	if grpcServer != nil {
+		logrus.Infof("shutting down grpc server")
+		check(stopGRPCServer(ctx, grpcServer))
+	}
+
+	logrus.Infof("draining event loop")
+	check(model.Stop(ctx))
+
+	logrus.Infof("stopping webhook dispatcher and event listener loop")
+	stopBackground()
 
-	model := NewModel(rootContext, tp, db)
-	serveMux := SetupHTTPServer(model, tp)
+	if listener != nil {
+		logrus.Infof("closing event listener")
+		check(listener.Close())
+	}
 
-	logrus.Infof("listening on port %s", addr)
-	utils.Die(http.ListenAndServe(addr, serveMux))
+	logrus.Infof("closing database connections")
+	check(errors.Wrapf(db.Close(), "unable to close database"))
+	return err
 }
@@ -0,0 +1,172 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattfenwick/scaling/pkg/telemetry"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TimelineStreamHandler pushes a user's new timeline messages as server-sent events:
+//
+//	id: <message id>
+//	event: message
+//	data: <TimelineEvent json>
+//
+// Comment lines are sent every heartbeat, so that idle streams aren't cut off by proxies.
+// The stream ends when the client disconnects, or when the server shuts down.
+func TimelineStreamHandler(responder Responder, heartbeat time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := telemetry.Logger(r.Context())
+		code := 200
+
+		if r.Method != "GET" {
+			code = http.StatusMethodNotAllowed
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", code)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			code = 500
+			http.Error(w, "streaming not supported", code)
+			return
+		}
+		userId, err := uuid.Parse(PathParams(r.Context())["userid"])
+		if err != nil {
+			code = 400
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		sub, err := responder.SubscribeTimeline(r.Context(), userId)
+		if err != nil {
+			code = errorStatusCode(err)
+			log.Errorf("unable to subscribe to timeline of %s: %+v", userId, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer sub.Close()
+
+		header := w.Header()
+		header.Set("content-type", "text/event-stream")
+		header.Set("cache-control", "no-cache")
+		// ask nginx not to buffer the stream
+		header.Set("x-accel-buffering", "no")
+		w.WriteHeader(code)
+		flusher.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case event, ok := <-sub.Events:
+				if !ok {
+					return
+				}
+				// data must be a single line, so no indentation
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Errorf("unable to marshal event %s: %+v", event.MessageId, err)
+					continue
+				}
+				_, err = fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", event.MessageId, data)
+				if err != nil {
+					log.Debugf("unable to write to timeline stream of %s: %s", userId, err.Error())
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// serveStream writes a list as NDJSON, item by item as stream reads them.  Its size and
+// ETag aren't known until it's finished, so neither is sent.  Headers wait for the first
+// item, so that a failure before then still gets an error status; after that, failures
+// can only cut the body short.
+func serveStream(w http.ResponseWriter, r *http.Request, stream StreamFunc) {
+	log := telemetry.Logger(r.Context())
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+	childCtx, childCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer childCancel()
+
+	values := r.URL.Query()
+	for name, value := range PathParams(ctx) {
+		values.Set(name, value)
+	}
+
+	header := w.Header()
+	header.Add("Vary", "Accept")
+	header.Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+
+	var out io.WriteCloser
+	var encoder *json.Encoder
+	count := 0
+	start := func() {
+		header.Set("Content-Type", NDJSONContentType)
+		if r.Method == "GET" {
+			header.Set("Cache-Control", getCacheControl)
+		}
+		if encoding != "" {
+			header.Set("Content-Encoding", encoding)
+		}
+		w.WriteHeader(200)
+		out = compress(w, encoding)
+		encoder = json.NewEncoder(out)
+	}
+
+	span.AddEvent("start process")
+	err = stream(childCtx, string(body), values, func(item any) error {
+		if out == nil {
+			start()
+		}
+		count++
+		return errors.Wrapf(encoder.Encode(item), "unable to encode item %d", count-1)
+	})
+	span.AddEvent("finish process")
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if out == nil {
+			code := errorStatusCode(err)
+			log.Errorf("http error: %s to %s, code %d, error %+v", r.Method, r.URL.Path, code, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		log.Errorf("unable to finish streaming %s to %s after %d items: %+v", r.Method, r.URL.Path, count, err)
+	}
+	if out == nil {
+		// an empty list is an empty body
+		start()
+	}
+	if err := out.Close(); err != nil {
+		log.Errorf("unable to finish response body: %+v", err)
+	} else {
+		log.Debugf("streamed %d items, encoding '%s'", count, encoding)
+	}
+}
@@ -0,0 +1,159 @@
+package webserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattfenwick/collections/pkg/json"
+)
+
+// timelineResponder subscribes every stream to sender's messages
+type timelineResponder struct {
+	Responder
+	hub    *Hub
+	sender uuid.UUID
+}
+
+func (r *timelineResponder) SubscribeTimeline(ctx context.Context, userId uuid.UUID) (*Subscription, error) {
+	return r.hub.Subscribe(userId, []uuid.UUID{r.sender}), nil
+}
+
+func newTimelineServer(t *testing.T, heartbeat time.Duration) (*timelineResponder, *httptest.Server) {
+	metrics := newTestMetrics(t)
+	responder := &timelineResponder{hub: NewHub(10, metrics), sender: uuid.New()}
+	server := httptest.NewServer(NewV1Router(responder, heartbeat, &AccessLogConfig{Disabled: true}, metrics))
+	t.Cleanup(server.Close)
+	t.Cleanup(responder.hub.Close)
+	return responder, server
+}
+
+// waitForSubscribers waits until the hub has count open streams
+func waitForSubscribers(t *testing.T, hub *Hub, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.Count() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d streams, have %d", count, hub.Count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTimelineStreamSendsEventsAndHeartbeats(t *testing.T) {
+	responder, server := newTimelineServer(t, 10*time.Millisecond)
+	response, err := http.Get(server.URL + fmt.Sprintf("/v1/users/%s/timeline/stream", uuid.New()))
+	if err != nil {
+		t.Fatalf("unable to open stream: %+v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected a 200 event stream, got %d and %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	// readUntil returns the lines up to and including the first which starts with prefix
+	readUntil := func(prefix string) []string {
+		var read []string
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("stream ended before %q, after %q", prefix, read)
+				}
+				read = append(read, line)
+				if strings.HasPrefix(line, prefix) {
+					return read
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %q, after %q", prefix, read)
+			}
+		}
+	}
+
+	readUntil(": heartbeat")
+
+	waitForSubscribers(t, responder.hub, 1)
+	event := &TimelineEvent{MessageId: uuid.New(), SenderUserId: responder.sender, Content: "hello", CreatedAt: time.Now().UTC()}
+	// another sender's messages aren't part of the timeline
+	responder.hub.Publish(&TimelineEvent{MessageId: uuid.New(), SenderUserId: uuid.New()})
+	responder.hub.Publish(event)
+
+	read := readUntil("id: ")
+	if id := read[len(read)-1]; id != "id: "+event.MessageId.String() {
+		t.Fatalf("expected the published event, got %q", id)
+	}
+	if kind := readUntil("event: "); kind[len(kind)-1] != "event: message" {
+		t.Errorf("expected a message event, got %q", kind)
+	}
+	data := readUntil("data: ")
+	received, err := json.ParseString[TimelineEvent](strings.TrimPrefix(data[len(data)-1], "data: "))
+	if err != nil || received.MessageId != event.MessageId || received.Content != event.Content {
+		t.Errorf("expected data for %+v, got %+v (%+v)", event, received, err)
+	}
+
+	// shutting down ends the stream
+	responder.hub.Close()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for the stream to end")
+		}
+	}
+}
+
+func TestClientStreamTimeline(t *testing.T) {
+	responder, server := newTimelineServer(t, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan *TimelineEvent, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- NewClient(server.URL).StreamTimeline(ctx, uuid.New(), func(event *TimelineEvent) {
+			events <- event
+		})
+	}()
+
+	waitForSubscribers(t, responder.hub, 1)
+	event := &TimelineEvent{MessageId: uuid.New(), SenderUserId: responder.sender, Content: "hello", CreatedAt: time.Now().UTC()}
+	responder.hub.Publish(event)
+	select {
+	case received := <-events:
+		if received.MessageId != event.MessageId || received.Content != event.Content || !received.CreatedAt.Equal(event.CreatedAt) {
+			t.Errorf("expected %+v, got %+v", event, received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the event")
+	}
+
+	// heartbeats aren't events
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected cancelling to end the stream cleanly, got %+v", err)
+	}
+	select {
+	case extra := <-events:
+		t.Errorf("expected only the published event, got %+v", extra)
+	default:
+	}
+}